@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/campbel/tiny-tunnel/core/client"
+	"github.com/campbel/tiny-tunnel/internal/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	localPort int
+	proxyMode bool
+)
+
+// connectCmd represents the connect command
+var connectCmd = &cobra.Command{
+	Use:   "connect <name>",
+	Short: "Forward a local port to a private tunnel",
+	Long: `Open a local listener whose connections are piped through the server to a private tunnel (started with tnl start --private), like ssh -L.
+
+With --proxy the listener is a SOCKS5 and HTTP CONNECT proxy whose connections are dialed by an egress proxy tunnel (started with tnl start --egress-proxy), like ssh -D.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger := log.NewBasicLogger(os.Getenv("DEBUG") == "true")
+		options := client.Options{
+			Name:       args[0],
+			ServerHost: serverHost,
+			ServerPort: serverPort,
+			Insecure:   insecure,
+			Token:      token,
+		}
+		useDefaultServer(&options, logger)
+
+		ln, err := net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(localPort)))
+		if err != nil {
+			return err
+		}
+		if proxyMode {
+			fmt.Printf("SOCKS5 and HTTP CONNECT proxy on %s, dialing through egress proxy tunnel %s\n", ln.Addr(), options.Name)
+			return client.ServeProxy(cmd.Context(), options, ln, logger)
+		}
+		fmt.Printf("Forwarding %s to private tunnel %s\n", ln.Addr(), options.Name)
+		return client.Connect(cmd.Context(), options, ln, logger)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(connectCmd)
+	connectCmd.Flags().IntVarP(&localPort, "local-port", "l", 0, "Local port to listen on (0 picks a free one)")
+	connectCmd.Flags().BoolVar(&proxyMode, "proxy", false, "Serve a SOCKS5 and HTTP CONNECT proxy on the local port, dialing through an egress proxy tunnel")
+	connectCmd.Flags().StringVarP(&serverHost, "server-host", "s", "", "Host of the server (if empty, uses default from config)")
+	connectCmd.Flags().StringVarP(&serverPort, "server-port", "p", "", "Port of the server (if empty, uses default from config)")
+	connectCmd.Flags().BoolVarP(&insecure, "insecure", "i", false, "Use insecure connection to the server")
+	connectCmd.Flags().StringVar(&token, "token", "", "JWT authentication token")
+}
@@ -5,6 +5,7 @@ package cmd
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"os"
 	"time"
@@ -23,6 +24,17 @@ var (
 	tokenTTL         time.Duration
 	accessPort       string
 	accessScheme     string
+	maxRequestBody   int64
+	maxWSMessage     int64
+	headerTimeout    time.Duration
+	idleTimeout      time.Duration
+	drainTimeout     time.Duration
+	resumeGrace      time.Duration
+	tcpPorts         string
+	udpPorts         string
+	udpIdleTimeout   time.Duration
+	passthroughAddr  string
+	trustedProxies   []string
 )
 
 // serveCmd represents the serve command
@@ -36,15 +48,39 @@ var serveCmd = &cobra.Command{
 
 		ctx := cmd.Context()
 
+		ports, err := server.ParsePortRange(tcpPorts)
+		if err != nil {
+			return err
+		}
+		udpRange, err := server.ParsePortRange(udpPorts)
+		if err != nil {
+			return err
+		}
+
+		trusted, err := server.ParseNetworks(trustedProxies)
+		if err != nil {
+			return err
+		}
+
 		router := server.NewHandler(server.Options{
-			Hostname:         hostname,
-			EnableAuth:       enableAuth,
-			GuardianURL:      guardianURL,
-			GuardianAudience: guardianAudience,
-			SigningKey:       os.Getenv("TINY_TUNNEL_SIGNING_KEY"),
-			TokenTTL:         tokenTTL,
-			AccessScheme:     accessScheme,
-			AccessPort:       accessPort,
+			Hostname:                 hostname,
+			EnableAuth:               enableAuth,
+			GuardianURL:              guardianURL,
+			GuardianAudience:         guardianAudience,
+			SigningKey:               os.Getenv("TINY_TUNNEL_SIGNING_KEY"),
+			TokenTTL:                 tokenTTL,
+			AccessScheme:             accessScheme,
+			AccessPort:               accessPort,
+			MaxRequestBodyBytes:      maxRequestBody,
+			MaxWebsocketMessageBytes: maxWSMessage,
+			ResponseHeaderTimeout:    headerTimeout,
+			IdleTimeout:              idleTimeout,
+			ResumeGracePeriod:        resumeGrace,
+			TCPPorts:                 ports,
+			UDPPorts:                 udpRange,
+			UDPIdleTimeout:           udpIdleTimeout,
+			TLSPassthroughAddr:       passthroughAddr,
+			TrustedProxies:           trusted,
 		}, logger)
 
 		server := &http.Server{
@@ -58,10 +94,25 @@ var serveCmd = &cobra.Command{
 			}
 		}()
 
+		if passthroughAddr != "" {
+			ln, err := net.Listen("tcp", passthroughAddr)
+			if err != nil {
+				return err
+			}
+			defer ln.Close()
+			logger.Info("accepting TLS passthrough connections", "addr", passthroughAddr)
+			go router.ServeTLSPassthrough(ln)
+		}
+
 		<-ctx.Done()
 		logger.Info("shutting down server")
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
 		defer cancel()
+		// Send clients elsewhere first; visitors keep being served by the
+		// draining tunnels until then.
+		if err := router.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("tunnels closed before draining", "err", err)
+		}
 		if err := server.Shutdown(shutdownCtx); err != nil {
 			if err == http.ErrServerClosed {
 				logger.Info("server closed")
@@ -83,5 +134,16 @@ func init() {
 	serveCmd.Flags().StringVarP(&guardianAudience, "guardian-audience", "", "svc_tiny-tunnel_stable", "Guardian service client ID expected in JWT aud claims (empty skips the check)")
 	serveCmd.Flags().DurationVarP(&tokenTTL, "token-ttl", "", 30*24*time.Hour, "Lifetime of vended tunnel tokens (signing key from TINY_TUNNEL_SIGNING_KEY)")
 	serveCmd.Flags().StringVarP(&accessPort, "access-port", "", "", "Port to access the tunnel on")
+	serveCmd.Flags().Int64Var(&maxRequestBody, "max-request-body", 0, "Maximum visitor request body size in bytes (0 for unlimited)")
+	serveCmd.Flags().Int64Var(&maxWSMessage, "max-websocket-message", 16<<20, "Maximum websocket message size in bytes, either way (0 for unlimited)")
+	serveCmd.Flags().DurationVar(&headerTimeout, "response-header-timeout", 0, "Maximum wait for a tunnel to return response headers (0 for no limit)")
+	serveCmd.Flags().DurationVar(&idleTimeout, "idle-timeout", 0, "Maximum wait between chunks of a streamed response (0 for no limit)")
+	serveCmd.Flags().DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "Maximum wait for in-flight requests when shutting down")
+	serveCmd.Flags().DurationVar(&resumeGrace, "resume-grace", 30*time.Second, "How long a disconnected tunnel's name is held for its client to reconnect (0 to free it right away)")
+	serveCmd.Flags().StringVar(&tcpPorts, "tcp-ports", "", "Port range for TCP tunnels, e.g. 20000-20100 (empty disables TCP tunnels)")
+	serveCmd.Flags().StringVar(&udpPorts, "udp-ports", "", "Port range for UDP tunnels, e.g. 21000-21100 (empty disables UDP tunnels)")
+	serveCmd.Flags().DurationVar(&udpIdleTimeout, "udp-idle-timeout", time.Minute, "How long a UDP tunnel keeps a visitor's session without datagrams")
+	serveCmd.Flags().StringVar(&passthroughAddr, "tls-passthrough-addr", "", "Address to accept TLS passthrough connections on, routed by SNI (empty disables passthrough)")
+	serveCmd.Flags().StringSliceVar(&trustedProxies, "trusted-proxies", nil, "Networks of the proxies in front of the server whose X-Forwarded-For is trusted to tell visitor IPs (e.g. 10.0.0.0/8)")
 	serveCmd.Flags().StringVarP(&accessScheme, "access-scheme", "", "https", "Scheme to access the tunnel on")
 }
@@ -4,14 +4,20 @@ Copyright © 2024 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"context"
+	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"time"
+	"strings"
 
 	"github.com/campbel/tiny-tunnel/core/client"
+	"github.com/campbel/tiny-tunnel/core/client/inspector"
 	"github.com/campbel/tiny-tunnel/core/client/ui"
 	"github.com/campbel/tiny-tunnel/core/stats"
 	"github.com/campbel/tiny-tunnel/internal/log"
+	"github.com/google/uuid"
 	"github.com/spf13/cobra"
 )
 
@@ -29,6 +35,23 @@ var (
 	serverHeaders     map[string]string
 	token             string
 	enableTUI         bool
+	compression       bool
+	connections       int
+	tcpAddr           string
+	udpAddr           string
+	remotePort        int
+	passthrough       string
+	private           bool
+	share             []string
+	egressProxy       bool
+	egressAllow       []string
+	routes            []string
+	requestHeaders    []string
+	responseHeaders   []string
+	hostHeader        string
+	rewriteURLs       bool
+	rewriteBody       bool
+	inspectAddr       string
 )
 
 // startCmd represents the start command
@@ -52,31 +75,71 @@ var startCmd = &cobra.Command{
 			TargetHeaders:     convertMapToHeaders(targetHeaders),
 			ServerHeaders:     convertMapToHeaders(serverHeaders),
 			Token:             token,
+			Compression:       compression,
+			Connections:       connections,
+			TCPAddr:           tcpAddr,
+			UDPAddr:           udpAddr,
+			RemotePort:        remotePort,
+			HostHeader:        hostHeader,
+			RewriteURLs:       rewriteURLs,
+			RewriteBody:       rewriteBody,
 		}
-
-		// If server host is not specified, try to use the default from config
-		if serverHost == "" {
-			if serverInfo, err := options.GetServerInfo(); err == nil {
-				logger.Info("using default server from config", "server", serverInfo.Hostname)
-				options.ServerHost = serverInfo.Hostname
-
-				// Determine if insecure
-				if insecure || serverInfo.Protocol == "http" {
-					options.Insecure = true
-				} else {
-					options.Insecure = false
-					options.ServerPort = "443"
+		for _, r := range routes {
+			route, err := client.ParseRoute(r)
+			if err != nil {
+				return err
+			}
+			options.Routes = append(options.Routes, route)
+		}
+		var err error
+		if options.RequestHeaders, err = client.ParseHeaderRules(requestHeaders); err != nil {
+			return err
+		}
+		if options.ResponseHeaders, err = client.ParseHeaderRules(responseHeaders); err != nil {
+			return err
+		}
+		if passthrough != "" {
+			options.TCPAddr = passthrough
+			options.TLSPassthrough = true
+		}
+		if len(share) > 0 && !private && !egressProxy {
+			return fmt.Errorf("--share requires --private or --egress-proxy")
+		}
+		if egressProxy {
+			if len(egressAllow) == 0 {
+				return fmt.Errorf("--egress-allow is required with --egress-proxy")
+			}
+			options.Private = true
+			options.EgressProxy = true
+			options.EgressAllow = egressAllow
+			options.Share = share
+		} else if private {
+			if options.TCPAddr == "" {
+				addr, err := targetAddr(target)
+				if err != nil {
+					return err
 				}
+				options.TCPAddr = addr
+			}
+			options.Private = true
+			options.Share = share
+		}
+		if connections > 1 {
+			options.PoolKey = uuid.New().String()
+		}
 
-				// Use port from config if specified
-				if serverInfo.Port != "" {
-					options.ServerPort = serverInfo.Port
-				}
+		useDefaultServer(&options, logger)
+
+		if inspectAddr != "" {
+			store, err := startInspector(cmd.Context(), inspectAddr, logger)
+			if err != nil {
+				return err
 			}
+			options.Inspector = store
 		}
 
 		// Create the tunnel state and provider
-		stateProvider := stats.NewTunnelState(options.Target, options.Name)
+		stateProvider := stats.NewTunnelState(displayTarget(options), options.Name)
 		statsProvider := stats.NewTunnelStats()
 
 		// If TUI is enabled, start it in a separate goroutine before entering the listen loop
@@ -96,28 +159,13 @@ var startCmd = &cobra.Command{
 					logger.Error("error starting TUI", "err", err)
 				}
 			}()
+			go client.RunPool(cmd.Context(), options, stateProvider, statsProvider, tui)
 
 			// TUI handles the context cancellation for proper shutdown
-			tunnel.Listen(cmd.Context())
+			client.Listen(cmd.Context(), tunnel, options, stateProvider, statsProvider, tui)
 		} else {
 			// Standard reconnection loop without TUI
-		LOOP:
-			for i := 0; i < reconnectAttempts; i++ {
-				select {
-				case <-cmd.Context().Done():
-					break LOOP
-				default:
-					logger.Info("connecting...", "server", options.ServerHost, "port", options.ServerPort, "insecure", options.Insecure)
-					tunnel, err := client.NewTunnel(cmd.Context(), options, stateProvider, statsProvider, logger)
-					if err != nil {
-						logger.Error("error connecting to tunnel", "err", err)
-						time.Sleep(3 * time.Second)
-						continue
-					}
-					logger.Info("connected", "server", options.ServerHost, "port", options.ServerPort, "insecure", options.Insecure)
-					tunnel.Listen(cmd.Context())
-				}
-			}
+			client.Run(cmd.Context(), options, stateProvider, statsProvider, logger)
 		}
 
 		return nil
@@ -131,16 +179,87 @@ func init() {
 	startCmd.Flags().StringVarP(&serverHost, "server-host", "s", "", "Host of the server (if empty, uses default from config)")
 	startCmd.Flags().StringVarP(&serverPort, "server-port", "p", "", "Port of the server (if empty, uses default from config)")
 	startCmd.Flags().BoolVarP(&insecure, "insecure", "i", false, "Use insecure connection to the server")
-	startCmd.Flags().StringSliceVarP(&allowedIPs, "allowed-ips", "a", []string{"0.0.0.0/0", "::/0"}, "Allowed IPs")
+	startCmd.Flags().StringSliceVarP(&allowedIPs, "allowed-ips", "a", []string{"0.0.0.0/0", "::/0"}, "Networks visitors may reach the tunnel from, in CIDR notation (e.g. 203.0.113.0/24)")
 	startCmd.Flags().IntVarP(&reconnectAttempts, "reconnect-attempts", "r", 5, "Reconnect attempts")
 	startCmd.Flags().StringToStringVarP(&targetHeaders, "target-headers", "T", map[string]string{}, "Target headers")
 	startCmd.Flags().BoolVar(&targetInsecure, "target-insecure", false, "Skip TLS verification for the target (does not affect the server connection)")
 	startCmd.Flags().StringVar(&targetCAFile, "target-ca", "", "Path to a PEM CA bundle used to verify the target's TLS certificate")
 	startCmd.Flags().StringToStringVarP(&serverHeaders, "server-headers", "S", map[string]string{}, "Server headers")
 	startCmd.Flags().StringVar(&token, "token", "", "JWT authentication token")
+	startCmd.Flags().BoolVar(&compression, "compress", false, "Compress tunnel traffic (permessage-deflate)")
+	startCmd.Flags().IntVar(&connections, "connections", 1, "Number of parallel connections to the server")
+	startCmd.Flags().StringVar(&tcpAddr, "tcp", "", "Expose a local TCP address (e.g. localhost:5432) instead of an HTTP target")
+	startCmd.Flags().StringVar(&udpAddr, "udp", "", "Expose a local UDP address (e.g. localhost:27015) instead of an HTTP target")
+	startCmd.Flags().IntVar(&remotePort, "remote-port", 0, "Public port to request for a TCP or UDP tunnel (0 lets the server choose)")
+	startCmd.Flags().StringVar(&passthrough, "tls-passthrough", "", "Relay TLS connections for the tunnel's hostname, still encrypted, to a local TLS address (e.g. localhost:8443)")
+	startCmd.Flags().BoolVar(&private, "private", false, "Serve the tunnel only to tnl connect, relaying its connections to the --tcp address or the target's host; the server must require authentication")
+	startCmd.Flags().StringSliceVar(&share, "share", nil, "Users, by email or subject, who may tnl connect to a --private tunnel besides you")
+	startCmd.Flags().BoolVar(&egressProxy, "egress-proxy", false, "Serve a private tunnel that dials, from this machine, the destinations tnl connect --proxy users ask for")
+	startCmd.Flags().StringSliceVar(&egressAllow, "egress-allow", nil, "Networks, hosts and *.domain wildcards the egress proxy may dial (e.g. 10.0.0.0/8,lab.local)")
+	startCmd.Flags().StringArrayVar(&routes, "route", nil, "Send requests under a path prefix to another target, as prefix=target[,strip] (e.g. /api=http://localhost:8080); the longest prefix wins and --target serves the rest")
+	startCmd.Flags().StringArrayVar(&requestHeaders, "request-header", nil, "Rewrite a header of requests to the target, as add:Name=value, set:Name=value or remove:Name; values may use {visitor_ip}, {tunnel} and {request_id}")
+	startCmd.Flags().StringArrayVar(&responseHeaders, "response-header", nil, "Rewrite a header of responses from the target, like --request-header")
+	startCmd.Flags().StringVar(&hostHeader, "host-header", client.HostHeaderRewrite, "Host header sent to the target: rewrite (the target's own), preserve (the tunnel's) or a value to send as is")
+	startCmd.Flags().BoolVar(&rewriteURLs, "rewrite-urls", false, "Rewrite the target's absolute URLs in Location and Content-Location headers, and its cookie domains, to the tunnel's")
+	startCmd.Flags().BoolVar(&rewriteBody, "rewrite-body", false, "Rewrite the target's absolute URLs to the tunnel's in HTML and JSON response bodies")
+	startCmd.Flags().StringVar(&inspectAddr, "inspect", "", "Serve a web page listing the requests the tunnel proxies on this local address (e.g. 127.0.0.1:4040)")
+	startCmd.Flags().Lookup("inspect").NoOptDefVal = "127.0.0.1:4040"
 	startCmd.Flags().BoolVarP(&enableTUI, "tui", "u", true, "Enable Terminal User Interface")
 }
 
+// displayTarget describes what a tunnel exposes.
+func displayTarget(options client.Options) string {
+	switch {
+	case options.TLSPassthrough:
+		return "tls://" + options.TCPAddr
+	case options.EgressProxy:
+		return "egress://" + strings.Join(options.EgressAllow, ",")
+	case options.Private:
+		return "private://" + options.TCPAddr
+	case options.TCPAddr != "":
+		return "tcp://" + options.TCPAddr
+	case options.UDPAddr != "":
+		return "udp://" + options.UDPAddr
+	case len(options.Routes) > 0:
+		return displayRoutes(options)
+	}
+	return options.Target
+}
+
+// displayRoutes describes a routed tunnel's targets, e.g.
+// "/api=http://localhost:8080 /=http://localhost:3000".
+func displayRoutes(options client.Options) string {
+	var parts []string
+	for _, route := range options.Routes {
+		parts = append(parts, route.Prefix+"="+route.Target)
+	}
+	if options.Target != "" {
+		parts = append(parts, "*="+options.Target)
+	}
+	return strings.Join(parts, " ")
+}
+
+// startInspector serves the request inspector on addr until ctx is done.
+func startInspector(ctx context.Context, addr string, logger log.Logger) (*inspector.Store, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start inspector: %w", err)
+	}
+	store := inspector.NewStore(inspector.DefaultCapacity, inspector.DefaultMaxBodyBytes)
+	server := &http.Server{Handler: store.Handler(addr)}
+	go func() {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logger.Error("error serving inspector", "err", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	logger.Info("serving request inspector", "url", "http://"+ln.Addr().String())
+	return store, nil
+}
+
 func convertMapToHeaders(m map[string]string) http.Header {
 	headers := http.Header{}
 	for k, v := range m {
@@ -148,3 +267,42 @@ func convertMapToHeaders(m map[string]string) http.Header {
 	}
 	return headers
 }
+
+// useDefaultServer points options at the default server from the config
+// when no server host was given.
+func useDefaultServer(options *client.Options, logger log.Logger) {
+	if options.ServerHost == "" {
+		if serverInfo, err := options.GetServerInfo(); err == nil {
+			logger.Info("using default server from config", "server", serverInfo.Hostname)
+			options.ServerHost = serverInfo.Hostname
+
+			// Determine if insecure
+			if options.Insecure || serverInfo.Protocol == "http" {
+				options.Insecure = true
+			} else {
+				options.Insecure = false
+				options.ServerPort = "443"
+			}
+
+			// Use port from config if specified
+			if serverInfo.Port != "" {
+				options.ServerPort = serverInfo.Port
+			}
+		}
+	}
+}
+
+// targetAddr returns the host:port a target URL points at.
+func targetAddr(target string) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid target %q", target)
+	}
+	if u.Port() != "" {
+		return u.Host, nil
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443"), nil
+	}
+	return net.JoinHostPort(u.Hostname(), "80"), nil
+}
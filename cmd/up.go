@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/campbel/tiny-tunnel/core/client"
+	"github.com/campbel/tiny-tunnel/core/stats"
+	"github.com/campbel/tiny-tunnel/internal/log"
+	"github.com/google/uuid"
+	"github.com/spf13/cobra"
+)
+
+var projectFile string
+
+// upCmd represents the up command
+var upCmd = &cobra.Command{
+	Use:   "up [name...]",
+	Short: "Start the tunnels declared in the project file",
+	Long: `Start the tunnels declared in the project file (tnl.yaml by default), or only the named ones, each with its own reconnect loop.
+
+A project file declares tunnels by name:
+
+  tunnels:
+    web:
+      target: http://localhost:3000
+      routes:
+        - /api=http://localhost:8080
+      target_headers:
+        X-Env: dev
+      server: tnl.example.com
+      token: ${TNL_TOKEN}
+
+${VAR} references in values are expanded from the environment, so secrets need not be
+committed; write $$ for a literal $.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger := log.NewBasicLogger(os.Getenv("DEBUG") == "true")
+		project, err := client.LoadProjectFile(projectFile)
+		if err != nil {
+			return err
+		}
+		tunnels, err := project.Options(args...)
+		if err != nil {
+			return err
+		}
+
+		var wg sync.WaitGroup
+		for _, options := range tunnels {
+			useDefaultServer(&options, logger)
+			if options.Connections > 1 {
+				options.PoolKey = uuid.New().String()
+			}
+			fmt.Printf("Starting tunnel %s for %s\n", options.Name, displayTarget(options))
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				stateProvider := stats.NewTunnelState(displayTarget(options), options.Name)
+				client.Run(cmd.Context(), options, stateProvider, stats.NewTunnelStats(), log.With(logger, "tunnel", options.Name))
+			}()
+		}
+		wg.Wait()
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(upCmd)
+	upCmd.Flags().StringVarP(&projectFile, "file", "f", client.ProjectFileName, "Project file declaring the tunnels")
+}
@@ -9,12 +9,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
-	"os"
 	"net/url"
+	"os"
 	"strings"
 	"time"
 
+	"github.com/campbel/tiny-tunnel/core/client/inspector"
 	"github.com/campbel/tiny-tunnel/core/protocol"
 	"github.com/campbel/tiny-tunnel/core/shared"
 	"github.com/campbel/tiny-tunnel/core/stats"
@@ -57,7 +59,12 @@ func NewTunnel(ctx context.Context, options Options, stateProvider stats.StatePr
 	tunnelURL := options.URL()
 	stateProvider.SetStatusMessage(fmt.Sprintf("Connecting to %s...", tunnelURL))
 
-	conn, _, err := websocket.DefaultDialer.DialContext(ctx, tunnelURL, headers)
+	// Offer the handshake, then bare binary frames for servers that predate
+	// it; servers that know neither ignore both and the tunnel stays JSON.
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{protocol.SubprotocolHandshake, protocol.SubprotocolBinary}
+	dialer.EnableCompression = options.Compression
+	conn, _, err := dialer.DialContext(ctx, tunnelURL, headers)
 	if err != nil {
 		stateProvider.SetStatus(stats.StatusError)
 		stateProvider.SetStatusMessage(fmt.Sprintf("Failed to connect: %s", err.Error()))
@@ -65,6 +72,16 @@ func NewTunnel(ctx context.Context, options Options, stateProvider stats.StatePr
 	}
 
 	tunnel := shared.NewTunnel(conn, l)
+	if err := tunnel.ClientHandshake(ctx, capabilities(options)); err != nil {
+		tunnel.Close()
+		stateProvider.SetStatus(stats.StatusError)
+		stateProvider.SetStatusMessage(fmt.Sprintf("Failed to connect: %s", err.Error()))
+		return nil, err
+	}
+
+	if options.restrictsIPs() && !tunnel.Capabilities().Has(protocol.FeatureAllowedIPs) {
+		l.Warn("server does not enforce allowed IPs; the tunnel is open to everyone", "allowed_ips", strings.Join(options.AllowedIPs, ","))
+	}
 
 	// Update state after successful connection
 	stateProvider.SetStatus(stats.StatusConnected)
@@ -82,13 +99,34 @@ func NewTunnel(ctx context.Context, options Options, stateProvider stats.StatePr
 
 		fmt.Fprintf(options.Output(), "%s\n", payload.Text)
 
-		// capture welcome message
-		if strings.HasPrefix(payload.Text, "Welcome to Tiny Tunnel!") {
+		// Servers that predate RegisterAck announce the URL in their
+		// welcome message.
+		if !tunnel.Capabilities().Has(protocol.FeatureRegisterAck) && strings.HasPrefix(payload.Text, "Welcome to Tiny Tunnel!") {
 			parts := strings.Split(payload.Text, " ")
 			stateProvider.SetURL(parts[len(parts)-1])
 		}
 	})
 
+	tunnel.RegisterRegisterAckHandler(func(tunnel *shared.Tunnel, id string, payload protocol.RegisterAckPayload) {
+		registration := stats.Registration{
+			TunnelID:            payload.TunnelID,
+			URLs:                payload.URLs,
+			ServerVersion:       payload.ServerVersion,
+			MaxRequestBodyBytes: payload.Limits.MaxRequestBodyBytes,
+			ResumeToken:         payload.ResumeToken,
+		}
+		if payload.Identity != nil {
+			registration.Identity = payload.Identity.Email
+			if registration.Identity == "" {
+				registration.Identity = payload.Identity.Subject
+			}
+		}
+		stateProvider.SetRegistration(registration)
+		if len(payload.URLs) > 0 {
+			fmt.Fprintf(options.Output(), "Your tunnel is ready at %s\n", payload.URLs[0])
+		}
+	})
+
 	// HTTP
 	// Requests are sent to the target and the response is relayed back to the
 	// server. Responses with a known length are buffered and sent as a single
@@ -103,9 +141,15 @@ func NewTunnel(ctx context.Context, options Options, stateProvider stats.StatePr
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
-		Transport: &http.Transport{
-			TLSClientConfig: targetTLS,
-		},
+		Transport: newTargetTransport(&http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig:     targetTLS,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		}, targetTLS),
 	}
 
 	// activeStreams tracks in-flight streamed responses by request ID so the
@@ -116,7 +160,45 @@ func NewTunnel(ctx context.Context, options Options, stateProvider stats.StatePr
 	tunnel.RegisterHttpRequestHandler(func(tunnel *shared.Tunnel, id string, payload protocol.HttpRequestPayload) {
 		// Handlers run on the tunnel read loop; do the actual work in a
 		// goroutine so slow targets don't block the tunnel.
-		go handleHttpRequest(tunnel, id, payload, options, tunnelHttpClient, activeStreams, statsProvider, l)
+		go handleHttpRequest(tunnel, id, payload, bytes.NewReader(payload.Body), options, tunnelHttpClient, activeStreams, statsProvider, l)
+	})
+
+	// requestBodies holds streamed request bodies by request ID while the
+	// server relays the visitor's upload.
+	requestBodies := safe.NewMap[string, *requestBody]()
+
+	tunnel.RegisterHttpRequestStartHandler(func(tunnel *shared.Tunnel, id string, payload protocol.HttpRequestStartPayload) {
+		// Register the body before returning so the chunks that follow on
+		// the read loop find it.
+		body := newRequestBody(tunnel, id)
+		requestBodies.SetNX(id, body)
+		request := protocol.HttpRequestPayload{
+			Method:     payload.Method,
+			Path:       payload.Path,
+			Headers:    payload.Headers,
+			Timeouts:   payload.Timeouts,
+			RemoteAddr: payload.RemoteAddr,
+			Host:       payload.Host,
+			Scheme:     payload.Scheme,
+		}
+		go func() {
+			defer requestBodies.Delete(id)
+			defer body.Close()
+			handleHttpRequest(tunnel, id, request, body, options, tunnelHttpClient, activeStreams, statsProvider, l)
+		}()
+	})
+
+	tunnel.RegisterHttpRequestChunkHandler(func(tunnel *shared.Tunnel, id string, payload protocol.HttpRequestChunkPayload) {
+		if body, ok := requestBodies.Get(payload.RequestID); ok {
+			body.write(payload.Data)
+		}
+	})
+
+	tunnel.RegisterHttpRequestEndHandler(func(tunnel *shared.Tunnel, id string, payload protocol.HttpRequestEndPayload) {
+		if body, ok := requestBodies.Get(payload.RequestID); ok {
+			requestBodies.Delete(payload.RequestID)
+			body.finish(payload.Error, payload.Trailers)
+		}
 	})
 
 	tunnel.RegisterHttpStreamCancelHandler(func(tunnel *shared.Tunnel, id string, payload protocol.HttpStreamCancelPayload) {
@@ -130,7 +212,7 @@ func NewTunnel(ctx context.Context, options Options, stateProvider stats.StatePr
 	// For websockets, we must establish connections and store a reference to them in the session map.
 	// Each connection is given a session ID as its identifier and passed back to the server in the response.
 	// The server will use this ID to send messages to the client in the future.
-	wsSessions := safe.NewMap[string, *safe.WSConn]()
+	wsSessions := safe.NewMap[string, *websocketSession]()
 
 	tunnel.RegisterWebsocketCreateRequestHandler(func(tunnel *shared.Tunnel, id string, payload protocol.WebsocketCreateRequestPayload) {
 		// Dialing the target can block; run async to keep the tunnel read loop free.
@@ -139,39 +221,107 @@ func NewTunnel(ctx context.Context, options Options, stateProvider stats.StatePr
 
 	tunnel.RegisterWebsocketMessageHandler(func(tunnel *shared.Tunnel, id string, payload protocol.WebsocketMessagePayload) {
 		l.Debug("handling websocket message", "payload", payload)
-		conn, ok := wsSessions.Get(payload.SessionID)
+		session, ok := wsSessions.Get(payload.SessionID)
 		if !ok {
 			l.Error("websocket session not found", "session_id", payload.SessionID)
 			return
 		}
-		if err := conn.WriteMessage(payload.Kind, payload.Data); err != nil {
-			l.Error("failed to write websocket message", "error", err.Error())
-		}
-		statsProvider.IncrementWebsocketMessageSent()
+		session.inbox.Push(len(payload.Data), func() {
+			if err := session.conn.WriteMessage(payload.Kind, payload.Data); err != nil {
+				l.Error("failed to write websocket message", "error", err.Error())
+			}
+			statsProvider.IncrementWebsocketMessageSent()
+		})
 	})
 
 	tunnel.RegisterWebsocketCloseHandler(func(tunnel *shared.Tunnel, id string, payload protocol.WebsocketClosePayload) {
 		l.Debug("handling websocket close", "payload", payload)
-		conn, ok := wsSessions.Get(payload.SessionID)
+		session, ok := wsSessions.Get(payload.SessionID)
 		if !ok {
 			l.Error("websocket session not found", "session_id", payload.SessionID)
 			return
 		}
-		if err := conn.Close(); err != nil {
-			l.Error("failed to close websocket connection", "error", err.Error(), "payload", payload)
-		}
 		wsSessions.Delete(payload.SessionID)
+		tunnel.ReleaseWindow(payload.SessionID)
+		// Close after the messages still queued ahead of it.
+		session.inbox.Push(0, func() {
+			if err := session.conn.CloseWith(payload.Code, payload.Reason); err != nil {
+				l.Error("failed to close websocket connection", "error", err.Error(), "payload", payload)
+			}
+			session.inbox.Close()
+		})
+	})
+
+	// TCP
+	egress, err := parseEgressPolicy(options.EgressAllow)
+	if err != nil {
+		tunnel.Close()
+		return nil, err
+	}
+	tcpSessions := registerTCPHandlers(tunnel, options, egress, l)
+
+	// Upgrades other than websocket are relayed as raw streams, like TCP
+	// connections, once the target has switched protocols.
+	tunnel.RegisterHttpUpgradeRequestHandler(func(tunnel *shared.Tunnel, id string, payload protocol.HttpUpgradeRequestPayload) {
+		// Register the session before returning so the data that follows on
+		// the read loop finds it.
+		session := &tcpSession{dialed: make(chan struct{}), inbox: tunnel.NewInbox(payload.ConnID)}
+		if !tcpSessions.SetNX(payload.ConnID, session) {
+			session.inbox.Close()
+			return
+		}
+		go handleUpgradeRequest(tunnel, id, payload, session, tcpSessions, options, tunnelHttpClient, statsProvider, l)
 	})
 
+	// UDP
+	registerUDPHandlers(tunnel, options, l)
+
 	return tunnel, nil
 }
 
+// capabilities lists the protocol features this client offers the server.
+func capabilities(options Options) protocol.Capabilities {
+	caps := protocol.Capabilities{
+		Version: protocol.ProtocolVersion,
+		Features: []string{
+			protocol.FeatureStreaming,
+			protocol.FeatureBinaryFrames,
+			protocol.FeatureRegisterAck,
+			protocol.FeatureRequestStreaming,
+			protocol.FeatureFlowControl,
+			protocol.FeatureErrorCodes,
+			protocol.FeatureGoAway,
+			protocol.FeatureTCP,
+			protocol.FeatureTcpOpened,
+			protocol.FeatureUDP,
+			protocol.FeatureUpgrade,
+			protocol.FeatureWebsocketControl,
+			protocol.FeatureAllowedIPs,
+		},
+	}
+	if options.Compression {
+		caps.Features = append(caps.Features, protocol.FeatureCompression)
+	}
+	return caps
+}
+
+// websocketSession is a target websocket relayed through the tunnel.
+// Messages from the server are written to conn from the inbox so a slow
+// target only holds up its own session.
+type websocketSession struct {
+	conn  *safe.WSConn
+	inbox *shared.Inbox
+}
+
 // handleHttpRequest proxies a single HTTP request from the tunnel server to
 // the local target, streaming the response back when its length is unknown.
+// The request body is read from body, which is either the buffered payload
+// body or a streamed requestBody.
 func handleHttpRequest(
 	tunnel *shared.Tunnel,
 	id string,
 	payload protocol.HttpRequestPayload,
+	body io.Reader,
 	options Options,
 	httpClient *http.Client,
 	activeStreams *safe.Map[string, context.CancelFunc],
@@ -183,20 +333,48 @@ func handleHttpRequest(
 	startTime := time.Now()
 	statsProvider.IncrementHttpRequest()
 
-	// The request context is cancelled when the tunnel closes or when the
-	// server tells us the downstream consumer went away (HttpStreamCancel).
-	reqCtx, cancel := context.WithCancel(tunnel.Context())
-	defer cancel()
+	// The request context is cancelled when the tunnel closes, when the
+	// server tells us the downstream consumer went away (HttpStreamCancel)
+	// or when one of the server's deadlines runs out.
+	reqCtx, cancel := context.WithCancelCause(tunnel.Context())
+	defer cancel(nil)
 
-	activeStreams.SetNX(id, cancel)
+	activeStreams.SetNX(id, func() { cancel(nil) })
 	defer activeStreams.Delete(id)
 
-	url_ := options.Target + payload.Path
-	req, err := http.NewRequestWithContext(reqCtx, payload.Method, url_, bytes.NewReader(payload.Body))
+	// The response head deadline starts once the request is sent in full:
+	// right away for buffered bodies, once the target has read a streamed
+	// one.
+	dog := newWatchdog(payload.Timeouts, cancel)
+	defer dog.stop()
+	rb, streamed := body.(*requestBody)
+	var buffered []byte
+	if !streamed {
+		buffered = payload.Body
+	}
+	exchange := options.Inspector.Begin(id, payload.Method, payload.Path, payload.RemoteAddr, payload.Headers, buffered)
+	defer exchange.Finish(nil)
+	if streamed {
+		body = dog.watchBody(exchange.RequestBody(body))
+	} else {
+		dog.sent()
+	}
+
+	route, path, ok := options.route(payload.Path)
+	if !ok {
+		statsProvider.IncrementHttpResponse()
+		response := noRouteResponse(payload.Path)
+		exchange.Respond(response.Response.Status, response.Response.Headers, response.Response.Body, false)
+		tunnel.SendResponse(protocol.MessageKindHttpResponse, id, response)
+		return
+	}
+	url_ := route.Target + path
+	req, err := http.NewRequestWithContext(reqCtx, payload.Method, url_, body)
 	if err != nil {
 		l.Error("failed to create HTTP request", "error", err.Error())
+		exchange.Finish(err)
 		statsProvider.IncrementHttpResponse()
-		tunnel.SendResponse(protocol.MessageKindHttpResponse, id, &protocol.HttpResponsePayload{Error: err})
+		tunnel.SendResponse(protocol.MessageKindHttpResponse, id, &protocol.HttpResponsePayload{Error: targetError(tunnel, err)})
 		return
 	}
 
@@ -205,29 +383,65 @@ func handleHttpRequest(
 			req.Header.Add(k, vv)
 		}
 	}
+	vars := headerVars{visitorIP: payload.RemoteAddr, tunnel: options.Name, requestID: id}
+	applyHeaderRules(options.requestHeaderRules(), req.Header, vars)
+	if host := options.targetHost(payload.Host); host != "" {
+		req.Host = host
+	}
+	if options.RewriteBody {
+		// Bodies are rewritten uncompressed; the transport asks for gzip
+		// itself and hands them back inflated.
+		req.Header.Del("Accept-Encoding")
+	}
+
+	// Streamed bodies have no length of their own; use the visitor's, or
+	// send chunked when it is unknown. They end with the trailers the
+	// visitor declared, which net/http sends from req.Trailer.
+	if streamed {
+		req.ContentLength = contentLength(payload.Headers)
+		if trailer := declaredTrailer(payload.Headers); trailer != nil {
+			req.Header.Del("Trailer")
+			req.Trailer = trailer
+			rb.trailer = trailer
+		}
+	}
 
 	resp, err := httpClient.Do(req)
+	dog.stop()
 	if err != nil {
+		err = deadlineCause(reqCtx, err)
+		exchange.Finish(err)
 		statsProvider.IncrementHttpResponse()
-		tunnel.SendResponse(protocol.MessageKindHttpResponse, id, &protocol.HttpResponsePayload{Error: err})
+		tunnel.SendResponse(protocol.MessageKindHttpResponse, id, &protocol.HttpResponsePayload{Error: targetError(tunnel, err)})
 		l.Info("http request failed", "method", payload.Method, "path", payload.Path, "elapsed", time.Since(startTime), "error", err.Error())
 		return
 	}
+	resp.Body = dog.watchResponse(resp.Body)
 	defer resp.Body.Close()
-
-	if isStreamingResponse(resp) {
-		streamHttpResponse(tunnel, id, payload, resp, statsProvider, l, startTime)
+	rewriter := options.newURLRewriter(route, payload.Scheme, payload.Host)
+	rewriter.rewriteHeaders(resp.Header)
+	applyHeaderRules(options.ResponseHeaders, resp.Header, vars)
+
+	// Servers that can't take streams get the response buffered, which is
+	// the best we can do for them.
+	if isStreamingResponse(resp) && !rewriter.buffersBody(resp.Header) && tunnel.Capabilities().Has(protocol.FeatureStreaming) {
+		streamHttpResponse(tunnel, id, payload, resp, exchange, statsProvider, l, startTime)
 		return
 	}
 
 	bodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
+		err = deadlineCause(reqCtx, err)
+		exchange.Finish(err)
 		statsProvider.IncrementHttpResponse()
-		tunnel.SendResponse(protocol.MessageKindHttpResponse, id, &protocol.HttpResponsePayload{Error: err})
+		tunnel.SendResponse(protocol.MessageKindHttpResponse, id, &protocol.HttpResponsePayload{Error: targetError(tunnel, err)})
 		l.Info("http request failed", "method", payload.Method, "path", payload.Path, "status", resp.StatusCode, "elapsed", time.Since(startTime), "error", err.Error())
 		return
 	}
 
+	bodyBytes = rewriter.rewriteBody(resp.Header, bodyBytes)
+	exchange.Respond(resp.StatusCode, resp.Header, bodyBytes, false)
+
 	elapsed := time.Since(startTime)
 	statsProvider.IncrementHttpResponse()
 	l.Info("http request completed", "status", resp.StatusCode, "elapsed", elapsed, "method", payload.Method, "path", payload.Path)
@@ -241,11 +455,15 @@ func handleHttpRequest(
 // isStreamingResponse reports whether a response should be relayed
 // chunk-by-chunk instead of buffered. Anything without a known content length
 // (chunked transfer encoding, connection-close streams) is streamed — this
-// covers SSE, k8s watch/informer streams, and log follows alike.
+// covers SSE, k8s watch/informer streams, and log follows alike. So is
+// anything with trailers, which only the end of a stream carries.
 func isStreamingResponse(resp *http.Response) bool {
 	if strings.Contains(resp.Header.Get("Content-Type"), "text/event-stream") {
 		return true
 	}
+	if len(resp.Trailer) > 0 || isGRPC(resp.Header) {
+		return true
+	}
 	if resp.ContentLength < 0 {
 		return true
 	}
@@ -264,6 +482,7 @@ func streamHttpResponse(
 	id string,
 	payload protocol.HttpRequestPayload,
 	resp *http.Response,
+	exchange *inspector.Exchange,
 	statsProvider stats.StatsProvider,
 	l log.Logger,
 	startTime time.Time,
@@ -271,8 +490,10 @@ func streamHttpResponse(
 	statsProvider.IncrementSseConnection()
 	defer statsProvider.DecrementSseConnection()
 	statsProvider.IncrementHttpResponse()
+	defer tunnel.ReleaseWindow(id)
 
 	l.Info("http stream started", "status", resp.StatusCode, "method", payload.Method, "path", payload.Path)
+	exchange.Respond(resp.StatusCode, resp.Header, nil, true)
 
 	if err := tunnel.SendResponse(protocol.MessageKindHttpResponseStart, id, &protocol.HttpResponseStartPayload{
 		Status:  resp.StatusCode,
@@ -285,9 +506,17 @@ func streamHttpResponse(
 	buf := make([]byte, 32*1024)
 	for {
 		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			// Wait for the server to have room for the chunk; the request
+			// context is cancelled if the visitor goes away meanwhile.
+			if acquireErr := tunnel.AcquireWindow(resp.Request.Context(), id, n); acquireErr != nil {
+				n, err = 0, acquireErr
+			}
+		}
 		if n > 0 {
 			chunk := make([]byte, n)
 			copy(chunk, buf[:n])
+			exchange.ResponseBody(chunk)
 			if sendErr := tunnel.SendResponse(protocol.MessageKindHttpResponseChunk, id, &protocol.HttpResponseChunkPayload{Data: chunk}); sendErr != nil {
 				l.Error("failed to send stream chunk", "error", sendErr.Error())
 				return
@@ -295,9 +524,13 @@ func streamHttpResponse(
 			statsProvider.IncrementSseMessageRecv()
 		}
 		if err != nil {
+			err = deadlineCause(resp.Request.Context(), err)
 			endPayload := &protocol.HttpResponseEndPayload{}
-			if err != io.EOF && !errors.Is(err, context.Canceled) {
+			if err == io.EOF {
+				endPayload.Trailers = resp.Trailer
+			} else if !errors.Is(err, context.Canceled) {
 				endPayload.Error = err.Error()
+				exchange.Finish(err)
 			}
 			if !tunnel.IsClosed() {
 				if sendErr := tunnel.SendResponse(protocol.MessageKindHttpResponseEnd, id, endPayload); sendErr != nil {
@@ -340,77 +573,140 @@ func handleWebsocketCreateRequest(
 	id string,
 	payload protocol.WebsocketCreateRequestPayload,
 	options Options,
-	wsSessions *safe.Map[string, *safe.WSConn],
+	wsSessions *safe.Map[string, *websocketSession],
 	statsProvider stats.StatsProvider,
 	l log.Logger,
 ) {
 	l.Debug("handling websocket create request", "payload", payload)
-	wsUrl, err := util.GetWebsocketURL(options.Target)
-		if err != nil {
-			tunnel.SendResponse(protocol.MessageKindWebsocketCreateResponse, id, &protocol.WebsocketCreateResponsePayload{Error: err})
-			return
-		}
+	route, path, ok := options.route(payload.Path)
+	if !ok {
+		tunnel.SendResponse(protocol.MessageKindWebsocketCreateResponse, id, &protocol.WebsocketCreateResponsePayload{HttpResponse: noRouteResponse(payload.Path)})
+		return
+	}
+	wsUrl, err := util.GetWebsocketURL(route.Target)
+	if err != nil {
+		tunnel.SendResponse(protocol.MessageKindWebsocketCreateResponse, id, &protocol.WebsocketCreateResponsePayload{Error: targetError(tunnel, err)})
+		return
+	}
 
-		// Prepare headers for the WebSocket connection
-		wsHeaders := http.Header{"Origin": []string{payload.Origin}}
+	// Prepare headers for the WebSocket connection. Servers that predate
+	// relaying the visitor's headers only send the origin.
+	wsHeaders := payload.Headers.Clone()
+	if wsHeaders == nil {
+		wsHeaders = http.Header{}
+	}
+	if wsHeaders.Get("Origin") == "" && payload.Origin != "" {
+		wsHeaders.Set("Origin", payload.Origin)
+	}
+	vars := headerVars{visitorIP: payload.RemoteAddr, tunnel: options.Name, requestID: id}
+	applyHeaderRules(options.requestHeaderRules(), wsHeaders, vars)
+	if host := options.targetHost(payload.Host); host != "" {
+		wsHeaders.Set("Host", host)
+	}
 
-		// We don't need to add token to WebSocket connections as tunnel access doesn't require auth
-		// The token is only needed for /register endpoint which is handled during initial websocket connection
+	// We don't need to add token to WebSocket connections as tunnel access doesn't require auth
+	// The token is only needed for /register endpoint which is handled during initial websocket connection
 
-		targetTLS, tlsErr := targetTLSConfig(options)
-		if tlsErr != nil {
-			tunnel.SendResponse(protocol.MessageKindWebsocketCreateResponse, id, &protocol.WebsocketCreateResponsePayload{Error: tlsErr})
-			return
-		}
-		wsDialer := &websocket.Dialer{
-			Proxy:            http.ProxyFromEnvironment,
-			HandshakeTimeout: 45 * time.Second,
-			TLSClientConfig:  targetTLS,
-		}
-		rawConn, resp, err := wsDialer.DialContext(ctx, wsUrl.String()+payload.Path, wsHeaders)
-		if err != nil {
-			tunnel.SendResponse(protocol.MessageKindWebsocketCreateResponse, id, &protocol.WebsocketCreateResponsePayload{Error: err})
-			return
+	targetTLS, tlsErr := targetTLSConfig(options)
+	if tlsErr != nil {
+		tunnel.SendResponse(protocol.MessageKindWebsocketCreateResponse, id, &protocol.WebsocketCreateResponsePayload{Error: targetError(tunnel, tlsErr)})
+		return
+	}
+	wsDialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 45 * time.Second,
+		TLSClientConfig:  targetTLS,
+		Subprotocols:     payload.Subprotocols,
+	}
+	rawConn, resp, err := wsDialer.DialContext(ctx, wsUrl.String()+path, wsHeaders)
+	if resp != nil {
+		options.newURLRewriter(route, payload.Scheme, payload.Host).rewriteHeaders(resp.Header)
+		applyHeaderRules(options.ResponseHeaders, resp.Header, vars)
+	}
+	if err != nil {
+		response := &protocol.WebsocketCreateResponsePayload{Error: targetError(tunnel, err)}
+		// A target that refused the handshake answered with a status
+		// (and the start of a body) to pass on to the visitor.
+		if resp != nil {
+			body, _ := io.ReadAll(resp.Body)
+			response.HttpResponse = &protocol.HttpResponsePayload{Response: protocol.HttpResponse{
+				Status:  resp.StatusCode,
+				Headers: resp.Header,
+				Body:    body,
+			}}
 		}
+		tunnel.SendResponse(protocol.MessageKindWebsocketCreateResponse, id, response)
+		return
+	}
 
-		conn := safe.NewWSConn(rawConn)
-		statsProvider.IncrementWebsocketConnection()
+	conn := safe.NewWSConn(rawConn)
+	if payload.MaxMessageBytes > 0 {
+		conn.SetReadLimit(payload.MaxMessageBytes)
+	}
+	statsProvider.IncrementWebsocketConnection()
 
-		sessionID := uuid.New().String()
-		if ok := wsSessions.SetNX(sessionID, conn); !ok {
-			tunnel.SendResponse(protocol.MessageKindWebsocketCreateResponse, id, &protocol.WebsocketCreateResponsePayload{Error: errors.New("session already exists")})
-			return
-		}
+	sessionID := payload.SessionID
+	if sessionID == "" {
+		sessionID = uuid.New().String()
+	}
+	session := &websocketSession{conn: conn, inbox: tunnel.NewInbox(sessionID)}
+	if ok := wsSessions.SetNX(sessionID, session); !ok {
+		session.inbox.Close()
+		tunnel.SendResponse(protocol.MessageKindWebsocketCreateResponse, id, &protocol.WebsocketCreateResponsePayload{Error: targetError(tunnel, errors.New("session already exists"))})
+		return
+	}
 
-		tunnel.SendResponse(protocol.MessageKindWebsocketCreateResponse, id, &protocol.WebsocketCreateResponsePayload{
-			SessionID: sessionID,
-			HttpResponse: &protocol.HttpResponsePayload{Response: protocol.HttpResponse{
-				Status:  resp.StatusCode,
-				Headers: resp.Header,
-			}},
+	tunnel.SendResponse(protocol.MessageKindWebsocketCreateResponse, id, &protocol.WebsocketCreateResponsePayload{
+		SessionID: sessionID,
+		HttpResponse: &protocol.HttpResponsePayload{Response: protocol.HttpResponse{
+			Status:  resp.StatusCode,
+			Headers: resp.Header,
+		}},
+	})
+
+	if tunnel.Capabilities().Has(protocol.FeatureWebsocketControl) {
+		conn.RelayControl(func(messageType int, data []byte) {
+			if err := tunnel.Send(protocol.MessageKindWebsocketMessage, &protocol.WebsocketMessagePayload{SessionID: sessionID, Kind: messageType, Data: data}); err != nil {
+				l.Debug("failed to send websocket control message", "error", err.Error())
+			}
 		})
+	}
 
-		go func() {
-			l.Info("starting websocket read loop", "session_id", sessionID)
-			defer func() {
-				l.Info("closing websocket connection", "session_id", sessionID)
-				conn.Close()
-				wsSessions.Delete(sessionID)
-				statsProvider.DecrementWebsocketConnection()
-			}()
-
-			for {
-				mt, data, err := conn.ReadMessage()
-				if err != nil {
-					l.Error("exiting websocket read loop", "error", err.Error(), "session_id", sessionID)
-					break
-				}
-				statsProvider.IncrementWebsocketMessageRecv()
-				l.Debug("read ws message", "session_id", sessionID, "kind", mt, "data", string(data))
-				if err := tunnel.Send(protocol.MessageKindWebsocketMessage, &protocol.WebsocketMessagePayload{SessionID: sessionID, Kind: mt, Data: data}); err != nil {
-					l.Error("failed to send websocket message", "error", err.Error())
+	go func() {
+		l.Info("starting websocket read loop", "session_id", sessionID)
+		defer func() {
+			l.Info("closing websocket connection", "session_id", sessionID)
+			conn.Close()
+			wsSessions.Delete(sessionID)
+			tunnel.ReleaseWindow(sessionID)
+			session.inbox.Close()
+			statsProvider.DecrementWebsocketConnection()
+		}()
+
+		for {
+			mt, data, err := conn.ReadMessage()
+			if err != nil {
+				l.Error("exiting websocket read loop", "error", err.Error(), "session_id", sessionID)
+				// The server is only told when the target closed first,
+				// and closes the visitor with the target's status.
+				if _, open := wsSessions.Get(sessionID); open && !tunnel.IsClosed() {
+					code, reason := safe.CloseStatus(err)
+					if err := tunnel.Send(protocol.MessageKindWebsocketClose, &protocol.WebsocketClosePayload{SessionID: sessionID, Code: code, Reason: reason}); err != nil {
+						l.Error("failed to send websocket close", "error", err.Error())
+					}
 				}
+				break
 			}
+			statsProvider.IncrementWebsocketMessageRecv()
+			l.Debug("read ws message", "session_id", sessionID, "kind", mt, "data", string(data))
+			if err := tunnel.AcquireWindow(ctx, sessionID, len(data)); err != nil {
+				l.Debug("websocket session ended", "session_id", sessionID, "error", err.Error())
+				break
+			}
+			if err := tunnel.Send(protocol.MessageKindWebsocketMessage, &protocol.WebsocketMessagePayload{SessionID: sessionID, Kind: mt, Data: data}); err != nil {
+				l.Error("failed to send websocket message", "error", err.Error())
+			}
+		}
 	}()
 }
 
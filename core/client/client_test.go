@@ -4,22 +4,28 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/campbel/tiny-tunnel/core/client"
+	"github.com/campbel/tiny-tunnel/core/client/inspector"
 	"github.com/campbel/tiny-tunnel/core/protocol"
+	"github.com/campbel/tiny-tunnel/core/server"
 	"github.com/campbel/tiny-tunnel/core/shared"
 	"github.com/campbel/tiny-tunnel/core/stats"
 	"github.com/campbel/tiny-tunnel/internal/log"
 	"github.com/campbel/tiny-tunnel/internal/safe"
+	"github.com/campbel/tiny-tunnel/internal/util"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestClientHttpRequest(t *testing.T) {
@@ -120,7 +126,7 @@ func TestClientWebsocket(t *testing.T) {
 	err := json.Unmarshal(response.Payload, &resp)
 	assert.NoError(err)
 	assert.NotEmpty(resp.SessionID)
-	assert.NoError(resp.Error)
+	assert.Nil(resp.Error)
 	assert.Equal(resp.HttpResponse.Response.Status, 101)
 
 	safeConn.WriteJSON(protocol.Message{
@@ -243,6 +249,322 @@ LOOP:
 	assert.Equal(0, tracker.GetSseStats().ActiveConnections)
 }
 
+func TestClientRoutes(t *testing.T) {
+	assert := assert.New(t)
+
+	// Each target names itself and the path it was asked for; the API also
+	// serves websockets.
+	target := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if websocket.IsWebSocketUpgrade(r) {
+				conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				conn.WriteMessage(websocket.TextMessage, []byte(name+" "+r.URL.RequestURI()))
+				return
+			}
+			fmt.Fprintf(w, "%s %s", name, r.URL.RequestURI())
+		}))
+	}
+	webServer := target("web")
+	defer webServer.Close()
+	apiServer := target("api")
+	defer apiServer.Close()
+
+	server := startTunnel(t, server.Options{
+		Hostname: "example.com",
+	}, client.Options{
+		Name: "routes",
+		Routes: []client.Route{
+			{Prefix: "/api", Target: apiServer.URL, StripPrefix: true},
+			{Prefix: "/", Target: webServer.URL},
+		},
+	})
+
+	for path, want := range map[string]string{
+		"/":               "web /",
+		"/apis":           "web /apis",
+		"/api":            "api /",
+		"/api/users?id=1": "api /users?id=1",
+	} {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if !assert.NoError(err) {
+			continue
+		}
+		req.Host = "routes.example.com"
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(err) {
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(want, string(body), path)
+	}
+
+	wsURL, err := util.GetWebsocketURL(server.URL)
+	if !assert.NoError(err) {
+		return
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL.String()+"/api/live", http.Header{"Host": {"routes.example.com"}})
+	if !assert.NoError(err) {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, message, err := conn.ReadMessage()
+	assert.NoError(err)
+	assert.Equal("api /live", string(message))
+}
+
+func TestClientHeaderRules(t *testing.T) {
+	assert := assert.New(t)
+
+	// The target reports the headers it got, and leaks one of its own.
+	appServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := fmt.Sprintf("%s|%s|%s|%s", r.Header.Get("Authorization"), r.Header.Get("X-Visitor"), r.Header.Get("X-Tunnel"), r.Header.Get("X-Internal"))
+		w.Header().Set("X-Powered-By", "secret-framework")
+		if websocket.IsWebSocketUpgrade(r) {
+			conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.WriteMessage(websocket.TextMessage, []byte(got))
+			return
+		}
+		fmt.Fprint(w, got)
+	}))
+	defer appServer.Close()
+
+	server := startTunnel(t, server.Options{
+		Hostname: "example.com",
+	}, client.Options{
+		Name:          "rules",
+		Target:        appServer.URL,
+		TargetHeaders: http.Header{"Authorization": {"Bearer local"}},
+		RequestHeaders: []client.HeaderRule{
+			{Action: "set", Name: "X-Visitor", Value: "{visitor_ip}"},
+			{Action: "set", Name: "X-Tunnel", Value: "{tunnel}"},
+			{Action: "remove", Name: "X-Internal"},
+		},
+		ResponseHeaders: []client.HeaderRule{
+			{Action: "remove", Name: "X-Powered-By"},
+			{Action: "set", Name: "X-Request-Id", Value: "{request_id}"},
+		},
+	})
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if !assert.NoError(err) {
+		return
+	}
+	req.Host = "rules.example.com"
+	req.Header.Set("Authorization", "Bearer visitor")
+	req.Header.Set("X-Visitor", "10.0.0.1")
+	req.Header.Set("X-Internal", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(err) {
+		return
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal("Bearer local|127.0.0.1|rules|", string(body))
+	assert.Empty(resp.Header.Get("X-Powered-By"))
+	assert.NotEmpty(resp.Header.Get("X-Request-Id"))
+
+	wsURL, err := util.GetWebsocketURL(server.URL)
+	if !assert.NoError(err) {
+		return
+	}
+	conn, response, err := websocket.DefaultDialer.Dial(wsURL.String()+"/ws", http.Header{
+		"Host":       {"rules.example.com"},
+		"X-Internal": {"1"},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	defer conn.Close()
+	assert.Empty(response.Header.Get("X-Powered-By"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, message, err := conn.ReadMessage()
+	assert.NoError(err)
+	assert.Equal("Bearer local|127.0.0.1|rules|", string(message))
+}
+
+func TestClientRewriteURLs(t *testing.T) {
+	assert := assert.New(t)
+
+	var appURL string
+	appServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "1", Domain: "127.0.0.1"})
+			http.Redirect(w, r, appURL+"/home", http.StatusFound)
+		case "/home":
+			// Written in chunks, as dev servers tend to.
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprintf(w, `<p>Host %s</p>`, r.Host)
+			w.(http.Flusher).Flush()
+			fmt.Fprintf(w, `<a href="%s/about">about</a>`, appURL)
+		case "/upload":
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("Location", appURL+"/home")
+			w.WriteHeader(http.StatusSeeOther)
+			fmt.Fprintf(w, "Host %s got %d bytes", r.Host, len(body))
+		}
+	}))
+	defer appServer.Close()
+	appURL = appServer.URL
+
+	server := startTunnel(t, server.Options{
+		Hostname:     "example.com",
+		AccessScheme: "http",
+	}, client.Options{
+		Name:        "app",
+		Target:      appServer.URL,
+		HostHeader:  client.HostHeaderPreserve,
+		RewriteURLs: true,
+		RewriteBody: true,
+	})
+
+	do := func(method, path string, body io.Reader) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, body)
+		if !assert.NoError(err) {
+			return nil
+		}
+		req.Host = "app.example.com"
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if !assert.NoError(err) {
+			return nil
+		}
+		return resp
+	}
+
+	resp := do(http.MethodGet, "/", nil)
+	if resp == nil {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(http.StatusFound, resp.StatusCode)
+	assert.Equal("http://app.example.com/home", resp.Header.Get("Location"))
+	assert.Contains(resp.Header.Get("Set-Cookie"), "Domain=app.example.com")
+
+	resp = do(http.MethodGet, "/home", nil)
+	if resp == nil {
+		return
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(`<p>Host app.example.com</p><a href="http://app.example.com/about">about</a>`, string(body))
+
+	// An upload of unknown length is streamed to the client rather than
+	// sent whole, and is rewritten all the same.
+	upload := io.MultiReader(strings.NewReader("ping"), strings.NewReader(strings.Repeat("x", 1<<20)))
+	resp = do(http.MethodPost, "/upload", upload)
+	if resp == nil {
+		return
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(http.StatusSeeOther, resp.StatusCode)
+	assert.Equal("http://app.example.com/home", resp.Header.Get("Location"))
+	assert.Equal(fmt.Sprintf("Host app.example.com got %d bytes", 4+1<<20), string(body))
+}
+
+func TestClientInspector(t *testing.T) {
+	assert := assert.New(t)
+
+	appServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path == "/stream" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "data: one\n\n")
+			w.(http.Flusher).Flush()
+			fmt.Fprint(w, "data: two\n\n")
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "got %s", body)
+	}))
+	defer appServer.Close()
+
+	store := inspector.NewStore(10, 1024)
+	server := startTunnel(t, server.Options{
+		Hostname: "example.com",
+	}, client.Options{
+		Name:      "inspected",
+		Target:    appServer.URL,
+		Inspector: store,
+	})
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/echo", strings.NewReader("ping"))
+	if !assert.NoError(err) {
+		return
+	}
+	req.Host = "inspected.example.com"
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(err) {
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	req, err = http.NewRequest(http.MethodGet, server.URL+"/stream", nil)
+	if !assert.NoError(err) {
+		return
+	}
+	req.Host = "inspected.example.com"
+	resp, err = http.DefaultClient.Do(req)
+	if !assert.NoError(err) {
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	assert.Eventually(func() bool {
+		exchanges := store.Exchanges()
+		return len(exchanges) == 2 && exchanges[1].Done
+	}, 5*time.Second, 10*time.Millisecond)
+	exchanges := store.Exchanges()
+	if !assert.Len(exchanges, 2) {
+		return
+	}
+	assert.Equal(http.MethodPost, exchanges[0].Method)
+	assert.Equal("/echo", exchanges[0].Path)
+	assert.Equal("ping", exchanges[0].Request.Body)
+	assert.Equal(http.StatusOK, exchanges[0].Status)
+	assert.Equal("got ping", exchanges[0].Response.Body)
+	assert.Equal("text/plain", exchanges[0].Response.Headers.Get("Content-Type"))
+	assert.True(exchanges[1].Streamed)
+	assert.Equal("data: one\n\ndata: two\n\n", exchanges[1].Response.Body)
+	assert.Empty(exchanges[1].Error)
+}
+
+// startTunnel serves a tunnel server with serverOptions and registers a
+// client tunnel with options against it.
+func startTunnel(t *testing.T, serverOptions server.Options, options client.Options) *httptest.Server {
+	t.Helper()
+	tunnelServer := httptest.NewServer(server.NewHandler(serverOptions, log.NewTestLogger()))
+	t.Cleanup(tunnelServer.Close)
+
+	serverURL, err := url.Parse(tunnelServer.URL)
+	require.NoError(t, err)
+	options.ServerHost = serverURL.Hostname()
+	options.ServerPort = serverURL.Port()
+	options.Insecure = true
+	options.OutputWriter = io.Discard
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	state := stats.NewTunnelState(options.Target, options.Name)
+	tunnel, err := client.NewTunnel(ctx, options, state, stats.NewTestStatsProvider(), log.NewTestLogger())
+	require.NoError(t, err)
+	go tunnel.Listen(ctx)
+	require.Eventually(t, func() bool { return state.GetURL() != "" }, 5*time.Second, 10*time.Millisecond)
+	return tunnelServer
+}
+
 func setupTestScenario(t *testing.T, ctx context.Context, handler func(w http.ResponseWriter, r *http.Request)) (*shared.Tunnel, chan *safe.WSConn, chan protocol.Message, *stats.TestStatsProvider) {
 	t.Helper()
 
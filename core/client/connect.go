@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/campbel/tiny-tunnel/core/shared"
+	"github.com/campbel/tiny-tunnel/internal/log"
+	"github.com/gorilla/websocket"
+)
+
+// Connect pipes each connection accepted on ln through the server to the
+// private tunnel named options.Name, until ctx is done.
+func Connect(ctx context.Context, options Options, ln net.Listener, l log.Logger) error {
+	return serveLocal(ctx, ln, func(conn net.Conn) {
+		remote, err := DialPrivate(ctx, options, "")
+		if err != nil {
+			l.Error("failed to connect to tunnel", "name", options.Name, "error", err.Error())
+			return
+		}
+		defer remote.Close()
+		l.Info("connection opened", "name", options.Name, "local", conn.RemoteAddr().String())
+		pipe(conn, conn, remote)
+		l.Info("connection closed", "name", options.Name, "local", conn.RemoteAddr().String())
+	})
+}
+
+// serveLocal hands each connection accepted on ln to handle, which runs in
+// its own goroutine and closes the connection when it returns, until ctx
+// is done.
+func serveLocal(ctx context.Context, ln net.Listener, handle func(conn net.Conn)) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			handle(conn)
+		}()
+	}
+}
+
+// pipe copies between a local connection, read through r, and remote
+// until either side is done.
+func pipe(r io.Reader, local, remote net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, r)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// DialPrivate opens a connection to the private tunnel named options.Name.
+// A non-empty target asks an egress proxy tunnel to dial it.
+func DialPrivate(ctx context.Context, options Options, target string) (net.Conn, error) {
+	headers := http.Header{}
+	for key, values := range options.ServerHeaders {
+		headers[key] = values
+	}
+	if token := options.GetResolvedToken(); token != "" {
+		headers.Set("X-Auth-Token", token)
+	}
+	connectURL := options.ConnectURL()
+	if target != "" {
+		connectURL += "&target=" + url.QueryEscape(target)
+	}
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, connectURL, headers)
+	if err != nil {
+		if resp != nil {
+			refused := &refusedError{name: options.Name, status: resp.Status, statusCode: resp.StatusCode}
+			if body, err := io.ReadAll(resp.Body); err == nil {
+				refused.reason = strings.TrimSpace(string(body))
+			}
+			return nil, refused
+		}
+		return nil, err
+	}
+	return shared.NewStreamConn(conn), nil
+}
+
+// refusedError is the server turning down a connection to a private
+// tunnel, or the tunnel client failing to reach its target.
+type refusedError struct {
+	name       string
+	status     string
+	statusCode int
+	// reason is the server's explanation, if any.
+	reason string
+}
+
+func (e *refusedError) Error() string {
+	if e.reason == "" {
+		return fmt.Sprintf("server refused connection to %s: %s", e.name, e.status)
+	}
+	return fmt.Sprintf("server refused connection to %s: %s: %s", e.name, e.status, e.reason)
+}
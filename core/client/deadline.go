@@ -0,0 +1,91 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/campbel/tiny-tunnel/core/protocol"
+)
+
+// errDeadlineExceeded cancels target requests that run past a deadline set
+// by the server. It is reported back as a timeout.
+var errDeadlineExceeded = fmt.Errorf("tunnel deadline exceeded: %w", context.DeadlineExceeded)
+
+// watchdog applies the server's deadlines to a target request: first to the
+// wait for the response head, once the request has been sent, then to each
+// read of the response body. It cancels the request when one runs out.
+type watchdog struct {
+	timeouts protocol.Timeouts
+	timer    *time.Timer
+}
+
+func newWatchdog(timeouts protocol.Timeouts, cancel context.CancelCauseFunc) *watchdog {
+	timer := time.AfterFunc(time.Hour, func() { cancel(errDeadlineExceeded) })
+	timer.Stop()
+	return &watchdog{timeouts: timeouts, timer: timer}
+}
+
+func (w *watchdog) arm(d time.Duration) {
+	if d > 0 {
+		w.timer.Reset(d)
+	}
+}
+
+// sent starts the response head deadline.
+func (w *watchdog) sent() {
+	w.arm(w.timeouts.ResponseHeader())
+}
+
+// stop disarms the watchdog.
+func (w *watchdog) stop() {
+	w.timer.Stop()
+}
+
+// watchBody calls sent once the target has read body to the end.
+func (w *watchdog) watchBody(body io.Reader) io.Reader {
+	return &sentReader{r: body, sent: w.sent}
+}
+
+// watchResponse applies the idle deadline to reads of body. Time spent
+// between reads, such as waiting for the server's window, does not count.
+func (w *watchdog) watchResponse(body io.ReadCloser) io.ReadCloser {
+	return &idleReader{ReadCloser: body, w: w}
+}
+
+// deadlineCause returns the deadline that cut ctx short in place of err, so
+// the failure is reported as a timeout rather than a cancellation.
+func deadlineCause(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); errors.Is(cause, errDeadlineExceeded) {
+		return cause
+	}
+	return err
+}
+
+type sentReader struct {
+	r    io.Reader
+	sent func()
+	once sync.Once
+}
+
+func (s *sentReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err == io.EOF {
+		s.once.Do(s.sent)
+	}
+	return n, err
+}
+
+type idleReader struct {
+	io.ReadCloser
+	w *watchdog
+}
+
+func (i *idleReader) Read(p []byte) (int, error) {
+	i.w.arm(i.w.timeouts.Idle())
+	defer i.w.stop()
+	return i.ReadCloser.Read(p)
+}
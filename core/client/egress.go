@@ -0,0 +1,85 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var errEgressDenied = errors.New("destination is not in the egress allowlist")
+
+// egressPolicy is the allowlist of an egress proxy tunnel. Entries are
+// networks ("10.0.0.0/8"), addresses, hostnames ("lab.local") and
+// hostname wildcards ("*.corp.example.com").
+type egressPolicy struct {
+	prefixes []netip.Prefix
+	hosts    []string
+}
+
+func parseEgressPolicy(allow []string) (egressPolicy, error) {
+	var p egressPolicy
+	for _, entry := range allow {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			p.prefixes = append(p.prefixes, prefix.Masked())
+		} else if addr, err := netip.ParseAddr(entry); err == nil {
+			p.prefixes = append(p.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		} else if entry != "" && !strings.ContainsAny(entry, "/:") {
+			p.hosts = append(p.hosts, entry)
+		} else {
+			return egressPolicy{}, fmt.Errorf("invalid egress allowlist entry %q", entry)
+		}
+	}
+	return p, nil
+}
+
+func (p egressPolicy) allowsHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range p.hosts {
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (p egressPolicy) allowsAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialer returns the dialer for target. Hosts allowed by name are dialed as
+// they resolve; anything else only reaches addresses inside an allowed
+// network, checked on the resolved address so a name cannot point the
+// client elsewhere.
+func (p egressPolicy) dialer(target string) (*net.Dialer, error) {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if p.allowsHost(host) {
+		return dialer, nil
+	}
+	dialer.Control = func(network, address string, c syscall.RawConn) error {
+		addrPort, err := netip.ParseAddrPort(address)
+		if err != nil || !p.allowsAddr(addrPort.Addr()) {
+			return errEgressDenied
+		}
+		return nil
+	}
+	return dialer, nil
+}
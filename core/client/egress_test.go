@@ -0,0 +1,60 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/campbel/tiny-tunnel/core/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEgressPolicy(t *testing.T) {
+	_, err := parseEgressPolicy([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+
+	policy, err := parseEgressPolicy([]string{"10.0.0.0/8", "192.168.1.5", "Lab.Local", "*.corp.example.com"})
+	require.NoError(t, err)
+
+	hosts := []struct {
+		host string
+		want bool
+	}{
+		{"lab.local", true},
+		{"LAB.local.", true},
+		{"db.corp.example.com", true},
+		{"corp.example.com", false},
+		{"example.com", false},
+	}
+	for _, tt := range hosts {
+		assert.Equal(t, tt.want, policy.allowsHost(tt.host), tt.host)
+	}
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+
+	// Neither the address nor the name it is dialed by is allowed.
+	for _, addr := range []string{target.Addr().String(), "localhost:" + portOf(target)} {
+		dialer, err := policy.dialer(addr)
+		require.NoError(t, err)
+		_, err = dialer.DialContext(context.Background(), "tcp", addr)
+		assert.ErrorIs(t, err, errEgressDenied, addr)
+		assert.Equal(t, protocol.ErrorCodeForbidden, errorCode(err))
+	}
+
+	loopback, err := parseEgressPolicy([]string{"127.0.0.0/8"})
+	require.NoError(t, err)
+	dialer, err := loopback.dialer(target.Addr().String())
+	require.NoError(t, err)
+	conn, err := dialer.DialContext(context.Background(), "tcp", target.Addr().String())
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+}
+
+func portOf(ln net.Listener) string {
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
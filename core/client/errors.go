@@ -0,0 +1,60 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/campbel/tiny-tunnel/core/protocol"
+	"github.com/campbel/tiny-tunnel/core/shared"
+)
+
+// targetError describes a failed request to the target for the server.
+// Servers that predate error codes cannot decode it and get nothing, which
+// they already answer with a 502.
+func targetError(tunnel *shared.Tunnel, err error) *protocol.Error {
+	if !tunnel.Capabilities().Has(protocol.FeatureErrorCodes) {
+		return nil
+	}
+	return &protocol.Error{Code: errorCode(err), Message: err.Error()}
+}
+
+// errorCode classifies err, as returned by dialing or requesting the target.
+func errorCode(err error) protocol.ErrorCode {
+	var (
+		dnsErr         *net.DNSError
+		certErr        *tls.CertificateVerificationError
+		recordErr      tls.RecordHeaderError
+		alertErr       tls.AlertError
+		unknownAuthErr x509.UnknownAuthorityError
+		hostnameErr    x509.HostnameError
+		certInvalidErr x509.CertificateInvalidError
+		netErr         net.Error
+	)
+	switch {
+	case errors.Is(err, errEgressDenied):
+		return protocol.ErrorCodeForbidden
+	case errors.Is(err, context.Canceled):
+		return protocol.ErrorCodeCancelled
+	case errors.Is(err, context.DeadlineExceeded):
+		return protocol.ErrorCodeTimeout
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsTimeout {
+			return protocol.ErrorCodeTimeout
+		}
+		return protocol.ErrorCodeDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return protocol.ErrorCodeConnectionRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return protocol.ErrorCodeReset
+	case errors.As(err, &certErr), errors.As(err, &recordErr), errors.As(err, &alertErr),
+		errors.As(err, &unknownAuthErr), errors.As(err, &hostnameErr), errors.As(err, &certInvalidErr):
+		return protocol.ErrorCodeTLS
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return protocol.ErrorCodeTimeout
+	}
+	return protocol.ErrorCodeUnknown
+}
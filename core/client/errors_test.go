@@ -0,0 +1,41 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/campbel/tiny-tunnel/core/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorCode(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	_, refused := http.Get(closed.URL)
+
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsServer.Close()
+	_, untrusted := http.Get(tlsServer.URL)
+
+	tests := []struct {
+		name string
+		err  error
+		want protocol.ErrorCode
+	}{
+		{"refused", refused, protocol.ErrorCodeConnectionRefused},
+		{"untrusted certificate", untrusted, protocol.ErrorCodeTLS},
+		{"dns", &net.DNSError{Err: "no such host", Name: "nowhere.invalid", IsNotFound: true}, protocol.ErrorCodeDNS},
+		{"timeout", context.DeadlineExceeded, protocol.ErrorCodeTimeout},
+		{"cancelled", context.Canceled, protocol.ErrorCodeCancelled},
+		{"unknown", errors.New("boom"), protocol.ErrorCodeUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, errorCode(tt.err))
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// HeaderRule adds, sets or removes a header of the requests sent to the
+// target or of the responses relayed back. Values may refer to the request
+// they are applied to with {visitor_ip}, {tunnel} and {request_id}.
+type HeaderRule struct {
+	// Action is "add", "set" or "remove".
+	Action string
+	Name   string
+	Value  string
+}
+
+// ParseHeaderRule parses a rule written "add:Name=value", "set:Name=value"
+// or "remove:Name".
+func ParseHeaderRule(s string) (HeaderRule, error) {
+	action, rest, ok := strings.Cut(s, ":")
+	if !ok {
+		return HeaderRule{}, fmt.Errorf("invalid header rule %q: expected action:name[=value]", s)
+	}
+	rule := HeaderRule{Action: strings.ToLower(action)}
+	switch rule.Action {
+	case "add", "set":
+		if rule.Name, rule.Value, ok = strings.Cut(rest, "="); !ok {
+			return HeaderRule{}, fmt.Errorf("invalid header rule %q: expected %s:name=value", s, rule.Action)
+		}
+	case "remove":
+		rule.Name = rest
+	default:
+		return HeaderRule{}, fmt.Errorf("invalid header rule %q: action must be add, set or remove", s)
+	}
+	rule.Name = strings.TrimSpace(rule.Name)
+	if rule.Name == "" {
+		return HeaderRule{}, fmt.Errorf("invalid header rule %q: missing header name", s)
+	}
+	return rule, nil
+}
+
+// ParseHeaderRules parses each of rules with ParseHeaderRule.
+func ParseHeaderRules(rules []string) ([]HeaderRule, error) {
+	var parsed []HeaderRule
+	for _, r := range rules {
+		rule, err := ParseHeaderRule(r)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
+
+// headerVars are the values header rule templates expand to.
+type headerVars struct {
+	visitorIP string
+	tunnel    string
+	requestID string
+}
+
+func (v headerVars) expand(value string) string {
+	return strings.NewReplacer(
+		"{visitor_ip}", v.visitorIP,
+		"{tunnel}", v.tunnel,
+		"{request_id}", v.requestID,
+	).Replace(value)
+}
+
+// applyHeaderRules applies rules to headers in order.
+func applyHeaderRules(rules []HeaderRule, headers http.Header, vars headerVars) {
+	for _, rule := range rules {
+		switch rule.Action {
+		case "add":
+			headers.Add(rule.Name, vars.expand(rule.Value))
+		case "set":
+			headers.Set(rule.Name, vars.expand(rule.Value))
+		case "remove":
+			headers.Del(rule.Name)
+		}
+	}
+}
+
+// requestHeaderRules returns the rules applied to requests to the target:
+// TargetHeaders, set first, then RequestHeaders.
+func (c Options) requestHeaderRules() []HeaderRule {
+	var rules []HeaderRule
+	for name, values := range c.TargetHeaders {
+		for i, value := range values {
+			action := "add"
+			if i == 0 {
+				action = "set"
+			}
+			rules = append(rules, HeaderRule{Action: action, Name: name, Value: value})
+		}
+	}
+	return append(rules, c.RequestHeaders...)
+}
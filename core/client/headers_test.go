@@ -0,0 +1,48 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderRules(t *testing.T) {
+	rules, err := ParseHeaderRules([]string{
+		"set:X-Visitor={visitor_ip}",
+		"add:Via=tnl/{tunnel}",
+		"SET:X-Request-Id={request_id}",
+		"remove:X-Internal",
+		"set:X-Equation=a=b",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, HeaderRule{Action: "set", Name: "X-Equation", Value: "a=b"}, rules[4])
+
+	for _, s := range []string{"X-Foo=bar", "set:X-Foo", "rename:X-Foo=X-Bar", "remove:", "add:=bar"} {
+		_, err := ParseHeaderRule(s)
+		assert.Error(t, err, s)
+	}
+
+	headers := http.Header{
+		"Via":        {"1.1 proxy"},
+		"X-Internal": {"secret"},
+		"X-Visitor":  {"spoofed"},
+	}
+	applyHeaderRules(rules, headers, headerVars{visitorIP: "203.0.113.9", tunnel: "web", requestID: "abc"})
+	assert.Equal(t, http.Header{
+		"Via":          {"1.1 proxy", "tnl/web"},
+		"X-Visitor":    {"203.0.113.9"},
+		"X-Request-Id": {"abc"},
+		"X-Equation":   {"a=b"},
+	}, headers)
+
+	// Target headers come first, so rules can undo them.
+	options := Options{
+		TargetHeaders:  http.Header{"Authorization": {"Bearer abc"}},
+		RequestHeaders: []HeaderRule{{Action: "remove", Name: "Authorization"}},
+	}
+	headers = http.Header{"Authorization": {"Basic visitor"}}
+	applyHeaderRules(options.requestHeaderRules(), headers, headerVars{})
+	assert.Empty(t, headers)
+}
@@ -0,0 +1,57 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// targetTransport sends gRPC requests to the target over HTTP/2, which gRPC
+// requires, and everything else over HTTP/1.1 so upgrades keep working.
+type targetTransport struct {
+	http1 *http.Transport
+	// http2 is negotiated with ALPN for https targets; h2c speaks cleartext
+	// HTTP/2 with prior knowledge to http ones.
+	http2 *http2.Transport
+	h2c   *http2.Transport
+}
+
+func newTargetTransport(http1 *http.Transport, tlsConfig *tls.Config) *targetTransport {
+	return &targetTransport{
+		http1: http1,
+		http2: &http2.Transport{TLSClientConfig: tlsConfig},
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+}
+
+func (t *targetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isGRPC(req.Header) {
+		return t.http1.RoundTrip(req)
+	}
+	// Routes may mix http and https targets, so pick per request.
+	if req.URL.Scheme == "http" {
+		return t.h2c.RoundTrip(req)
+	}
+	return t.http2.RoundTrip(req)
+}
+
+// isGRPC reports whether headers describe a gRPC message, as opposed to
+// gRPC-Web, which works over HTTP/1.1.
+func isGRPC(headers http.Header) bool {
+	contentType := headers.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "application/grpc") {
+		return false
+	}
+	rest := contentType[len("application/grpc"):]
+	return rest == "" || rest[0] == '+' || rest[0] == ';'
+}
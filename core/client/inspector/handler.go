@@ -0,0 +1,92 @@
+package inspector
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"strings"
+)
+
+//go:embed static
+var staticFiles embed.FS
+
+// Handler serves the inspector: its page at /, the recorded exchanges at
+// /api/requests and their changes as server-sent events at /api/events.
+//
+// What it records includes credentials, so only requests for a loopback
+// host or the host of addr, the address it listens on, are answered. A web
+// page rebinding its own name to the inspector's address cannot read it.
+func (s *Store) Handler(addr string) http.Handler {
+	fsys, err := fs.Sub(staticFiles, "static")
+	if err != nil {
+		panic(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /", http.FileServer(http.FS(fsys)))
+	mux.HandleFunc("GET /api/requests", s.handleRequests)
+	mux.HandleFunc("GET /api/events", s.handleEvents)
+	return allowHosts(addr, mux)
+}
+
+// allowHosts passes the requests whose Host is a loopback host or the host
+// of addr on to next, and refuses the others.
+func allowHosts(addr string, next http.Handler) http.Handler {
+	listenHost, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		listenHost = addr
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if !isLoopback(host) && (listenHost == "" || !strings.EqualFold(host, listenHost)) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isLoopback(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s *Store) handleRequests(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Exchanges())
+}
+
+func (s *Store) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	events, unsubscribe := s.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case data := <-events:
+			if _, err := fmt.Fprintf(w, "event: exchange\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
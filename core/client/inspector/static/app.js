@@ -0,0 +1,128 @@
+document.addEventListener('DOMContentLoaded', () => {
+    const rows = document.getElementById('requests');
+    const empty = document.getElementById('empty');
+    const connection = document.getElementById('connection');
+    const exchanges = new Map();
+    let selected = null;
+
+    // Load what has been recorded so far, then follow along live.
+    fetch('/api/requests')
+        .then((response) => response.json())
+        .then((list) => list.forEach(update))
+        .catch((error) => console.error('Error loading requests:', error));
+
+    const events = new EventSource('/api/events');
+    events.addEventListener('open', () => {
+        connection.textContent = 'live';
+        connection.classList.add('live');
+    });
+    events.addEventListener('error', () => {
+        connection.textContent = 'reconnecting…';
+        connection.classList.remove('live');
+    });
+    events.addEventListener('exchange', (event) => update(JSON.parse(event.data)));
+
+    function update(exchange) {
+        const known = exchanges.get(exchange.id);
+        exchanges.set(exchange.id, exchange);
+        const row = known ? known.row : document.createElement('tr');
+        exchange.row = row;
+        if (!known) {
+            row.addEventListener('click', () => select(exchange.id));
+            rows.prepend(row);
+        }
+        row.replaceChildren(
+            cell(exchange.method),
+            cell(exchange.path, 'path'),
+            cell(status(exchange), statusClass(exchange)),
+            cell(new Date(exchange.started_at).toLocaleTimeString()),
+            cell(exchange.done ? duration(exchange.duration_ms) : '…'),
+        );
+        empty.classList.add('hidden');
+        if (selected === exchange.id) {
+            show(exchange);
+        }
+    }
+
+    function select(id) {
+        if (selected !== null && exchanges.has(selected)) {
+            exchanges.get(selected).row.classList.remove('selected');
+        }
+        selected = id;
+        const exchange = exchanges.get(id);
+        exchange.row.classList.add('selected');
+        show(exchange);
+    }
+
+    function show(exchange) {
+        document.getElementById('detail').classList.remove('hidden');
+        document.getElementById('detail-title').textContent = `${exchange.method} ${exchange.path}`;
+        const summary = [status(exchange)];
+        if (exchange.done) {
+            summary.push(duration(exchange.duration_ms));
+        }
+        if (exchange.remote_addr) {
+            summary.push(`from ${exchange.remote_addr}`);
+        }
+        if (exchange.streamed) {
+            summary.push('streamed');
+        }
+        document.getElementById('detail-summary').textContent = summary.join(' · ');
+        document.getElementById('request-headers').textContent = headers(exchange.request.headers);
+        document.getElementById('request-body').textContent = body(exchange.request);
+        document.getElementById('response-headers').textContent = headers(exchange.response.headers);
+        document.getElementById('response-body').textContent = body(exchange.response);
+    }
+
+    function cell(text, className) {
+        const td = document.createElement('td');
+        td.textContent = text;
+        if (className) {
+            td.className = className;
+        }
+        return td;
+    }
+
+    function status(exchange) {
+        if (exchange.error) {
+            return `error: ${exchange.error}`;
+        }
+        return exchange.status ? String(exchange.status) : 'pending';
+    }
+
+    function statusClass(exchange) {
+        if (exchange.error || exchange.status >= 400) {
+            return 'status-error';
+        }
+        if (exchange.status >= 300) {
+            return 'status-redirect';
+        }
+        return exchange.status ? 'status-ok' : '';
+    }
+
+    function duration(ms) {
+        return ms < 1000 ? `${ms.toFixed(1)} ms` : `${(ms / 1000).toFixed(2)} s`;
+    }
+
+    function headers(h) {
+        if (!h) {
+            return '(no headers)';
+        }
+        return Object.keys(h).sort()
+            .flatMap((name) => h[name].map((value) => `${name}: ${value}`))
+            .join('\n');
+    }
+
+    function body(message) {
+        if (message.size === 0) {
+            return '(no body)';
+        }
+        if (message.binary) {
+            return `(binary, ${message.size} bytes)`;
+        }
+        if (message.truncated) {
+            return `${message.body}\n… (${message.size} bytes in all)`;
+        }
+        return message.body;
+    }
+});
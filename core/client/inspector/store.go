@@ -0,0 +1,261 @@
+// Package inspector records the HTTP requests a tunnel proxies and serves
+// them on a local web page that updates as they happen.
+package inspector
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Default limits of a Store.
+const (
+	DefaultCapacity     = 100
+	DefaultMaxBodyBytes = 64 << 10
+)
+
+// Store keeps the most recent exchanges in memory, dropping the oldest once
+// it is full, and tells subscribers about every change. A nil Store records
+// nothing.
+type Store struct {
+	capacity     int
+	maxBodyBytes int
+
+	mu          sync.Mutex
+	exchanges   []*Exchange
+	nextID      int64
+	subscribers map[chan []byte]struct{}
+}
+
+// NewStore returns a store of up to capacity exchanges whose bodies are
+// kept up to maxBodyBytes each. Values below 1 take the defaults.
+func NewStore(capacity, maxBodyBytes int) *Store {
+	if capacity < 1 {
+		capacity = DefaultCapacity
+	}
+	if maxBodyBytes < 1 {
+		maxBodyBytes = DefaultMaxBodyBytes
+	}
+	return &Store{
+		capacity:     capacity,
+		maxBodyBytes: maxBodyBytes,
+		subscribers:  make(map[chan []byte]struct{}),
+	}
+}
+
+// Exchange is a proxied request and the response to it. Its fields are
+// guarded by the store it belongs to.
+type Exchange struct {
+	// ID numbers the exchanges of a store in the order they began.
+	ID         int64     `json:"id"`
+	RequestID  string    `json:"request_id"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	// Duration is how long the exchange took, in milliseconds, once it is
+	// Done.
+	Duration float64 `json:"duration_ms"`
+	Status   int     `json:"status,omitempty"`
+	// Streamed is set for responses relayed chunk by chunk.
+	Streamed bool    `json:"streamed,omitempty"`
+	Error    string  `json:"error,omitempty"`
+	Done     bool    `json:"done"`
+	Request  Message `json:"request"`
+	Response Message `json:"response"`
+
+	store *Store
+}
+
+// Message is the head and the start of the body of a request or response.
+type Message struct {
+	Headers http.Header `json:"headers,omitempty"`
+	// Body is kept up to the store's limit; Size counts all of it.
+	Body      string `json:"body,omitempty"`
+	Size      int64  `json:"size"`
+	Truncated bool   `json:"truncated,omitempty"`
+	// Binary is set for bodies that are not UTF-8, which are not kept.
+	Binary bool `json:"binary,omitempty"`
+
+	body []byte
+}
+
+func (m *Message) write(p []byte, limit int) {
+	m.Size += int64(len(p))
+	if room := limit - len(m.body); room < len(p) {
+		p = p[:max(room, 0)]
+		m.Truncated = true
+	}
+	m.body = append(m.body, p...)
+}
+
+// snapshot returns a copy of m fit to be encoded.
+func (m Message) snapshot() Message {
+	m.Headers = m.Headers.Clone()
+	body := m.body
+	if m.Truncated {
+		// Don't count a rune cut in half at the limit against the body.
+		for i := 0; i < utf8.UTFMax && len(body) > 0 && !utf8.Valid(body); i++ {
+			body = body[:len(body)-1]
+		}
+	}
+	if utf8.Valid(body) {
+		m.Body = string(body)
+	} else {
+		m.Binary = true
+	}
+	m.body = nil
+	return m
+}
+
+// Begin records the start of a request, with its body when it is buffered.
+func (s *Store) Begin(requestID, method, path, remoteAddr string, headers http.Header, body []byte) *Exchange {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	e := &Exchange{
+		ID:         s.nextID,
+		RequestID:  requestID,
+		Method:     method,
+		Path:       path,
+		RemoteAddr: remoteAddr,
+		StartedAt:  time.Now(),
+		Request:    Message{Headers: headers.Clone()},
+		store:      s,
+	}
+	e.Request.write(body, s.maxBodyBytes)
+	if len(s.exchanges) == s.capacity {
+		copy(s.exchanges, s.exchanges[1:])
+		s.exchanges = s.exchanges[:len(s.exchanges)-1]
+	}
+	s.exchanges = append(s.exchanges, e)
+	s.publish(e)
+	return e
+}
+
+// RequestBody returns a reader of body that records what is read from it,
+// for streamed request bodies.
+func (e *Exchange) RequestBody(body io.Reader) io.Reader {
+	if e == nil {
+		return body
+	}
+	return &captureReader{r: body, e: e}
+}
+
+type captureReader struct {
+	r io.Reader
+	e *Exchange
+}
+
+func (c *captureReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.e.store.mu.Lock()
+		c.e.Request.write(p[:n], c.e.store.maxBodyBytes)
+		c.e.store.mu.Unlock()
+	}
+	return n, err
+}
+
+// Respond records the head of the response, with its body when it is
+// buffered.
+func (e *Exchange) Respond(status int, headers http.Header, body []byte, streamed bool) {
+	if e == nil {
+		return
+	}
+	e.store.mu.Lock()
+	defer e.store.mu.Unlock()
+	e.Status = status
+	e.Streamed = streamed
+	e.Response.Headers = headers.Clone()
+	e.Response.write(body, e.store.maxBodyBytes)
+	e.store.publish(e)
+}
+
+// ResponseBody records a chunk of a streamed response body.
+func (e *Exchange) ResponseBody(chunk []byte) {
+	if e == nil {
+		return
+	}
+	e.store.mu.Lock()
+	defer e.store.mu.Unlock()
+	e.Response.write(chunk, e.store.maxBodyBytes)
+}
+
+// Finish records the end of the exchange and the error it failed with, if
+// any.
+func (e *Exchange) Finish(err error) {
+	if e == nil {
+		return
+	}
+	e.store.mu.Lock()
+	defer e.store.mu.Unlock()
+	if e.Done {
+		return
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	e.Duration = float64(time.Since(e.StartedAt).Microseconds()) / 1000
+	e.Done = true
+	e.store.publish(e)
+}
+
+// snapshot returns a copy of e fit to be encoded. The store's lock must be
+// held.
+func (e *Exchange) snapshot() Exchange {
+	c := *e
+	c.Request = e.Request.snapshot()
+	c.Response = e.Response.snapshot()
+	c.store = nil
+	return c
+}
+
+// Exchanges returns a copy of the exchanges in the store, oldest first.
+func (s *Store) Exchanges() []Exchange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exchanges := make([]Exchange, 0, len(s.exchanges))
+	for _, e := range s.exchanges {
+		exchanges = append(exchanges, e.snapshot())
+	}
+	return exchanges
+}
+
+// Subscribe returns a channel of the exchanges that change from now on,
+// encoded as JSON, and a function to stop receiving them. Subscribers
+// that fall behind miss updates rather than hold up the tunnel.
+func (s *Store) Subscribe() (<-chan []byte, func()) {
+	ch := make(chan []byte, 64)
+	s.mu.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.mu.Unlock()
+	return ch, func() {
+		s.mu.Lock()
+		delete(s.subscribers, ch)
+		s.mu.Unlock()
+	}
+}
+
+// publish sends e to the subscribers. The store's lock must be held.
+func (s *Store) publish(e *Exchange) {
+	if len(s.subscribers) == 0 {
+		return
+	}
+	data, err := json.Marshal(e.snapshot())
+	if err != nil {
+		return
+	}
+	for ch := range s.subscribers {
+		select {
+		case ch <- data:
+		default:
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package inspector
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	store := NewStore(2, 8)
+
+	first := store.Begin("a", "POST", "/upload", "203.0.113.9", http.Header{"Content-Type": {"text/plain"}}, []byte("0123456789"))
+	first.Respond(http.StatusCreated, http.Header{"Location": {"/upload/1"}}, nil, false)
+	first.Finish(nil)
+
+	second := store.Begin("b", "GET", "/stream", "", nil, nil)
+	second.Respond(http.StatusOK, nil, nil, true)
+	second.ResponseBody([]byte{0xff, 0xfe})
+	second.Finish(errors.New("target went away"))
+	second.Finish(nil)
+
+	exchanges := store.Exchanges()
+	require.Len(t, exchanges, 2)
+	assert.Equal(t, int64(1), exchanges[0].ID)
+	assert.Equal(t, Message{Headers: http.Header{"Content-Type": {"text/plain"}}, Body: "01234567", Size: 10, Truncated: true}, exchanges[0].Request)
+	assert.Equal(t, http.StatusCreated, exchanges[0].Status)
+	assert.True(t, exchanges[0].Done)
+	assert.True(t, exchanges[1].Streamed)
+	assert.True(t, exchanges[1].Response.Binary)
+	assert.Equal(t, "target went away", exchanges[1].Error)
+
+	// A streamed request body is recorded as the target reads it.
+	third := store.Begin("c", "PUT", "/chunked", "", nil, nil)
+	body, err := io.ReadAll(third.RequestBody(strings.NewReader("hello")))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+
+	// The oldest exchange makes room for the newest.
+	exchanges = store.Exchanges()
+	require.Len(t, exchanges, 2)
+	assert.Equal(t, "b", exchanges[0].RequestID)
+	assert.Equal(t, "hello", exchanges[1].Request.Body)
+	assert.False(t, exchanges[1].Done)
+
+	// A nil store records nothing.
+	var none *Store
+	e := none.Begin("d", "GET", "/", "", nil, nil)
+	assert.Nil(t, e)
+	e.Respond(http.StatusOK, nil, nil, false)
+	e.Finish(nil)
+}
+
+func TestHandler(t *testing.T) {
+	store := NewStore(0, 0)
+	server := httptest.NewServer(store.Handler("127.0.0.1:0"))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/html")
+
+	events, err := http.Get(server.URL + "/api/events")
+	require.NoError(t, err)
+	defer events.Body.Close()
+	assert.Equal(t, "text/event-stream", events.Header.Get("Content-Type"))
+
+	store.Begin("a", "GET", "/hello", "", nil, nil).Finish(nil)
+
+	// Every change to the exchange is an event.
+	scanner := bufio.NewScanner(events.Body)
+	var updates []Exchange
+	for len(updates) < 2 && scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var e Exchange
+		require.NoError(t, json.Unmarshal([]byte(data), &e))
+		updates = append(updates, e)
+	}
+	require.Len(t, updates, 2)
+	assert.Equal(t, "/hello", updates[0].Path)
+	assert.False(t, updates[0].Done)
+	assert.True(t, updates[1].Done)
+
+	resp, err = http.Get(server.URL + "/api/requests")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var exchanges []Exchange
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&exchanges))
+	require.Len(t, exchanges, 1)
+	assert.Equal(t, "a", exchanges[0].RequestID)
+}
+
+func TestHandlerRefusesOtherHosts(t *testing.T) {
+	handler := NewStore(0, 0).Handler("inspect.lan:4040")
+	for host, want := range map[string]int{
+		"127.0.0.1:4040":     http.StatusOK,
+		"[::1]:4040":         http.StatusOK,
+		"localhost:4040":     http.StatusOK,
+		"inspect.lan:4040":   http.StatusOK,
+		"INSPECT.LAN":        http.StatusOK,
+		"rebound.example":    http.StatusForbidden,
+		"10.0.0.5:4040":      http.StatusForbidden,
+		"localhost.evil.com": http.StatusForbidden,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/requests", nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, want, rec.Code, host)
+	}
+}
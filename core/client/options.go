@@ -9,7 +9,10 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+
+	"github.com/campbel/tiny-tunnel/core/client/inspector"
 )
 
 // ServerConfig holds configuration for a specific server
@@ -350,25 +353,83 @@ func SaveTokenToConfig(server, token string) error {
 }
 
 type Options struct {
-	Target            string
-	Name              string
-	ServerHost        string
-	ServerPort        string
-	Insecure          bool
+	Target string
+	// Routes send requests to other targets by path prefix, the longest
+	// matching prefix first. Requests no route matches go to Target.
+	Routes     []Route
+	Name       string
+	ServerHost string
+	ServerPort string
+	Insecure   bool
 	// TargetInsecure skips TLS verification when connecting to the target
 	// (e.g. a local k8s apiserver with a self-signed cert). Unlike Insecure,
 	// it does not affect the connection to the tunnel server.
 	TargetInsecure bool
 	// TargetCAFile is a path to a PEM CA bundle used to verify the target's
 	// TLS certificate.
-	TargetCAFile string
+	TargetCAFile      string
 	AllowedIPs        []string
 	ReconnectAttempts int
 	TargetHeaders     http.Header
-	ServerHeaders     http.Header
-	Token             string // JWT auth token
+	// RequestHeaders and ResponseHeaders rewrite the headers of requests to
+	// the target, after TargetHeaders, and of the responses relayed back.
+	RequestHeaders  []HeaderRule
+	ResponseHeaders []HeaderRule
+	// HostHeader is the Host sent to the target: its own with
+	// HostHeaderRewrite (the default), the visitor's with
+	// HostHeaderPreserve, or any other value as is.
+	HostHeader string
+	// RewriteURLs rewrites the target's absolute URLs in the Location and
+	// Content-Location of responses, and the domain of their cookies, to
+	// the tunnel's.
+	RewriteURLs bool
+	// RewriteBody rewrites the target's origin to the tunnel's in HTML and
+	// JSON response bodies.
+	RewriteBody   bool
+	ServerHeaders http.Header
+	Token         string // JWT auth token
+	// Compression asks the server to compress tunnel traffic
+	// (permessage-deflate). Worth it for text-heavy traffic on slow links.
+	Compression bool
+	// Connections is the number of websocket connections the tunnel is
+	// spread across; values below 2 mean a single connection.
+	Connections int
+	// PoolKey is a secret presented on every connection so that all of
+	// them can register under Name. Required when Connections > 1.
+	PoolKey string
+	// ResumeToken reclaims a name the server is holding after the tunnel
+	// dropped. It is taken from the last RegisterAck.
+	ResumeToken string
+	// TCPAddr makes the tunnel a TCP tunnel: raw TCP connections to its
+	// public port are relayed to this address instead of HTTP to Target.
+	TCPAddr string
+	// UDPAddr makes the tunnel a UDP tunnel: datagrams sent to its public
+	// port are relayed to this address.
+	UDPAddr string
+	// RemotePort is the public port to ask the server for, for a TCP or UDP
+	// tunnel; zero lets the server pick one.
+	RemotePort int
+	// TLSPassthrough makes the tunnel take TLS connections for its hostname,
+	// routed by SNI, and relay them still encrypted to TCPAddr.
+	TLSPassthrough bool
+	// Private makes the tunnel reachable only through `tnl connect`, which
+	// relays raw connections to TCPAddr. The server routes no HTTP to it.
+	Private bool
+	// Share lists the users, by subject or email, who may connect to a
+	// private tunnel besides the one who started it.
+	Share []string
+	// EgressProxy makes a private tunnel dial the destination each
+	// connection asks for, from this machine, as long as EgressAllow allows
+	// it.
+	EgressProxy bool
+	// EgressAllow lists the networks, addresses, hostnames and
+	// "*.domain" wildcards an egress proxy tunnel may dial.
+	EgressAllow []string
 
 	OutputWriter io.Writer
+	// Inspector records the HTTP requests the tunnel proxies, for the
+	// request inspector. Nothing is recorded when it is nil.
+	Inspector *inspector.Store
 }
 
 func (c Options) Origin() string {
@@ -382,7 +443,8 @@ func (c Options) Origin() string {
 	return c.SchemeHTTP() + "://" + host
 }
 
-func (c Options) URL() string {
+// serverURL returns the websocket URL of the server.
+func (c Options) serverURL() string {
 	// Extract hostname and port if serverHost already contains port info
 	host := c.ServerHost
 	port := c.ServerPort
@@ -410,10 +472,82 @@ func (c Options) URL() string {
 		}
 	}
 
-	url := c.SchemeWS() + "://" + host + ":" + port + "/register?name=" + c.Name
+	return c.SchemeWS() + "://" + host + ":" + port
+}
+
+func (c Options) URL() string {
+	url := c.serverURL() + "/register?name=" + c.Name
+	if c.PoolKey != "" || c.ResumeToken != "" {
+		url += "&" + c.poolQuery()
+	}
+	if c.TCPAddr != "" && c.TLSPassthrough {
+		url += "&tls=1"
+	} else if c.Private {
+		url += "&private=1"
+		if len(c.Share) > 0 {
+			url += "&" + c.shareQuery()
+		}
+	} else if c.TCPAddr != "" {
+		url += "&tcp=1"
+	} else if c.UDPAddr != "" {
+		url += "&udp=1"
+	}
+	if c.RemotePort != 0 && !c.TLSPassthrough && !c.Private {
+		url += "&port=" + strconv.Itoa(c.RemotePort)
+	}
+	if c.restrictsIPs() {
+		url += "&" + c.allowQuery()
+	}
 	return url
 }
 
+// restrictsIPs reports whether AllowedIPs leaves some visitors out, i.e.
+// whether it lacks a network covering all of IPv4 or all of IPv6.
+func (c Options) restrictsIPs() bool {
+	if len(c.AllowedIPs) == 0 {
+		return false
+	}
+	var all4, all6 bool
+	for _, ip := range c.AllowedIPs {
+		if _, network, err := net.ParseCIDR(ip); err == nil {
+			if ones, _ := network.Mask.Size(); ones == 0 {
+				all4 = all4 || network.IP.To4() != nil
+				all6 = all6 || network.IP.To4() == nil
+			}
+		}
+	}
+	return !all4 || !all6
+}
+
+// allowQuery encodes AllowedIPs as the allow parameters of /register.
+func (c Options) allowQuery() string {
+	return url.Values{"allow": c.AllowedIPs}.Encode()
+}
+
+// poolQuery encodes PoolKey and ResumeToken as the pool and resume
+// parameters of /register.
+func (c Options) poolQuery() string {
+	values := url.Values{}
+	if c.PoolKey != "" {
+		values.Set("pool", c.PoolKey)
+	}
+	if c.ResumeToken != "" {
+		values.Set("resume", c.ResumeToken)
+	}
+	return values.Encode()
+}
+
+// shareQuery encodes Share as the share parameters of /register.
+func (c Options) shareQuery() string {
+	return url.Values{"share": c.Share}.Encode()
+}
+
+// ConnectURL returns the URL connections to the private tunnel named Name
+// are opened at.
+func (c Options) ConnectURL() string {
+	return c.serverURL() + "/connect?name=" + c.Name
+}
+
 func (c Options) SchemeHTTP() string {
 	// Try to get protocol from server info
 	if serverInfo, err := c.GetServerInfo(); err == nil && serverInfo.Protocol != "" {
@@ -478,9 +612,17 @@ func (c Options) Valid() error {
 	if c.Name == "" {
 		errs = append(errs, fmt.Errorf("name is required"))
 	}
-	if c.Target == "" {
+	if c.Target == "" && len(c.Routes) == 0 {
 		errs = append(errs, fmt.Errorf("target is required"))
 	}
+	for _, route := range c.Routes {
+		if err := route.valid(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := c.validHostHeader(); err != nil {
+		errs = append(errs, err)
+	}
 	for _, ip := range c.AllowedIPs {
 		if _, _, err := net.ParseCIDR(ip); err != nil {
 			errs = append(errs, fmt.Errorf("invalid IP CIDR range specified: %s", ip))
@@ -0,0 +1,27 @@
+package client
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOptionsURLEscapesPoolKey(t *testing.T) {
+	options := Options{
+		Name:        "web",
+		ServerHost:  "localhost",
+		ServerPort:  "8080",
+		Insecure:    true,
+		PoolKey:     "a&b=c#d+e%f",
+		ResumeToken: "t+1",
+	}
+	u, err := url.Parse(options.URL())
+	require.NoError(t, err)
+	query := u.Query()
+	assert.Equal(t, "web", query.Get("name"))
+	assert.Equal(t, "a&b=c#d+e%f", query.Get("pool"))
+	assert.Equal(t, "t+1", query.Get("resume"))
+	assert.Empty(t, u.Fragment)
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/campbel/tiny-tunnel/core/shared"
+	"github.com/campbel/tiny-tunnel/core/stats"
+	"github.com/campbel/tiny-tunnel/internal/log"
+)
+
+// Run keeps the tunnel connected until ctx is cancelled, reconnecting up to
+// options.ReconnectAttempts times, along with the extra connections of a
+// pooled tunnel. It returns once every connection has given up.
+func Run(ctx context.Context, options Options, stateProvider stats.StateProvider, statsProvider stats.StatsProvider, l log.Logger) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		RunPool(ctx, options, stateProvider, statsProvider, l)
+	}()
+	maintain(ctx, options, stateProvider, statsProvider, l)
+	wg.Wait()
+}
+
+// RunPool keeps the extra connections of a pooled tunnel (all but the first
+// of options.Connections) registered until ctx is cancelled. Each one
+// reconnects on its own; requests fail over to the others meanwhile.
+func RunPool(ctx context.Context, options Options, stateProvider stats.StateProvider, statsProvider stats.StatsProvider, l log.Logger) {
+	// The first connection already announces the tunnel.
+	options.OutputWriter = io.Discard
+
+	var wg sync.WaitGroup
+	for i := 1; i < options.Connections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			maintain(ctx, options, poolMemberState{stateProvider}, statsProvider, l)
+		}()
+	}
+	wg.Wait()
+}
+
+// Listen serves an established connection until it closes. When the server
+// announces it is going away the connection is replaced, and the
+// replacement is kept connected as by Run.
+func Listen(ctx context.Context, tunnel *shared.Tunnel, options Options, stateProvider stats.StateProvider, statsProvider stats.StatsProvider, l log.Logger) {
+	if serve(ctx, tunnel, l) {
+		maintain(ctx, options, stateProvider, statsProvider, l)
+	}
+}
+
+// serve listens on tunnel until it closes, or until the server announces it
+// is going away, which it reports. The old connection then keeps serving
+// its requests in flight until the server closes it.
+func serve(ctx context.Context, tunnel *shared.Tunnel, l log.Logger) bool {
+	go tunnel.Listen(ctx)
+	select {
+	case <-tunnel.GoingAway():
+	case <-tunnel.Done():
+		select {
+		case <-tunnel.GoingAway():
+		default:
+			return false
+		}
+	}
+	l.Info("server is going away, reconnecting")
+	return true
+}
+
+// maintain connects one tunnel connection and reconnects it when it drops.
+func maintain(ctx context.Context, options Options, stateProvider stats.StateProvider, statsProvider stats.StatsProvider, l log.Logger) {
+	for i := 0; i < options.ReconnectAttempts; i++ {
+		if ctx.Err() != nil {
+			return
+		}
+		l.Info("connecting...", "server", options.ServerHost, "port", options.ServerPort, "insecure", options.Insecure)
+		// Reclaim the name should the server still be holding it.
+		options.ResumeToken = stateProvider.GetRegistration().ResumeToken
+		tunnel, err := NewTunnel(ctx, options, stateProvider, statsProvider, l)
+		if err != nil {
+			l.Error("error connecting to tunnel", "err", err)
+			select {
+			case <-time.After(3 * time.Second):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		l.Info("connected", "server", options.ServerHost, "port", options.ServerPort, "insecure", options.Insecure)
+		if serve(ctx, tunnel, l) {
+			// Replacing a connection the server sends away is not a
+			// reconnect attempt.
+			i--
+		}
+	}
+}
+
+// poolMemberState lets the extra connections of a pool record what the
+// server tells them without driving the connection status, which follows
+// the first connection.
+type poolMemberState struct {
+	stats.StateProvider
+}
+
+func (poolMemberState) SetStatus(stats.Status) {}
+
+func (poolMemberState) SetStatusMessage(string) {}
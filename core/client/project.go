@@ -0,0 +1,217 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ProjectFileName is the project file `tnl up` reads by default.
+const ProjectFileName = "tnl.yaml"
+
+// ProjectFile is a project's tnl.yaml: the tunnels it declares, by name.
+// It is meant to be committed, so ${VAR} references in its values are
+// expanded from the environment when it is loaded, keeping secrets such as
+// tokens out of it. $$ stands for a literal $.
+type ProjectFile struct {
+	Tunnels map[string]ProjectTunnel `yaml:"tunnels"`
+}
+
+// ProjectTunnel declares one tunnel of a project file. Unset fields take the
+// same defaults as the flags of `tnl start`.
+type ProjectTunnel struct {
+	// Name is the tunnel's public name; it defaults to the key it is
+	// declared under.
+	Name   string   `yaml:"name"`
+	Target string   `yaml:"target"`
+	Routes []string `yaml:"routes"`
+	// Server is the server to register with, as host, host:port or URL. The
+	// default server from the config is used when it is empty.
+	Server            string            `yaml:"server"`
+	Insecure          bool              `yaml:"insecure"`
+	Token             string            `yaml:"token"`
+	TargetHeaders     map[string]string `yaml:"target_headers"`
+	ServerHeaders     map[string]string `yaml:"server_headers"`
+	TargetInsecure    bool              `yaml:"target_insecure"`
+	TargetCA          string            `yaml:"target_ca"`
+	AllowedIPs        []string          `yaml:"allowed_ips"`
+	ReconnectAttempts *int              `yaml:"reconnect_attempts"`
+	Compress          bool              `yaml:"compress"`
+	Connections       int               `yaml:"connections"`
+	// RequestHeaders and ResponseHeaders are header rules, written as for
+	// ParseHeaderRule.
+	RequestHeaders  []string `yaml:"request_headers"`
+	ResponseHeaders []string `yaml:"response_headers"`
+	HostHeader      string   `yaml:"host_header"`
+	RewriteURLs     bool     `yaml:"rewrite_urls"`
+	RewriteBody     bool     `yaml:"rewrite_body"`
+}
+
+// LoadProjectFile reads and parses the project file at path.
+func LoadProjectFile(path string) (ProjectFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ProjectFile{}, fmt.Errorf("failed to read project file: %w", err)
+	}
+	return ParseProjectFile(data)
+}
+
+// ParseProjectFile parses the contents of a project file.
+func ParseProjectFile(data []byte) (ProjectFile, error) {
+	var project ProjectFile
+	if err := yaml.Unmarshal(data, &project); err != nil {
+		return project, fmt.Errorf("failed to parse project file: %w", err)
+	}
+	if len(project.Tunnels) == 0 {
+		return project, fmt.Errorf("project file declares no tunnels")
+	}
+	// Expanding after parsing keeps a value from the environment from
+	// changing the structure of the file.
+	for name, tunnel := range project.Tunnels {
+		project.Tunnels[name] = tunnel.expandEnv()
+	}
+	return project, nil
+}
+
+// expandEnv returns t with environment references expanded in its string
+// values.
+func (t ProjectTunnel) expandEnv() ProjectTunnel {
+	for _, s := range []*string{
+		&t.Name, &t.Target, &t.Server, &t.Token, &t.TargetCA, &t.HostHeader,
+	} {
+		*s = expandEnv(*s)
+	}
+	t.Routes = expandEnvSlice(t.Routes)
+	t.AllowedIPs = expandEnvSlice(t.AllowedIPs)
+	t.RequestHeaders = expandEnvSlice(t.RequestHeaders)
+	t.ResponseHeaders = expandEnvSlice(t.ResponseHeaders)
+	t.TargetHeaders = expandEnvMap(t.TargetHeaders)
+	t.ServerHeaders = expandEnvMap(t.ServerHeaders)
+	return t
+}
+
+// expandEnv replaces $VAR and ${VAR} in s with the variable's value, and $$
+// with $.
+func expandEnv(s string) string {
+	return os.Expand(s, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		return os.Getenv(name)
+	})
+}
+
+func expandEnvSlice(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	expanded := make([]string, len(values))
+	for i, v := range values {
+		expanded[i] = expandEnv(v)
+	}
+	return expanded
+}
+
+func expandEnvMap(values map[string]string) map[string]string {
+	if values == nil {
+		return nil
+	}
+	expanded := make(map[string]string, len(values))
+	for k, v := range values {
+		expanded[k] = expandEnv(v)
+	}
+	return expanded
+}
+
+// Options returns the options of the named tunnels, or of every tunnel when
+// no names are given, sorted by name.
+func (p ProjectFile) Options(names ...string) ([]Options, error) {
+	if len(names) == 0 {
+		for name := range p.Tunnels {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	names = slices.Compact(names)
+
+	var all []Options
+	for _, name := range names {
+		tunnel, ok := p.Tunnels[name]
+		if !ok {
+			return nil, fmt.Errorf("no tunnel named %q in project file", name)
+		}
+		options, err := tunnel.options(name)
+		if err != nil {
+			return nil, fmt.Errorf("tunnel %q: %w", name, err)
+		}
+		all = append(all, options)
+	}
+	return all, nil
+}
+
+func (t ProjectTunnel) options(key string) (Options, error) {
+	options := Options{
+		Name:              t.Name,
+		Target:            t.Target,
+		Insecure:          t.Insecure,
+		Token:             t.Token,
+		TargetHeaders:     projectHeaders(t.TargetHeaders),
+		ServerHeaders:     projectHeaders(t.ServerHeaders),
+		TargetInsecure:    t.TargetInsecure,
+		TargetCAFile:      t.TargetCA,
+		AllowedIPs:        t.AllowedIPs,
+		ReconnectAttempts: 5,
+		Compression:       t.Compress,
+		Connections:       t.Connections,
+		HostHeader:        t.HostHeader,
+		RewriteURLs:       t.RewriteURLs,
+		RewriteBody:       t.RewriteBody,
+	}
+	if options.Name == "" {
+		options.Name = key
+	}
+	if len(options.AllowedIPs) == 0 {
+		options.AllowedIPs = []string{"0.0.0.0/0", "::/0"}
+	}
+	if t.ReconnectAttempts != nil {
+		options.ReconnectAttempts = *t.ReconnectAttempts
+	}
+	if t.Server != "" {
+		u, err := parseServerURL(t.Server)
+		if err != nil {
+			return options, err
+		}
+		options.ServerHost = u.Hostname()
+		options.ServerPort = u.Port()
+		if u.Scheme == "http" {
+			options.Insecure = true
+		}
+	}
+	var err error
+	if options.RequestHeaders, err = ParseHeaderRules(t.RequestHeaders); err != nil {
+		return options, err
+	}
+	if options.ResponseHeaders, err = ParseHeaderRules(t.ResponseHeaders); err != nil {
+		return options, err
+	}
+	for _, r := range t.Routes {
+		route, err := ParseRoute(r)
+		if err != nil {
+			return options, err
+		}
+		options.Routes = append(options.Routes, route)
+	}
+	return options, options.Valid()
+}
+
+func projectHeaders(m map[string]string) http.Header {
+	headers := http.Header{}
+	for k, v := range m {
+		headers.Add(k, v)
+	}
+	return headers
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProjectFile(t *testing.T) {
+	t.Setenv("TNL_TEST_TOKEN", "secret")
+	project, err := ParseProjectFile([]byte(`
+tunnels:
+  web:
+    target: http://localhost:3000
+    routes:
+      - /api=http://localhost:8080,strip
+    target_headers:
+      X-Env: dev
+    server: localhost:8080
+    token: ${TNL_TEST_TOKEN}
+  docs:
+    name: team-docs
+    target: https://localhost:4000
+    server: https://tnl.example.com:8443
+    allowed_ips: [10.0.0.0/8]
+    reconnect_attempts: 0
+  broken:
+    routes: [api=http://localhost:8080]
+`))
+	require.NoError(t, err)
+
+	tunnels, err := project.Options("web", "docs", "web")
+	require.NoError(t, err)
+	require.Len(t, tunnels, 2)
+
+	docs, web := tunnels[0], tunnels[1]
+	assert.Equal(t, "team-docs", docs.Name)
+	assert.Equal(t, "tnl.example.com", docs.ServerHost)
+	assert.Equal(t, "8443", docs.ServerPort)
+	assert.False(t, docs.Insecure)
+	assert.Equal(t, []string{"10.0.0.0/8"}, docs.AllowedIPs)
+	assert.Equal(t, 0, docs.ReconnectAttempts)
+
+	assert.Equal(t, "web", web.Name)
+	assert.Equal(t, "http://localhost:3000", web.Target)
+	assert.Equal(t, []Route{{Prefix: "/api", Target: "http://localhost:8080", StripPrefix: true}}, web.Routes)
+	assert.Equal(t, http.Header{"X-Env": {"dev"}}, web.TargetHeaders)
+	assert.Equal(t, "localhost", web.ServerHost)
+	assert.Equal(t, "8080", web.ServerPort)
+	assert.True(t, web.Insecure)
+	assert.Equal(t, "secret", web.Token)
+	assert.Equal(t, 5, web.ReconnectAttempts)
+	assert.Equal(t, []string{"0.0.0.0/0", "::/0"}, web.AllowedIPs)
+
+	_, err = project.Options("missing")
+	assert.ErrorContains(t, err, `no tunnel named "missing"`)
+	_, err = project.Options()
+	assert.ErrorContains(t, err, `tunnel "broken"`)
+
+	_, err = ParseProjectFile([]byte("tunnels: {}\n"))
+	assert.Error(t, err)
+}
+
+func TestProjectFileExpandsValuesOnly(t *testing.T) {
+	// A value that looks like YAML stays a value.
+	t.Setenv("TNL_TEST_TOKEN", "secret\n    insecure: true")
+	t.Setenv("TNL_TEST_HOST", "localhost")
+	project, err := ParseProjectFile([]byte(`
+tunnels:
+  web:
+    target: http://${TNL_TEST_HOST}:3000
+    token: ${TNL_TEST_TOKEN}
+    routes:
+      - /api=http://${TNL_TEST_HOST}:8080
+    target_headers:
+      X-Host: $TNL_TEST_HOST
+`))
+	require.NoError(t, err)
+
+	tunnels, err := project.Options()
+	require.NoError(t, err)
+	require.Len(t, tunnels, 1)
+	web := tunnels[0]
+	assert.Equal(t, "http://localhost:3000", web.Target)
+	assert.Equal(t, "secret\n    insecure: true", web.Token)
+	assert.False(t, web.Insecure)
+	assert.Equal(t, []Route{{Prefix: "/api", Target: "http://localhost:8080"}}, web.Routes)
+	assert.Equal(t, http.Header{"X-Host": {"localhost"}}, web.TargetHeaders)
+}
+
+func TestProjectFileEscapesDollar(t *testing.T) {
+	t.Setenv("TNL_TEST_TOKEN", "secret")
+	project, err := ParseProjectFile([]byte(`
+tunnels:
+  web:
+    target: http://localhost:3000
+    token: pa$$word-$${TNL_TEST_TOKEN}-${TNL_TEST_TOKEN}
+    server_headers:
+      X-Price: $$5
+`))
+	require.NoError(t, err)
+
+	tunnels, err := project.Options()
+	require.NoError(t, err)
+	require.Len(t, tunnels, 1)
+	assert.Equal(t, "pa$word-${TNL_TEST_TOKEN}-secret", tunnels[0].Token)
+	assert.Equal(t, http.Header{"X-Price": {"$5"}}, tunnels[0].ServerHeaders)
+}
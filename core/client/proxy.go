@@ -0,0 +1,189 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/campbel/tiny-tunnel/internal/log"
+)
+
+// ServeProxy runs a SOCKS5 and HTTP CONNECT proxy on ln whose connections
+// are dialed by the egress proxy tunnel named options.Name, from its
+// client's machine, until ctx is done.
+//
+// Success is reported to the proxy client once the tunnel client has
+// reached the destination, and failure with the reply that says why. With
+// servers or tunnel clients that do not confirm connections, success is
+// reported once the server takes the connection, and an unreachable
+// destination shows as the connection closing.
+func ServeProxy(ctx context.Context, options Options, ln net.Listener, l log.Logger) error {
+	return serveLocal(ctx, ln, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		first, err := r.Peek(1)
+		if err != nil {
+			return
+		}
+		var handshake proxyHandshake = connectHandshake
+		if first[0] == socksVersion {
+			handshake = socksHandshake
+		}
+		target, reply, err := handshake(r, conn)
+		if err != nil {
+			l.Debug("proxy handshake failed", "local", conn.RemoteAddr().String(), "error", err.Error())
+			return
+		}
+
+		remote, err := DialPrivate(ctx, options, target)
+		if err != nil {
+			reply(err)
+			l.Error("failed to connect to tunnel", "name", options.Name, "target", target, "error", err.Error())
+			return
+		}
+		defer remote.Close()
+		if err := reply(nil); err != nil {
+			return
+		}
+		l.Info("proxy connection opened", "name", options.Name, "target", target)
+		pipe(r, conn, remote)
+		l.Info("proxy connection closed", "name", options.Name, "target", target)
+	})
+}
+
+// A proxy handshake reads the destination the proxy client asks for and
+// returns it with a func reporting to the proxy client whether the tunnel
+// could be dialed.
+type proxyHandshake func(r *bufio.Reader, w io.Writer) (target string, reply func(error) error, err error)
+
+const socksVersion = 5
+
+// SOCKS5 reply codes (RFC 1928).
+const (
+	socksSucceeded          = 0
+	socksGeneralFailure     = 1
+	socksNotAllowed         = 2
+	socksHostUnreachable    = 4
+	socksConnectionRefused  = 5
+	socksCommandUnsupported = 7
+	socksAddressUnsupported = 8
+)
+
+// refusedStatus returns the status the server refused a connection with,
+// or zero when it was not reached.
+func refusedStatus(err error) int {
+	var refused *refusedError
+	if errors.As(err, &refused) {
+		return refused.statusCode
+	}
+	return 0
+}
+
+// socksHandshake speaks SOCKS5 without authentication; the user is
+// authenticated with the server already. Only CONNECT is supported.
+func socksHandshake(r *bufio.Reader, w io.Writer) (string, func(error) error, error) {
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(r, greeting); err != nil {
+		return "", nil, err
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", nil, err
+	}
+	if !bytes.Contains(methods, []byte{0}) {
+		w.Write([]byte{socksVersion, 0xff})
+		return "", nil, errors.New("socks: client requires authentication")
+	}
+	if _, err := w.Write([]byte{socksVersion, 0}); err != nil {
+		return "", nil, err
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(r, request); err != nil {
+		return "", nil, err
+	}
+	var host string
+	switch request[3] {
+	case 1, 4:
+		ip := make(net.IP, 4)
+		if request[3] == 4 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", nil, err
+		}
+		host = ip.String()
+	case 3:
+		n, err := r.ReadByte()
+		if err != nil {
+			return "", nil, err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", nil, err
+		}
+		host = string(name)
+	default:
+		socksReply(w, socksAddressUnsupported)
+		return "", nil, fmt.Errorf("socks: unsupported address type %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", nil, err
+	}
+	if request[1] != 1 {
+		socksReply(w, socksCommandUnsupported)
+		return "", nil, fmt.Errorf("socks: unsupported command %d", request[1])
+	}
+
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	return target, func(err error) error {
+		if err == nil {
+			return socksReply(w, socksSucceeded)
+		}
+		switch refusedStatus(err) {
+		case http.StatusForbidden:
+			return socksReply(w, socksNotAllowed)
+		case http.StatusServiceUnavailable:
+			return socksReply(w, socksConnectionRefused)
+		case http.StatusBadGateway, http.StatusGatewayTimeout:
+			return socksReply(w, socksHostUnreachable)
+		}
+		return socksReply(w, socksGeneralFailure)
+	}, nil
+}
+
+// socksReply answers a SOCKS5 request. The bound address is left unset.
+func socksReply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socksVersion, code, 0, 1, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// connectHandshake reads an HTTP CONNECT request.
+func connectHandshake(r *bufio.Reader, w io.Writer) (string, func(error) error, error) {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return "", nil, err
+	}
+	if req.Method != http.MethodConnect {
+		io.WriteString(w, "HTTP/1.1 405 Method Not Allowed\r\nAllow: CONNECT\r\nContent-Length: 0\r\n\r\n")
+		return "", nil, fmt.Errorf("unsupported proxy method %s", req.Method)
+	}
+	return req.Host, func(err error) error {
+		switch {
+		case err == nil:
+			_, err = io.WriteString(w, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		case refusedStatus(err) == http.StatusForbidden:
+			_, err = io.WriteString(w, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+		default:
+			_, err = io.WriteString(w, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		}
+		return err
+	}, nil
+}
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/campbel/tiny-tunnel/core/shared"
+)
+
+var errTunnelClosed = errors.New("tunnel closed")
+
+// requestBody is the body of a streamed request (HttpRequestStart/Chunk/End).
+// Chunks arrive on the tunnel read loop and are queued in an inbox, which
+// writes them into the pipe the target request reads from. With flow control
+// the server stops sending once the target falls a window behind; without it
+// a slow target stalls the tunnel once the inbox is full.
+type requestBody struct {
+	pr    *io.PipeReader
+	pw    *io.PipeWriter
+	inbox *shared.Inbox
+	stop  func() bool
+	// trailer is the target request's Trailer, set before the request is
+	// sent. The trailers received with the end of the body are copied into
+	// it as the body hits EOF, which is when net/http reads it.
+	trailer  http.Header
+	trailers http.Header
+}
+
+// newRequestBody returns a body for the request id that is fed until finish
+// is called or the tunnel closes.
+func newRequestBody(tunnel *shared.Tunnel, id string) *requestBody {
+	pr, pw := io.Pipe()
+	return &requestBody{
+		pr:    pr,
+		pw:    pw,
+		inbox: tunnel.NewInbox(id),
+		stop: context.AfterFunc(tunnel.Context(), func() {
+			pw.CloseWithError(errTunnelClosed)
+		}),
+	}
+}
+
+// write queues a chunk of the body. It is called from the tunnel read loop.
+func (b *requestBody) write(data []byte) {
+	b.inbox.Push(len(data), func() {
+		// Once the target stops reading the write fails; the chunk is
+		// dropped but still credited so the server is never left waiting.
+		b.pw.Write(data)
+	})
+}
+
+// finish ends the body, with an error if the visitor's upload failed, or
+// else with the visitor's trailers.
+func (b *requestBody) finish(errMsg string, trailers http.Header) {
+	var err error
+	if errMsg != "" {
+		err = errors.New(errMsg)
+	}
+	b.inbox.Push(0, func() {
+		b.trailers = trailers
+		// A nil error closes the pipe with io.EOF.
+		b.pw.CloseWithError(err)
+	})
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.pr.Read(p)
+	if err == io.EOF && b.trailer != nil {
+		for k, v := range b.trailers {
+			b.trailer[k] = v
+		}
+	}
+	return n, err
+}
+
+// Close stops the body from the reading side; further chunks are dropped.
+func (b *requestBody) Close() error {
+	b.stop()
+	b.inbox.Close()
+	return b.pr.Close()
+}
+
+// declaredTrailer returns the trailers announced in the Trailer header of
+// headers, with their values to be filled in, or nil when there are none.
+func declaredTrailer(headers http.Header) http.Header {
+	var trailer http.Header
+	for _, value := range headers.Values("Trailer") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				if trailer == nil {
+					trailer = http.Header{}
+				}
+				trailer[http.CanonicalHeaderKey(name)] = nil
+			}
+		}
+	}
+	return trailer
+}
+
+// contentLength returns the Content-Length announced in headers, or -1 when
+// the length is unknown.
+func contentLength(headers http.Header) int64 {
+	n, err := strconv.ParseInt(headers.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
@@ -0,0 +1,180 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Host header modes. Any other HostHeader is sent as the Host itself.
+const (
+	// HostHeaderRewrite sends the target's own host, as if it were
+	// reached directly.
+	HostHeaderRewrite = "rewrite"
+	// HostHeaderPreserve sends the host the visitor reached the tunnel at.
+	HostHeaderPreserve = "preserve"
+)
+
+// targetHost returns the Host to send the target for a visitor who asked
+// for visitorHost, or "" for the target's own.
+func (c Options) targetHost(visitorHost string) string {
+	switch c.HostHeader {
+	case "", HostHeaderRewrite:
+		return ""
+	case HostHeaderPreserve:
+		return visitorHost
+	}
+	return c.HostHeader
+}
+
+// validHostHeader checks that HostHeader is a mode or a plausible host.
+func (c Options) validHostHeader() error {
+	if c.HostHeader == "" || c.HostHeader == HostHeaderRewrite || c.HostHeader == HostHeaderPreserve {
+		return nil
+	}
+	if strings.ContainsAny(c.HostHeader, " /\t\r\n") {
+		return fmt.Errorf("invalid host header %q: must be rewrite, preserve or a host", c.HostHeader)
+	}
+	return nil
+}
+
+// urlRewriter maps the absolute URLs a target hands out to the ones the
+// visitor reaches it at, so that links and redirects keep going through the
+// tunnel.
+type urlRewriter struct {
+	target *url.URL
+	public *url.URL
+	// prefix is the path prefix the route stripped, put back on the
+	// target's paths.
+	prefix string
+	// headers and body say what to rewrite.
+	headers, body bool
+}
+
+// newURLRewriter returns a rewriter from route's target to scheme://host,
+// or nil when URLs are not to be rewritten or can't be.
+func (c Options) newURLRewriter(route Route, scheme, host string) *urlRewriter {
+	if !c.RewriteURLs && !c.RewriteBody || host == "" {
+		return nil
+	}
+	target, err := url.Parse(route.Target)
+	if err != nil || target.Host == "" {
+		return nil
+	}
+	if scheme == "" {
+		scheme = "https"
+	}
+	return &urlRewriter{
+		target:  &url.URL{Scheme: target.Scheme, Host: target.Host},
+		public:  &url.URL{Scheme: scheme, Host: host},
+		prefix:  route.stripped(),
+		headers: c.RewriteURLs,
+		body:    c.RewriteBody,
+	}
+}
+
+// rewriteURL rewrites a URL reference: absolute URLs to the target, and
+// absolute paths when the route strips a prefix. Others are left alone.
+func (w *urlRewriter) rewriteURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	switch {
+	case u.Host == "" && u.Scheme == "" && strings.HasPrefix(u.Path, "/"):
+		// An absolute path on the target's own host.
+		if w.prefix == "" {
+			return s
+		}
+	case strings.EqualFold(u.Host, w.target.Host) && (u.Scheme == "" || strings.EqualFold(u.Scheme, w.target.Scheme)):
+		u.Scheme, u.Host = w.public.Scheme, w.public.Host
+	default:
+		return s
+	}
+	if w.prefix != "" && strings.HasPrefix(u.Path, "/") {
+		u.Path = w.prefix + u.Path
+		if u.RawPath != "" {
+			u.RawPath = w.prefix + u.RawPath
+		}
+	}
+	return u.String()
+}
+
+// rewriteCookie moves a Set-Cookie scoped to the target's host to the
+// public one.
+func (w *urlRewriter) rewriteCookie(s string) string {
+	attrs := strings.Split(s, ";")
+	for i, attr := range attrs {
+		name, value, ok := strings.Cut(strings.TrimSpace(attr), "=")
+		if !ok {
+			continue
+		}
+		switch {
+		case strings.EqualFold(name, "Domain") && strings.EqualFold(strings.TrimPrefix(value, "."), w.target.Hostname()):
+			attrs[i] = " Domain=" + w.public.Hostname()
+		case strings.EqualFold(name, "Path") && w.prefix != "" && strings.HasPrefix(value, "/"):
+			attrs[i] = " Path=" + w.prefix + value
+		}
+	}
+	return strings.Join(attrs, ";")
+}
+
+// rewriteHeaders rewrites the URLs in a response's Location and
+// Content-Location, and the scope of its cookies.
+func (w *urlRewriter) rewriteHeaders(headers http.Header) {
+	if w == nil || !w.headers {
+		return
+	}
+	for _, name := range []string{"Location", "Content-Location"} {
+		if v := headers.Get(name); v != "" {
+			headers.Set(name, w.rewriteURL(v))
+		}
+	}
+	for i, cookie := range headers["Set-Cookie"] {
+		headers["Set-Cookie"][i] = w.rewriteCookie(cookie)
+	}
+}
+
+// rewriteBody replaces the target's origin with the public one in HTML and
+// JSON bodies, plain or JSON-escaped, and fixes Content-Length to match.
+// Compressed bodies are left alone.
+func (w *urlRewriter) rewriteBody(headers http.Header, body []byte) []byte {
+	if w == nil || !w.body || rewritableBody(headers) == "" {
+		return body
+	}
+	target, public := w.target.String(), w.public.String()
+	rewritten := bytes.ReplaceAll(body, []byte(target), []byte(public))
+	escape := strings.NewReplacer("/", `\/`)
+	rewritten = bytes.ReplaceAll(rewritten, []byte(escape.Replace(target)), []byte(escape.Replace(public)))
+	if headers.Get("Content-Length") != "" {
+		headers.Set("Content-Length", strconv.Itoa(len(rewritten)))
+	}
+	return rewritten
+}
+
+// buffersBody reports whether a response that would be streamed is to be
+// buffered instead, to rewrite its body. Only HTML is: streamed JSON may
+// well be an endless watch.
+func (w *urlRewriter) buffersBody(headers http.Header) bool {
+	return w != nil && w.body && rewritableBody(headers) == "text/html"
+}
+
+// rewritableBody returns the media type of an uncompressed HTML or JSON
+// body, or "" for any other.
+func rewritableBody(headers http.Header) string {
+	if encoding := headers.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return ""
+	}
+	mediaType, params, err := mime.ParseMediaType(headers.Get("Content-Type"))
+	if err != nil || params["stream"] != "" {
+		return ""
+	}
+	if mediaType == "text/html" || mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+		return mediaType
+	}
+	return ""
+}
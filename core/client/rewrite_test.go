@@ -0,0 +1,60 @@
+package client
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTargetHost(t *testing.T) {
+	assert.Equal(t, "", Options{}.targetHost("web.example.com"))
+	assert.Equal(t, "", Options{HostHeader: HostHeaderRewrite}.targetHost("web.example.com"))
+	assert.Equal(t, "web.example.com", Options{HostHeader: HostHeaderPreserve}.targetHost("web.example.com"))
+	assert.Equal(t, "app.local", Options{HostHeader: "app.local"}.targetHost("web.example.com"))
+	assert.Error(t, Options{HostHeader: "http://app.local"}.validHostHeader())
+}
+
+func TestURLRewriter(t *testing.T) {
+	options := Options{RewriteURLs: true, RewriteBody: true}
+	assert.Nil(t, Options{}.newURLRewriter(Route{Target: "http://localhost:3000"}, "https", "web.example.com"))
+
+	w := options.newURLRewriter(Route{Target: "http://localhost:3000"}, "https", "web.example.com")
+	require.NotNil(t, w)
+	headers := http.Header{
+		"Location":         {"http://localhost:3000/login?next=%2F"},
+		"Content-Location": {"/docs/1"},
+		"Set-Cookie":       {"sid=1; Domain=localhost; Path=/; HttpOnly", "theme=dark; Domain=other.test"},
+	}
+	w.rewriteHeaders(headers)
+	assert.Equal(t, http.Header{
+		"Location":         {"https://web.example.com/login?next=%2F"},
+		"Content-Location": {"/docs/1"},
+		"Set-Cookie":       {"sid=1; Domain=web.example.com; Path=/; HttpOnly", "theme=dark; Domain=other.test"},
+	}, headers)
+	assert.Equal(t, "https://elsewhere.test/", w.rewriteURL("https://elsewhere.test/"))
+	assert.Equal(t, "https://localhost:3000/", w.rewriteURL("https://localhost:3000/"))
+
+	// Paths get back the prefix the route stripped.
+	w = options.newURLRewriter(Route{Prefix: "/api/", Target: "http://localhost:8080", StripPrefix: true}, "https", "web.example.com")
+	assert.Equal(t, "https://web.example.com/api/users", w.rewriteURL("http://localhost:8080/users"))
+	assert.Equal(t, "/api/login", w.rewriteURL("/login"))
+	assert.Equal(t, "sid=1; Path=/api/", w.rewriteCookie("sid=1; Path=/"))
+
+	headers = http.Header{"Content-Type": {"application/json"}, "Content-Length": {"0"}}
+	body := w.rewriteBody(headers, []byte(`{"self":"http://localhost:8080/a","escaped":"http:\/\/localhost:8080\/b"}`))
+	assert.Equal(t, `{"self":"https://web.example.com/a","escaped":"https:\/\/web.example.com\/b"}`, string(body))
+	assert.Equal(t, strconv.Itoa(len(body)), headers.Get("Content-Length"))
+
+	for _, headers := range []http.Header{
+		{"Content-Type": {"text/plain"}},
+		{"Content-Type": {"text/html"}, "Content-Encoding": {"gzip"}},
+		{"Content-Type": {"application/json;stream=watch"}},
+	} {
+		assert.Equal(t, "http://localhost:8080", string(w.rewriteBody(headers, []byte("http://localhost:8080"))))
+	}
+	assert.True(t, w.buffersBody(http.Header{"Content-Type": {"text/html; charset=utf-8"}}))
+	assert.False(t, w.buffersBody(http.Header{"Content-Type": {"application/json"}}))
+}
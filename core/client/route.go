@@ -0,0 +1,99 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/campbel/tiny-tunnel/core/protocol"
+)
+
+// Route sends the requests whose path starts with Prefix to Target.
+type Route struct {
+	Prefix string
+	Target string
+	// StripPrefix removes Prefix from the path before the request is sent
+	// to Target.
+	StripPrefix bool
+}
+
+// ParseRoute parses a route given as "prefix=target", optionally followed
+// by ",strip" to strip the prefix (e.g. "/api=http://localhost:8080,strip").
+func ParseRoute(s string) (Route, error) {
+	prefix, target, ok := strings.Cut(s, "=")
+	if !ok {
+		return Route{}, fmt.Errorf("invalid route %q: expected prefix=target", s)
+	}
+	route := Route{Prefix: prefix}
+	route.Target, route.StripPrefix = strings.CutSuffix(target, ",strip")
+	return route, route.valid()
+}
+
+func (r Route) valid() error {
+	if !strings.HasPrefix(r.Prefix, "/") {
+		return fmt.Errorf("invalid route prefix %q: must start with /", r.Prefix)
+	}
+	u, err := url.Parse(r.Target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid route target %q: must be an http or https URL", r.Target)
+	}
+	return nil
+}
+
+// matches reports whether path, which may have a query, falls under the
+// route's prefix. Prefixes match whole path segments: /api matches /api and
+// /api/users but not /apis.
+func (r Route) matches(path string) bool {
+	rest, ok := strings.CutPrefix(path, r.Prefix)
+	if !ok {
+		return false
+	}
+	return rest == "" || strings.HasSuffix(r.Prefix, "/") || rest[0] == '/' || rest[0] == '?'
+}
+
+// stripped returns the prefix the route strips from paths, to be put back
+// on the target's own paths.
+func (r Route) stripped() string {
+	if !r.StripPrefix {
+		return ""
+	}
+	return strings.TrimSuffix(r.Prefix, "/")
+}
+
+// rewrite returns path as sent to the route's target.
+func (r Route) rewrite(path string) string {
+	if !r.StripPrefix {
+		return path
+	}
+	path = strings.TrimPrefix(path, r.stripped())
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// route returns the route a request for path is sent along, and the path
+// it is sent to: the longest of Routes matching it, or else one to Target.
+// ok is false when there is neither.
+func (c Options) route(path string) (route Route, targetPath string, ok bool) {
+	var best *Route
+	for i := range c.Routes {
+		if r := &c.Routes[i]; r.matches(path) && (best == nil || len(r.Prefix) > len(best.Prefix)) {
+			best = r
+		}
+	}
+	if best != nil {
+		return *best, best.rewrite(path), true
+	}
+	return Route{Prefix: "/", Target: c.Target}, path, c.Target != ""
+}
+
+// noRouteResponse answers a request for path that no route matches.
+func noRouteResponse(path string) *protocol.HttpResponsePayload {
+	return &protocol.HttpResponsePayload{Response: protocol.HttpResponse{
+		Status:  http.StatusNotFound,
+		Headers: http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:    []byte(fmt.Sprintf("no route for %s\n", path)),
+	}}
+}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRoute(t *testing.T) {
+	route, err := ParseRoute("/api=http://localhost:8080,strip")
+	require.NoError(t, err)
+	assert.Equal(t, Route{Prefix: "/api", Target: "http://localhost:8080", StripPrefix: true}, route)
+
+	route, err = ParseRoute("/=https://localhost:3000")
+	require.NoError(t, err)
+	assert.Equal(t, Route{Prefix: "/", Target: "https://localhost:3000"}, route)
+
+	for _, s := range []string{"/api", "api=http://localhost:8080", "/api=localhost:8080", "/api=ftp://localhost", "/api=http://"} {
+		_, err := ParseRoute(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestOptionsRoute(t *testing.T) {
+	options := Options{
+		Name:   "test",
+		Target: "http://localhost:3000",
+		Routes: []Route{
+			{Prefix: "/api", Target: "http://localhost:8080"},
+			{Prefix: "/api/v2/", Target: "http://localhost:8082", StripPrefix: true},
+			{Prefix: "/static", Target: "http://localhost:9000", StripPrefix: true},
+		},
+	}
+	tests := []struct {
+		path, target, targetPath string
+	}{
+		{"/", "http://localhost:3000", "/"},
+		{"/apis", "http://localhost:3000", "/apis"},
+		{"/api", "http://localhost:8080", "/api"},
+		{"/api?q=1", "http://localhost:8080", "/api?q=1"},
+		{"/api/users", "http://localhost:8080", "/api/users"},
+		{"/api/v2/users", "http://localhost:8082", "/users"},
+		{"/static", "http://localhost:9000", "/"},
+		{"/static?v=2", "http://localhost:9000", "/?v=2"},
+		{"/static/app.js", "http://localhost:9000", "/app.js"},
+	}
+	for _, tt := range tests {
+		route, targetPath, ok := options.route(tt.path)
+		assert.True(t, ok, tt.path)
+		assert.Equal(t, tt.target, route.Target, tt.path)
+		assert.Equal(t, tt.targetPath, targetPath, tt.path)
+	}
+
+	options.Target = ""
+	_, _, ok := options.route("/other")
+	assert.False(t, ok)
+	assert.NoError(t, options.Valid())
+}
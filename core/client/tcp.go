@@ -0,0 +1,160 @@
+package client
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/campbel/tiny-tunnel/core/protocol"
+	"github.com/campbel/tiny-tunnel/core/shared"
+	"github.com/campbel/tiny-tunnel/internal/log"
+	"github.com/campbel/tiny-tunnel/internal/safe"
+)
+
+// tcpSession is a connection to options.TCPAddr relayed through the tunnel,
+// for a TCP tunnel or a TLS passthrough one alike, or an upgraded HTTP
+// connection to the target.
+// Data from the server is written to conn from the inbox, which holds it
+// until the dial completes.
+type tcpSession struct {
+	conn   io.ReadWriteCloser
+	dialed chan struct{}
+	inbox  *shared.Inbox
+}
+
+// connected waits for the dial and reports whether it succeeded.
+func (s *tcpSession) connected() bool {
+	<-s.dialed
+	return s.conn != nil
+}
+
+// registerTCPHandlers relays the connections the server accepts on the
+// tunnel's public port to options.TCPAddr, or for an egress proxy tunnel to
+// the destination of each connection that egress allows.
+func registerTCPHandlers(tunnel *shared.Tunnel, options Options, egress egressPolicy, l log.Logger) *safe.Map[string, *tcpSession] {
+	sessions := safe.NewMap[string, *tcpSession]()
+
+	tunnel.RegisterTcpOpenHandler(func(tunnel *shared.Tunnel, id string, payload protocol.TcpOpenPayload) {
+		// Register the session before returning so the data that follows on
+		// the read loop finds it.
+		session := &tcpSession{dialed: make(chan struct{}), inbox: tunnel.NewInbox(payload.ConnID)}
+		if !sessions.SetNX(payload.ConnID, session) {
+			session.inbox.Close()
+			return
+		}
+		go relayTCP(tunnel, payload, session, sessions, options, egress, l)
+	})
+
+	tunnel.RegisterTcpDataHandler(func(tunnel *shared.Tunnel, id string, payload protocol.TcpDataPayload) {
+		session, ok := sessions.Get(payload.ConnID)
+		if !ok {
+			return
+		}
+		session.inbox.Push(len(payload.Data), func() {
+			if !session.connected() {
+				return
+			}
+			if _, err := session.conn.Write(payload.Data); err != nil {
+				l.Debug("failed to write tcp data", "conn_id", payload.ConnID, "error", err.Error())
+			}
+		})
+	})
+
+	tunnel.RegisterTcpCloseHandler(func(tunnel *shared.Tunnel, id string, payload protocol.TcpClosePayload) {
+		session, ok := sessions.Get(payload.ConnID)
+		if !ok {
+			return
+		}
+		sessions.Delete(payload.ConnID)
+		tunnel.ReleaseWindow(payload.ConnID)
+		// Close after the data still queued ahead of it.
+		session.inbox.Push(0, func() {
+			if session.connected() {
+				session.conn.Close()
+			}
+			session.inbox.Close()
+		})
+	})
+
+	return sessions
+}
+
+// relayTCP dials options.TCPAddr, or the connection's own target on an
+// egress proxy tunnel, for a connection accepted by the server and relays
+// what the target sends until either side closes.
+func relayTCP(tunnel *shared.Tunnel, payload protocol.TcpOpenPayload, session *tcpSession, sessions *safe.Map[string, *tcpSession], options Options, egress egressPolicy, l log.Logger) {
+	connID := payload.ConnID
+	defer func() {
+		sessions.Delete(connID)
+		tunnel.ReleaseWindow(connID)
+		session.inbox.Close()
+	}()
+
+	addr, dialer := options.TCPAddr, &net.Dialer{Timeout: 10 * time.Second}
+	var err error
+	switch {
+	case payload.Target == "":
+	case options.EgressProxy:
+		addr = payload.Target
+		dialer, err = egress.dialer(addr)
+	default:
+		// Only egress proxy tunnels dial where the server asks.
+		addr, err = payload.Target, errEgressDenied
+	}
+	var conn net.Conn
+	if err == nil {
+		conn, err = dialer.DialContext(tunnel.Context(), "tcp", addr)
+	}
+	if err != nil {
+		close(session.dialed)
+		l.Info("tcp connection failed", "addr", addr, "remote", payload.RemoteAddr, "error", err.Error())
+		if err := tunnel.Send(protocol.MessageKindTcpClose, &protocol.TcpClosePayload{ConnID: connID, Error: targetError(tunnel, err)}); err != nil {
+			l.Error("failed to send tcp close", "error", err.Error())
+		}
+		return
+	}
+	session.conn = conn
+	close(session.dialed)
+	defer conn.Close()
+	l.Info("tcp connection opened", "addr", addr, "remote", payload.RemoteAddr)
+	if tunnel.Capabilities().Has(protocol.FeatureTcpOpened) {
+		if err := tunnel.Send(protocol.MessageKindTcpOpened, &protocol.TcpOpenedPayload{ConnID: connID}); err != nil {
+			l.Error("failed to send tcp opened", "error", err.Error())
+			return
+		}
+	}
+
+	pumpTCP(tunnel, connID, conn, sessions, l)
+	l.Info("tcp connection closed", "addr", addr, "remote", payload.RemoteAddr)
+}
+
+// pumpTCP relays what the target sends on conn to the server until either
+// side closes the connection.
+func pumpTCP(tunnel *shared.Tunnel, connID string, conn io.Reader, sessions *safe.Map[string, *tcpSession], l log.Logger) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			// Stop reading from the target while the server's window is
+			// exhausted; it fails once the server closes the connection.
+			if err := tunnel.AcquireWindow(tunnel.Context(), connID, n); err != nil {
+				return
+			}
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			if err := tunnel.Send(protocol.MessageKindTcpData, &protocol.TcpDataPayload{ConnID: connID, Data: data}); err != nil {
+				l.Error("failed to send tcp data", "error", err.Error())
+				return
+			}
+		}
+		if err != nil {
+			// The server is only told when the target hung up first.
+			if _, open := sessions.Get(connID); open && !tunnel.IsClosed() {
+				if err := tunnel.Send(protocol.MessageKindTcpClose, &protocol.TcpClosePayload{ConnID: connID}); err != nil {
+					l.Error("failed to send tcp close", "error", err.Error())
+				}
+			}
+			return
+		}
+	}
+}
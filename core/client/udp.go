@@ -0,0 +1,100 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/campbel/tiny-tunnel/core/protocol"
+	"github.com/campbel/tiny-tunnel/core/shared"
+	"github.com/campbel/tiny-tunnel/internal/log"
+	"github.com/campbel/tiny-tunnel/internal/safe"
+)
+
+// udpIdleTimeout lets go of sessions the server never closed, e.g. because
+// the tunnel dropped. It outlasts the server's own idle timeout.
+const udpIdleTimeout = 2 * time.Minute
+
+// udpSession is a socket connected to options.UDPAddr on behalf of one
+// visitor address of a UDP tunnel.
+type udpSession struct {
+	conn net.Conn
+	// seen is when the last datagram went either way, in Unix nanoseconds.
+	seen atomic.Int64
+}
+
+func (s *udpSession) touch() {
+	s.seen.Store(time.Now().UnixNano())
+}
+
+// registerUDPHandlers relays the datagrams the server receives on the
+// tunnel's public port to options.UDPAddr.
+func registerUDPHandlers(tunnel *shared.Tunnel, options Options, l log.Logger) {
+	sessions := safe.NewMap[string, *udpSession]()
+
+	tunnel.RegisterUdpDatagramHandler(func(tunnel *shared.Tunnel, id string, payload protocol.UdpDatagramPayload) {
+		session, ok := sessions.Get(payload.SessionID)
+		if !ok {
+			// Dialing UDP only resolves the address, so it is done on the
+			// read loop to keep the first datagrams in order.
+			conn, err := net.Dial("udp", options.UDPAddr)
+			if err != nil {
+				l.Info("udp session failed", "addr", options.UDPAddr, "remote", payload.RemoteAddr, "error", err.Error())
+				return
+			}
+			session = &udpSession{conn: conn}
+			session.touch()
+			sessions.SetNX(payload.SessionID, session)
+			go relayUDP(tunnel, payload, session, sessions, options, l)
+		}
+		session.touch()
+		if _, err := session.conn.Write(payload.Data); err != nil {
+			l.Debug("failed to write udp datagram", "session_id", payload.SessionID, "error", err.Error())
+		}
+	})
+
+	tunnel.RegisterUdpCloseHandler(func(tunnel *shared.Tunnel, id string, payload protocol.UdpClosePayload) {
+		session, ok := sessions.Get(payload.SessionID)
+		if !ok {
+			return
+		}
+		sessions.Delete(payload.SessionID)
+		session.conn.Close()
+	})
+}
+
+// relayUDP relays what the target sends back for a session until the
+// session is closed or goes idle.
+func relayUDP(tunnel *shared.Tunnel, payload protocol.UdpDatagramPayload, session *udpSession, sessions *safe.Map[string, *udpSession], options Options, l log.Logger) {
+	sessionID := payload.SessionID
+	defer func() {
+		sessions.DeleteIf(sessionID, func(s *udpSession) bool { return s == session })
+		session.conn.Close()
+	}()
+	l.Info("udp session opened", "addr", options.UDPAddr, "remote", payload.RemoteAddr)
+
+	buf := make([]byte, 64*1024)
+	for {
+		session.conn.SetReadDeadline(time.Unix(0, session.seen.Load()).Add(udpIdleTimeout))
+		n, err := session.conn.Read(buf)
+		if n > 0 {
+			session.touch()
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			if err := tunnel.Send(protocol.MessageKindUdpDatagram, &protocol.UdpDatagramPayload{SessionID: sessionID, Data: data}); err != nil {
+				l.Error("failed to send udp datagram", "error", err.Error())
+				return
+			}
+		}
+		if err != nil {
+			// Datagrams the visitor sent meanwhile moved the deadline on.
+			if errors.Is(err, os.ErrDeadlineExceeded) && time.Since(time.Unix(0, session.seen.Load())) < udpIdleTimeout {
+				continue
+			}
+			l.Info("udp session closed", "addr", options.UDPAddr, "remote", payload.RemoteAddr)
+			return
+		}
+	}
+}
@@ -221,6 +221,14 @@ func (t *TUI) View() string {
 		statusElements = append(statusElements, highlightStyle.Render(url))
 	}
 
+	registration := t.state.GetRegistration()
+	if registration.Identity != "" {
+		statusElements = append(statusElements, infoStyle.Render(registration.Identity))
+	}
+	if registration.ServerVersion != "" {
+		statusElements = append(statusElements, infoStyle.Render("server "+registration.ServerVersion))
+	}
+
 	// Calculate dimensions
 	titleWidth := 60 // Approximate width of the ASCII art title
 	statusWidth := t.width - titleWidth - 4
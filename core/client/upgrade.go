@@ -0,0 +1,115 @@
+package client
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/campbel/tiny-tunnel/core/protocol"
+	"github.com/campbel/tiny-tunnel/core/shared"
+	"github.com/campbel/tiny-tunnel/core/stats"
+	"github.com/campbel/tiny-tunnel/internal/log"
+	"github.com/campbel/tiny-tunnel/internal/safe"
+)
+
+// handleUpgradeRequest sends an upgrade request to the target and relays its
+// response to the server. When the target switches protocols the upgraded
+// connection becomes the session's stream, relayed as TCP data until either
+// side closes it.
+func handleUpgradeRequest(
+	tunnel *shared.Tunnel,
+	id string,
+	payload protocol.HttpUpgradeRequestPayload,
+	session *tcpSession,
+	sessions *safe.Map[string, *tcpSession],
+	options Options,
+	httpClient *http.Client,
+	statsProvider stats.StatsProvider,
+	l log.Logger,
+) {
+	connID := payload.ConnID
+	defer func() {
+		sessions.Delete(connID)
+		tunnel.ReleaseWindow(connID)
+		session.inbox.Close()
+	}()
+
+	startTime := time.Now()
+	statsProvider.IncrementHttpRequest()
+
+	// fail answers the server when there is no stream after all.
+	fail := func(response *protocol.HttpResponsePayload) {
+		close(session.dialed)
+		statsProvider.IncrementHttpResponse()
+		tunnel.SendResponse(protocol.MessageKindHttpResponse, id, response)
+	}
+
+	route, path, ok := options.route(payload.Path)
+	if !ok {
+		fail(noRouteResponse(payload.Path))
+		return
+	}
+
+	// The upgraded connection outlives the request, so only the tunnel
+	// bounds it.
+	req, err := http.NewRequestWithContext(tunnel.Context(), payload.Method, route.Target+path, nil)
+	if err != nil {
+		l.Error("failed to create HTTP request", "error", err.Error())
+		fail(&protocol.HttpResponsePayload{Error: targetError(tunnel, err)})
+		return
+	}
+	for k, v := range payload.Headers {
+		for _, vv := range v {
+			req.Header.Add(k, vv)
+		}
+	}
+	vars := headerVars{visitorIP: payload.RemoteAddr, tunnel: options.Name, requestID: id}
+	applyHeaderRules(options.requestHeaderRules(), req.Header, vars)
+	if host := options.targetHost(payload.Host); host != "" {
+		req.Host = host
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		l.Info("upgrade request failed", "method", payload.Method, "path", payload.Path, "elapsed", time.Since(startTime), "error", err.Error())
+		fail(&protocol.HttpResponsePayload{Error: targetError(tunnel, err)})
+		return
+	}
+	options.newURLRewriter(route, payload.Scheme, payload.Host).rewriteHeaders(resp.Header)
+	applyHeaderRules(options.ResponseHeaders, resp.Header, vars)
+
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if resp.StatusCode != http.StatusSwitchingProtocols || !ok {
+		// The target declined; relay its answer as a plain response.
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			fail(&protocol.HttpResponsePayload{Error: targetError(tunnel, err)})
+			return
+		}
+		l.Info("upgrade request declined", "status", resp.StatusCode, "method", payload.Method, "path", payload.Path)
+		fail(&protocol.HttpResponsePayload{Response: protocol.HttpResponse{
+			Status:  resp.StatusCode,
+			Headers: resp.Header,
+			Body:    body,
+		}})
+		return
+	}
+	session.conn = conn
+	close(session.dialed)
+	defer conn.Close()
+
+	statsProvider.IncrementHttpResponse()
+	if err := tunnel.SendResponse(protocol.MessageKindHttpResponse, id, &protocol.HttpResponsePayload{Response: protocol.HttpResponse{
+		Status:  resp.StatusCode,
+		Headers: resp.Header,
+	}}); err != nil {
+		l.Error("failed to send upgrade response", "error", err.Error())
+		return
+	}
+	upgrade := resp.Header.Get("Upgrade")
+	l.Info("upgraded connection", "protocol", upgrade, "method", payload.Method, "path", payload.Path)
+
+	pumpTCP(tunnel, connID, conn, sessions, l)
+	l.Info("upgraded connection closed", "protocol", upgrade, "path", payload.Path, "elapsed", time.Since(startTime))
+}
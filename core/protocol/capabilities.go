@@ -0,0 +1,90 @@
+package protocol
+
+import "slices"
+
+// ProtocolVersion is the tunnel protocol version spoken by this build.
+// Version 1 is the implicit version of peers that predate the handshake.
+const ProtocolVersion = 2
+
+// SubprotocolHandshake is the websocket subprotocol offered by peers that
+// open the tunnel with a Hello/HelloAck exchange. It is preferred over
+// SubprotocolBinary, which older servers may still select.
+const SubprotocolHandshake = "tnl.v2"
+
+// Features that peers advertise in the handshake. A feature is only used
+// when both sides list it.
+const (
+	// FeatureStreaming allows HttpResponseStart/Chunk/End streams.
+	FeatureStreaming = "streaming"
+	// FeatureBinaryFrames switches both peers to EncodingBinary once the
+	// handshake completes.
+	FeatureBinaryFrames = "binary-frames"
+	// FeatureCompression enables permessage-deflate write compression.
+	FeatureCompression = "compression"
+	// FeatureRegisterAck replaces the welcome text with a RegisterAck.
+	FeatureRegisterAck = "register-ack"
+	// FeatureRequestStreaming allows HttpRequestStart/Chunk/End streams.
+	FeatureRequestStreaming = "request-streaming"
+	// FeatureFlowControl bounds each stream by a credit window replenished
+	// with WindowUpdate messages, instead of stalling the whole tunnel when
+	// one consumer falls behind.
+	FeatureFlowControl = "flow-control"
+	// FeatureErrorCodes lets the client explain failed requests with a
+	// structured Error. Older servers cannot decode one, so they are sent
+	// none and fall back to a bare 502.
+	FeatureErrorCodes = "error-codes"
+	// FeatureGoAway lets the server announce with a GoAway that it is
+	// shutting down, so the client can reconnect before the tunnel closes.
+	FeatureGoAway = "go-away"
+	// FeatureTCP allows TCP tunnels (TcpOpen/Data/Close).
+	FeatureTCP = "tcp"
+	// FeatureTcpOpened has the client confirm each connection it reaches
+	// with a TcpOpened, so `tnl connect` users learn whether it went
+	// through before they are told it did.
+	FeatureTcpOpened = "tcp-opened"
+	// FeatureUDP allows UDP tunnels (UdpDatagram/Close).
+	FeatureUDP = "udp"
+	// FeatureUpgrade relays HTTP upgrades other than websocket
+	// (HttpUpgradeRequest). Without it they are sent as plain requests.
+	FeatureUpgrade = "upgrade"
+	// FeatureWebsocketControl relays websocket pings and pongs as
+	// WebsocketMessages of those kinds. Without it each side answers pings
+	// itself.
+	FeatureWebsocketControl = "ws-control"
+	// FeatureAllowedIPs means the server turns away visitors outside the
+	// networks the client registered its tunnel for.
+	FeatureAllowedIPs = "allowed-ips"
+)
+
+// InitialWindowSize is the credit, in data bytes, each flow-controlled
+// stream starts with in each direction.
+const InitialWindowSize = 256 * 1024
+
+// Capabilities describes what a peer (or a negotiated tunnel) supports.
+type Capabilities struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features,omitempty"`
+}
+
+// LegacyCapabilities are assumed for peers that connect without the
+// handshake. Every such peer already understands streamed responses.
+func LegacyCapabilities() Capabilities {
+	return Capabilities{Version: 1, Features: []string{FeatureStreaming}}
+}
+
+// Has reports whether feature is in the set.
+func (c Capabilities) Has(feature string) bool {
+	return slices.Contains(c.Features, feature)
+}
+
+// Negotiate returns the capabilities both c and peer support: the lower of
+// the two versions and the intersection of their features, in c's order.
+func (c Capabilities) Negotiate(peer Capabilities) Capabilities {
+	agreed := Capabilities{Version: min(c.Version, peer.Version)}
+	for _, f := range c.Features {
+		if peer.Has(f) {
+			agreed.Features = append(agreed.Features, f)
+		}
+	}
+	return agreed
+}
@@ -0,0 +1,25 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiate(t *testing.T) {
+	server := Capabilities{Version: 3, Features: []string{FeatureStreaming, FeatureBinaryFrames, FeatureCompression}}
+	client := Capabilities{Version: 2, Features: []string{FeatureCompression, "future-thing", FeatureStreaming}}
+
+	agreed := server.Negotiate(client)
+	assert.Equal(t, 2, agreed.Version)
+	assert.Equal(t, []string{FeatureStreaming, FeatureCompression}, agreed.Features)
+	assert.True(t, agreed.Has(FeatureStreaming))
+	assert.False(t, agreed.Has(FeatureBinaryFrames))
+}
+
+func TestLegacyCapabilities(t *testing.T) {
+	legacy := LegacyCapabilities()
+	assert.Equal(t, 1, legacy.Version)
+	assert.True(t, legacy.Has(FeatureStreaming))
+	assert.False(t, legacy.Has(FeatureBinaryFrames))
+}
@@ -0,0 +1,36 @@
+package protocol
+
+// ErrorCode classifies why the client could not complete a request to its
+// target.
+type ErrorCode string
+
+const (
+	ErrorCodeConnectionRefused ErrorCode = "connection_refused"
+	ErrorCodeDNS               ErrorCode = "dns_failure"
+	ErrorCodeTLS               ErrorCode = "tls_error"
+	ErrorCodeTimeout           ErrorCode = "timeout"
+	ErrorCodeReset             ErrorCode = "target_reset"
+	ErrorCodeCancelled         ErrorCode = "cancelled"
+	// ErrorCodeForbidden is a destination the client refuses to dial.
+	ErrorCodeForbidden ErrorCode = "forbidden"
+	// ErrorCodeUnknown covers everything else, including errors from
+	// clients that predate error codes.
+	ErrorCodeUnknown ErrorCode = "unknown"
+)
+
+// Error is a failure reported by the client in place of a response.
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message,omitempty"`
+}
+
+func (e *Error) Error() string {
+	code := e.Code
+	if code == "" {
+		code = ErrorCodeUnknown
+	}
+	if e.Message == "" {
+		return string(code)
+	}
+	return string(code) + ": " + e.Message
+}
@@ -0,0 +1,247 @@
+package protocol
+
+import (
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Encoding identifies how a Message is carried on the tunnel websocket.
+type Encoding int
+
+const (
+	// EncodingJSON is the original wire format: a JSON Message in a text
+	// frame whose Payload is itself JSON (and therefore base64 encoded).
+	// It remains the default for peers that do not negotiate binary frames.
+	EncodingJSON Encoding = iota
+	// EncodingBinary carries a Message in a websocket binary frame: a short
+	// length-prefixed header (kind, ID, RE) followed by the raw payload.
+	// Payloads that carry bulk bytes implement encoding.BinaryMarshaler and
+	// skip JSON altogether; everything else is still JSON inside the frame.
+	EncodingBinary
+)
+
+// SubprotocolBinary is the websocket subprotocol offered by clients that can
+// speak binary frames. When the server selects it both peers switch to
+// EncodingBinary; old servers ignore it and the tunnel stays on JSON.
+const SubprotocolBinary = "tnl.binary.v1"
+
+// frameVersion is the first byte of every binary frame so the layout can
+// evolve without ambiguity.
+const frameVersion = 1
+
+var errShortFrame = errors.New("protocol: short frame")
+
+// MarshalFrame encodes msg as a binary frame:
+//
+//	version (1 byte) | header length (uint16, big endian) | header | payload
+//
+// where the header is uvarint(kind), then ID and RE each as a uvarint length
+// followed by the string bytes.
+func MarshalFrame(msg Message) ([]byte, error) {
+	header := make([]byte, 0, 3*binary.MaxVarintLen64+len(msg.ID)+len(msg.RE))
+	header = binary.AppendUvarint(header, uint64(msg.Kind))
+	header = appendString(header, msg.ID)
+	header = appendString(header, msg.RE)
+	if len(header) > math.MaxUint16 {
+		return nil, fmt.Errorf("protocol: frame header too large (%d bytes)", len(header))
+	}
+
+	frame := make([]byte, 0, 3+len(header)+len(msg.Payload))
+	frame = append(frame, frameVersion)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(header)))
+	frame = append(frame, header...)
+	return append(frame, msg.Payload...), nil
+}
+
+// UnmarshalFrame decodes a binary frame produced by MarshalFrame. The
+// returned Message aliases data for its payload.
+func UnmarshalFrame(data []byte) (Message, error) {
+	if len(data) < 3 {
+		return Message{}, errShortFrame
+	}
+	if data[0] != frameVersion {
+		return Message{}, fmt.Errorf("protocol: unsupported frame version %d", data[0])
+	}
+	headerLen := int(binary.BigEndian.Uint16(data[1:3]))
+	if len(data) < 3+headerLen {
+		return Message{}, errShortFrame
+	}
+	header := data[3 : 3+headerLen]
+
+	kind, n := binary.Uvarint(header)
+	if n <= 0 {
+		return Message{}, errShortFrame
+	}
+	header = header[n:]
+	id, header, err := readString(header)
+	if err != nil {
+		return Message{}, err
+	}
+	re, _, err := readString(header)
+	if err != nil {
+		return Message{}, err
+	}
+
+	msg := Message{
+		ID:       id,
+		Kind:     int(kind),
+		RE:       re,
+		Encoding: EncodingBinary,
+	}
+	if payload := data[3+headerLen:]; len(payload) > 0 {
+		msg.Payload = payload
+	}
+	return msg, nil
+}
+
+// EncodePayload encodes a message payload for the given encoding. Binary
+// frames use the payload's MarshalBinary when it has one.
+func EncodePayload(enc Encoding, v any) ([]byte, error) {
+	if m, ok := v.(encoding.BinaryMarshaler); ok && enc == EncodingBinary {
+		return m.MarshalBinary()
+	}
+	return json.Marshal(v)
+}
+
+// DecodePayload decodes the message payload into v, honoring the encoding
+// the message arrived in.
+func (m Message) DecodePayload(v any) error {
+	if u, ok := v.(encoding.BinaryUnmarshaler); ok && m.Encoding == EncodingBinary {
+		return u.UnmarshalBinary(m.Payload)
+	}
+	return json.Unmarshal(m.Payload, v)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func readString(b []byte) (string, []byte, error) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < l {
+		return "", nil, errShortFrame
+	}
+	return string(b[n : n+int(l)]), b[n+int(l):], nil
+}
+
+// marshalWithBody encodes meta as length-prefixed JSON followed by the raw
+// body bytes. It is the binary layout for payloads that pair a little
+// metadata with bulk data.
+func marshalWithBody(meta any, body []byte) ([]byte, error) {
+	m, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, binary.MaxVarintLen64+len(m)+len(body))
+	buf = binary.AppendUvarint(buf, uint64(len(m)))
+	buf = append(buf, m...)
+	return append(buf, body...), nil
+}
+
+// unmarshalWithBody decodes the layout written by marshalWithBody, filling
+// meta and returning the body (nil when empty).
+func unmarshalWithBody(data []byte, meta any) ([]byte, error) {
+	l, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < l {
+		return nil, errShortFrame
+	}
+	if err := json.Unmarshal(data[n:n+int(l)], meta); err != nil {
+		return nil, err
+	}
+	if body := data[n+int(l):]; len(body) > 0 {
+		return body, nil
+	}
+	return nil, nil
+}
+
+// Binary payload encodings. JSON encoding of these types is unchanged; the
+// methods below are only used inside binary frames.
+
+func (p HttpRequestPayload) MarshalBinary() ([]byte, error) {
+	body := p.Body
+	p.Body = nil
+	return marshalWithBody(p, body)
+}
+
+func (p *HttpRequestPayload) UnmarshalBinary(data []byte) error {
+	body, err := unmarshalWithBody(data, p)
+	p.Body = body
+	return err
+}
+
+func (p HttpResponsePayload) MarshalBinary() ([]byte, error) {
+	body := p.Response.Body
+	p.Response.Body = nil
+	return marshalWithBody(p, body)
+}
+
+func (p *HttpResponsePayload) UnmarshalBinary(data []byte) error {
+	body, err := unmarshalWithBody(data, p)
+	p.Response.Body = body
+	return err
+}
+
+func (p HttpResponseChunkPayload) MarshalBinary() ([]byte, error) {
+	return p.Data, nil
+}
+
+func (p *HttpResponseChunkPayload) UnmarshalBinary(data []byte) error {
+	p.Data = data
+	if len(data) == 0 {
+		p.Data = nil
+	}
+	return nil
+}
+
+func (p WebsocketMessagePayload) MarshalBinary() ([]byte, error) {
+	data := p.Data
+	p.Data = nil
+	return marshalWithBody(p, data)
+}
+
+func (p *WebsocketMessagePayload) UnmarshalBinary(data []byte) error {
+	body, err := unmarshalWithBody(data, p)
+	p.Data = body
+	return err
+}
+
+func (p HttpRequestChunkPayload) MarshalBinary() ([]byte, error) {
+	data := p.Data
+	p.Data = nil
+	return marshalWithBody(p, data)
+}
+
+func (p *HttpRequestChunkPayload) UnmarshalBinary(data []byte) error {
+	body, err := unmarshalWithBody(data, p)
+	p.Data = body
+	return err
+}
+
+func (p TcpDataPayload) MarshalBinary() ([]byte, error) {
+	data := p.Data
+	p.Data = nil
+	return marshalWithBody(p, data)
+}
+
+func (p *TcpDataPayload) UnmarshalBinary(data []byte) error {
+	body, err := unmarshalWithBody(data, p)
+	p.Data = body
+	return err
+}
+
+func (p UdpDatagramPayload) MarshalBinary() ([]byte, error) {
+	data := p.Data
+	p.Data = nil
+	return marshalWithBody(p, data)
+}
+
+func (p *UdpDatagramPayload) UnmarshalBinary(data []byte) error {
+	body, err := unmarshalWithBody(data, p)
+	p.Data = body
+	return err
+}
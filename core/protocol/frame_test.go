@@ -0,0 +1,183 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []Message{
+		{
+			ID:      "123",
+			Kind:    MessageKindText,
+			Payload: []byte(`{"text":"hello"}`),
+		},
+		{
+			ID:      "456",
+			Kind:    MessageKindHttpResponseChunk,
+			RE:      "789",
+			Payload: []byte{0x00, 0x01, 0xff},
+		},
+		{
+			ID:   "empty",
+			Kind: MessageKindHttpResponseEnd,
+		},
+	}
+
+	for _, msg := range tests {
+		t.Run(msg.ID, func(t *testing.T) {
+			frame, err := MarshalFrame(msg)
+			assert.NoError(t, err)
+
+			decoded, err := UnmarshalFrame(frame)
+			assert.NoError(t, err)
+
+			msg.Encoding = EncodingBinary
+			assert.Equal(t, msg, decoded)
+		})
+	}
+}
+
+func TestUnmarshalFrameRejectsGarbage(t *testing.T) {
+	for _, data := range [][]byte{
+		nil,
+		{frameVersion},
+		{frameVersion, 0x00, 0x10, 0x01},
+		{0x7f, 0x00, 0x00},
+		{frameVersion, 0x00, 0x02, 0x01, 0x05},
+	} {
+		_, err := UnmarshalFrame(data)
+		assert.Error(t, err, "%v", data)
+	}
+}
+
+func TestBinaryPayloads(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload any
+		decoded any
+	}{
+		{
+			name: "http request",
+			payload: &HttpRequestPayload{
+				Method:   "POST",
+				Path:     "/upload?x=1",
+				Headers:  http.Header{"Content-Type": []string{"application/octet-stream"}},
+				Body:     []byte{0x00, 0x01, 0x02, 0xff},
+				Timeouts: Timeouts{ResponseHeaderMillis: 30000, IdleMillis: 5000},
+			},
+			decoded: &HttpRequestPayload{},
+		},
+		{
+			name: "http response",
+			payload: &HttpResponsePayload{Response: HttpResponse{
+				Status:  200,
+				Headers: http.Header{"Content-Length": []string{"3"}},
+				Body:    []byte("abc"),
+			}},
+			decoded: &HttpResponsePayload{},
+		},
+		{
+			name:    "response chunk",
+			payload: &HttpResponseChunkPayload{Data: []byte("data: x\n\n\x00")},
+			decoded: &HttpResponseChunkPayload{},
+		},
+		{
+			name:    "request chunk",
+			payload: &HttpRequestChunkPayload{RequestID: "r1", Data: []byte{0x00, 0xff}},
+			decoded: &HttpRequestChunkPayload{},
+		},
+		{
+			name:    "websocket message",
+			payload: &WebsocketMessagePayload{SessionID: "s1", Kind: 2, Data: []byte{0xde, 0xad}},
+			decoded: &WebsocketMessagePayload{},
+		},
+		{
+			name:    "tcp data",
+			payload: &TcpDataPayload{ConnID: "c1", Data: []byte{0x00, 0x0d, 0x0a}},
+			decoded: &TcpDataPayload{},
+		},
+		{
+			name:    "udp datagram",
+			payload: &UdpDatagramPayload{SessionID: "u1", RemoteAddr: "203.0.113.7:5353", Data: []byte{0xff, 0x00}},
+			decoded: &UdpDatagramPayload{},
+		},
+		{
+			name:    "json fallback",
+			payload: &TextPayload{Text: "ping"},
+			decoded: &TextPayload{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := EncodePayload(EncodingBinary, tt.payload)
+			assert.NoError(t, err)
+
+			msg := Message{Payload: data, Encoding: EncodingBinary}
+			assert.NoError(t, msg.DecodePayload(tt.decoded))
+			assert.Equal(t, tt.payload, tt.decoded)
+		})
+	}
+}
+
+func TestBinaryChunkIsNotInflated(t *testing.T) {
+	data := bytes.Repeat([]byte{0xab}, 32*1024)
+
+	binaryPayload, err := EncodePayload(EncodingBinary, &HttpResponseChunkPayload{Data: data})
+	assert.NoError(t, err)
+	frame, err := MarshalFrame(Message{ID: "id", RE: "re", Kind: MessageKindHttpResponseChunk, Payload: binaryPayload})
+	assert.NoError(t, err)
+
+	jsonPayload, err := EncodePayload(EncodingJSON, &HttpResponseChunkPayload{Data: data})
+	assert.NoError(t, err)
+	jsonMessage, err := json.Marshal(Message{ID: "id", RE: "re", Kind: MessageKindHttpResponseChunk, Payload: jsonPayload})
+	assert.NoError(t, err)
+
+	assert.Less(t, len(frame), len(data)+64)
+	assert.Greater(t, len(jsonMessage), len(data)*16/10)
+}
+
+func benchmarkChunk(b *testing.B, enc Encoding, size int) {
+	data := bytes.Repeat([]byte{0xab}, size)
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		payload, err := EncodePayload(enc, &HttpResponseChunkPayload{Data: data})
+		if err != nil {
+			b.Fatal(err)
+		}
+		msg := Message{ID: "2f1c6a4e-0d3b-4b8e-9b7e-1f0e5c2d3a4b", RE: "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d", Kind: MessageKindHttpResponseChunk, Payload: payload}
+
+		var decoded Message
+		if enc == EncodingBinary {
+			frame, err := MarshalFrame(msg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if decoded, err = UnmarshalFrame(frame); err != nil {
+				b.Fatal(err)
+			}
+		} else {
+			text, err := json.Marshal(msg)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := json.Unmarshal(text, &decoded); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		var chunk HttpResponseChunkPayload
+		if err := decoded.DecodePayload(&chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkChunkJSON(b *testing.B)   { benchmarkChunk(b, EncodingJSON, 32*1024) }
+func BenchmarkChunkBinary(b *testing.B) { benchmarkChunk(b, EncodingBinary, 32*1024) }
@@ -23,6 +23,49 @@ const (
 	// HttpStreamCancel is sent by the server to the client when the downstream
 	// consumer disconnects, so the client can cancel the upstream request.
 	MessageKindHttpStreamCancel
+	// Hello and HelloAck open a tunnel negotiated with SubprotocolHandshake:
+	// the client sends Hello with its capabilities, the server answers with
+	// the agreed set. Both are always JSON and precede all other traffic.
+	MessageKindHello
+	MessageKindHelloAck
+	// RegisterAck is sent by the server once the tunnel is registered and
+	// routable, in place of the legacy welcome text.
+	MessageKindRegisterAck
+	// Streaming HTTP requests mirror streamed responses: the server sends
+	// one HttpRequestStart, then HttpRequestChunk* with the visitor's body,
+	// terminated by HttpRequestEnd. Chunks and end carry the start message's
+	// ID in RequestID; the client answers the start like an HttpRequest.
+	MessageKindHttpRequestStart
+	MessageKindHttpRequestChunk
+	MessageKindHttpRequestEnd
+	// WindowUpdate returns send credit to the peer on a flow-controlled
+	// stream once the data it sent has been consumed.
+	MessageKindWindowUpdate
+	// GoAway is sent by a server that is shutting down. It routes no new
+	// requests to the connection once the client has replaced it, and closes
+	// it when the requests in flight are done.
+	MessageKindGoAway
+	// Raw TCP connections to a TCP tunnel. The server sends TcpOpen for
+	// each connection accepted on the tunnel's port; both peers then relay
+	// the byte stream as TcpData and end it with TcpClose. All three carry
+	// the ConnID chosen by the server.
+	MessageKindTcpOpen
+	MessageKindTcpData
+	MessageKindTcpClose
+	// Datagrams of a UDP tunnel, in either direction. The server tracks
+	// each visitor address as a session with a SessionID it chooses, and
+	// sends UdpClose once a session has been idle for too long.
+	MessageKindUdpDatagram
+	MessageKindUdpClose
+	// HttpUpgradeRequest asks the client to relay a request to switch
+	// protocols other than websocket. The client answers with an
+	// HttpResponse; after a 101 both peers relay the raw connection as
+	// TcpData and TcpClose under the ConnID chosen by the server.
+	MessageKindHttpUpgradeRequest
+	// TcpOpened is sent by the client once it has reached the target of a
+	// TcpOpen; a target it cannot reach gets a TcpClose with an Error
+	// instead. It carries the TcpOpen's ConnID.
+	MessageKindTcpOpened
 )
 
 type Message struct {
@@ -31,6 +74,10 @@ type Message struct {
 	// RE is the request ID of the message that this message is responding to
 	RE      string `json:"re"`
 	Payload []byte `json:"payload"`
+
+	// Encoding records how the message arrived so DecodePayload can undo
+	// it. It is not part of the wire format.
+	Encoding Encoding `json:"-"`
 }
 
 type TextPayload struct {
@@ -38,14 +85,50 @@ type TextPayload struct {
 }
 
 type HttpRequestPayload struct {
-	Method  string      `json:"method"`
-	Path    string      `json:"path"`
-	Headers http.Header `json:"headers"`
-	Body    []byte      `json:"body"`
+	Method   string      `json:"method"`
+	Path     string      `json:"path"`
+	Headers  http.Header `json:"headers"`
+	Body     []byte      `json:"body"`
+	Timeouts Timeouts    `json:"timeouts"`
+	// RemoteAddr is the visitor's IP address, as far as the server can
+	// tell through its trusted proxies.
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// Host and Scheme are those the visitor reached the tunnel at.
+	Host   string `json:"host,omitempty"`
+	Scheme string `json:"scheme,omitempty"`
+}
+
+// Timeouts are the deadlines the server gives up on a request after, so the
+// client can apply them to the target request too. Zero means no deadline.
+type Timeouts struct {
+	// ResponseHeaderMillis bounds the wait for the response status and
+	// headers once the request has been sent in full.
+	ResponseHeaderMillis int64 `json:"response_header_ms,omitempty"`
+	// IdleMillis bounds the wait for each read of the response body.
+	IdleMillis int64 `json:"idle_ms,omitempty"`
+}
+
+// NewTimeouts returns Timeouts for the given durations.
+func NewTimeouts(responseHeader, idle time.Duration) Timeouts {
+	return Timeouts{
+		ResponseHeaderMillis: responseHeader.Milliseconds(),
+		IdleMillis:           idle.Milliseconds(),
+	}
+}
+
+// ResponseHeader returns the response header deadline.
+func (t Timeouts) ResponseHeader() time.Duration {
+	return time.Duration(t.ResponseHeaderMillis) * time.Millisecond
+}
+
+// Idle returns the idle deadline.
+func (t Timeouts) Idle() time.Duration {
+	return time.Duration(t.IdleMillis) * time.Millisecond
 }
 
 type HttpResponsePayload struct {
-	Error    error        `json:"error"`
+	// Error is set instead of Response when the target could not be reached.
+	Error    *Error       `json:"error"`
 	Response HttpResponse `json:"response"`
 }
 
@@ -55,14 +138,33 @@ type HttpResponse struct {
 	Body    []byte      `json:"body"`
 }
 
+// WebsocketCreateRequestPayload asks the client to open a websocket to the
+// target. Path includes the query string. Headers are the visitor's
+// handshake headers, less those the websocket handshake itself sets, and
+// Subprotocols are the ones the visitor offered, in order of preference.
+// SessionID is chosen by the server so it can take messages for the session
+// as soon as the target accepts; clients that predate it choose their own.
 type WebsocketCreateRequestPayload struct {
-	Origin string `json:"origin"`
-	Path   string `json:"path"`
+	SessionID    string      `json:"session_id,omitempty"`
+	Origin       string      `json:"origin"`
+	Path         string      `json:"path"`
+	Headers      http.Header `json:"headers,omitempty"`
+	Subprotocols []string    `json:"subprotocols,omitempty"`
+	// MaxMessageBytes caps the size of a message read from the target, as
+	// the server caps those from the visitor. Zero means unlimited.
+	MaxMessageBytes int64  `json:"max_message_bytes,omitempty"`
+	RemoteAddr      string `json:"remote_addr,omitempty"`
+	Host            string `json:"host,omitempty"`
+	Scheme          string `json:"scheme,omitempty"`
 }
 
+// WebsocketCreateResponsePayload answers a WebsocketCreateRequest.
+// HttpResponse is the target's handshake response: a 101 with the chosen
+// subprotocol on success, or the status it refused the handshake with
+// alongside Error.
 type WebsocketCreateResponsePayload struct {
 	SessionID    string               `json:"session_id"`
-	Error        error                `json:"error"`
+	Error        *Error               `json:"error"`
 	HttpResponse *HttpResponsePayload `json:"http_response"`
 }
 
@@ -72,8 +174,13 @@ type WebsocketMessagePayload struct {
 	Data      []byte `json:"data"`
 }
 
+// WebsocketClosePayload ends a websocket session. Code and Reason are the
+// close status the peer's side closed with, to close the other side with;
+// a zero Code (from peers that predate them) is a normal closure.
 type WebsocketClosePayload struct {
 	SessionID string `json:"session_id"`
+	Code      int    `json:"code,omitempty"`
+	Reason    string `json:"reason,omitempty"`
 }
 
 type HTTPRequest struct {
@@ -125,9 +232,11 @@ type HttpResponseChunkPayload struct {
 	Data []byte `json:"data"`
 }
 
-// HttpResponseEndPayload terminates a streamed HTTP response.
+// HttpResponseEndPayload terminates a streamed HTTP response. Trailers are
+// the target's response trailers (grpc-status for gRPC).
 type HttpResponseEndPayload struct {
-	Error string `json:"error,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Trailers http.Header `json:"trailers,omitempty"`
 }
 
 // HttpStreamCancelPayload asks the client to cancel an in-flight streamed
@@ -135,3 +244,145 @@ type HttpResponseEndPayload struct {
 type HttpStreamCancelPayload struct {
 	RequestID string `json:"request_id"`
 }
+
+// HelloPayload is the client's half of the handshake.
+type HelloPayload struct {
+	Capabilities
+}
+
+// HelloAckPayload carries the capabilities the server agreed to. A non-empty
+// Error means the server refused the tunnel and will close it.
+type HelloAckPayload struct {
+	Capabilities
+	Error string `json:"error,omitempty"`
+}
+
+// RegisterAckPayload describes a freshly registered tunnel.
+type RegisterAckPayload struct {
+	TunnelID string `json:"tunnel_id"`
+	Name     string `json:"name"`
+	// URLs are the public URLs the tunnel is reachable at; the first one is
+	// the canonical URL.
+	URLs          []string `json:"urls"`
+	ServerVersion string   `json:"server_version,omitempty"`
+	Limits        Limits   `json:"limits"`
+	// Identity is the authenticated owner of the tunnel, when the server
+	// requires authentication.
+	Identity *Identity `json:"identity,omitempty"`
+	// TCPPort is the public port of a TCP tunnel.
+	TCPPort int `json:"tcp_port,omitempty"`
+	// UDPPort is the public port of a UDP tunnel.
+	UDPPort int `json:"udp_port,omitempty"`
+	// ResumeToken lets the client take the name back after a disconnect,
+	// while the server holds it for the resume grace period.
+	ResumeToken string `json:"resume_token,omitempty"`
+}
+
+// Limits are the constraints the server enforces on tunnelled traffic. Zero
+// values mean unlimited.
+type Limits struct {
+	MaxRequestBodyBytes int64    `json:"max_request_body_bytes,omitempty"`
+	Timeouts            Timeouts `json:"timeouts"`
+}
+
+// Identity is an authenticated user as seen by the server.
+type Identity struct {
+	Subject string `json:"subject,omitempty"`
+	Email   string `json:"email,omitempty"`
+	Method  string `json:"method,omitempty"`
+}
+
+// HttpRequestStartPayload begins an HTTP request whose body follows as
+// HttpRequestChunk messages.
+type HttpRequestStartPayload struct {
+	Method     string      `json:"method"`
+	Path       string      `json:"path"`
+	Headers    http.Header `json:"headers,omitempty"`
+	Timeouts   Timeouts    `json:"timeouts"`
+	RemoteAddr string      `json:"remote_addr,omitempty"`
+	Host       string      `json:"host,omitempty"`
+	Scheme     string      `json:"scheme,omitempty"`
+}
+
+// HttpRequestChunkPayload carries raw request body bytes, relayed verbatim
+// and in order.
+type HttpRequestChunkPayload struct {
+	RequestID string `json:"request_id"`
+	Data      []byte `json:"data"`
+}
+
+// HttpRequestEndPayload terminates a streamed request body. A non-empty
+// Error means the visitor's upload failed part way. Trailers are the
+// visitor's request trailers, declared in the Trailer header of the
+// HttpRequestStart.
+type HttpRequestEndPayload struct {
+	RequestID string      `json:"request_id"`
+	Error     string      `json:"error,omitempty"`
+	Trailers  http.Header `json:"trailers,omitempty"`
+}
+
+// WindowUpdatePayload grants the peer Increment more bytes of credit on the
+// stream identified by StreamID (a request or websocket session ID).
+type WindowUpdatePayload struct {
+	StreamID  string `json:"stream_id"`
+	Increment int64  `json:"increment"`
+}
+
+// GoAwayPayload announces that the server is going away.
+type GoAwayPayload struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// TcpOpenPayload announces a connection accepted on a TCP tunnel's port.
+type TcpOpenPayload struct {
+	ConnID     string `json:"conn_id"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// Target is the host:port an egress proxy tunnel is asked to dial, in
+	// place of the address the client relays to.
+	Target string `json:"target,omitempty"`
+}
+
+// TcpOpenedPayload confirms that the client reached the target of a
+// connection.
+type TcpOpenedPayload struct {
+	ConnID string `json:"conn_id"`
+}
+
+// TcpDataPayload carries raw bytes of a TCP connection, relayed verbatim
+// and in order.
+type TcpDataPayload struct {
+	ConnID string `json:"conn_id"`
+	Data   []byte `json:"data"`
+}
+
+// TcpClosePayload ends a TCP connection in both directions. Error is set
+// when the client could not reach the target.
+type TcpClosePayload struct {
+	ConnID string `json:"conn_id"`
+	Error  *Error `json:"error,omitempty"`
+}
+
+// UdpDatagramPayload carries one datagram of a UDP session. RemoteAddr is
+// the visitor's address, set by the server.
+type UdpDatagramPayload struct {
+	SessionID  string `json:"session_id"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	Data       []byte `json:"data"`
+}
+
+// UdpClosePayload ends an idle UDP session.
+type UdpClosePayload struct {
+	SessionID string `json:"session_id"`
+}
+
+// HttpUpgradeRequestPayload is a request with Connection: Upgrade. It has
+// no body.
+type HttpUpgradeRequestPayload struct {
+	ConnID     string      `json:"conn_id"`
+	Method     string      `json:"method"`
+	Path       string      `json:"path"`
+	Headers    http.Header `json:"headers"`
+	RemoteAddr string      `json:"remote_addr,omitempty"`
+	Host       string      `json:"host,omitempty"`
+	Scheme     string      `json:"scheme,omitempty"`
+}
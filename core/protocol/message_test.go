@@ -127,6 +127,15 @@ func TestStreamPayloads(t *testing.T) {
 		assert.Equal(t, p, decoded)
 	})
 
+	t.Run("response end with trailers", func(t *testing.T) {
+		p := HttpResponseEndPayload{Trailers: http.Header{"Grpc-Status": []string{"0"}, "Grpc-Message": []string{""}}}
+		data, err := json.Marshal(p)
+		assert.NoError(t, err)
+		var decoded HttpResponseEndPayload
+		assert.NoError(t, json.Unmarshal(data, &decoded))
+		assert.Equal(t, p, decoded)
+	})
+
 	t.Run("stream cancel", func(t *testing.T) {
 		p := HttpStreamCancelPayload{RequestID: "abc-123"}
 		data, err := json.Marshal(p)
@@ -149,6 +158,15 @@ func TestWebsocketPayloads(t *testing.T) {
 				Origin: "http://localhost:8080",
 			},
 		},
+		{
+			name: "websocket create request with handshake",
+			payload: WebsocketCreateRequestPayload{
+				Path:         "/ws?room=1",
+				Origin:       "http://localhost:8080",
+				Headers:      http.Header{"Authorization": []string{"Bearer abc"}, "Cookie": []string{"session=1"}},
+				Subprotocols: []string{"graphql-ws", "graphql-transport-ws"},
+			},
+		},
 		{
 			name: "websocket message",
 			payload: WebsocketMessagePayload{
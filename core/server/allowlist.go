@@ -0,0 +1,121 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Networks is a list of IP networks, such as the allowlist a client
+// registers its tunnel with or the proxies the server trusts.
+type Networks []*net.IPNet
+
+// ParseNetworks parses networks written in CIDR notation. A bare address
+// stands for a network of its own.
+func ParseNetworks(entries []string) (Networks, error) {
+	var networks Networks
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// contains reports whether ip is in any of the networks.
+func (n Networks) contains(ip net.IP) bool {
+	for _, network := range n {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns the IP address of addr, or nil if it has none.
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return hostIP(addr.String())
+}
+
+// hostIP parses the address part of a "host:port" or bare address.
+func hostIP(s string) net.IP {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(s)
+}
+
+// visitorIP returns the address a request came from. Requests relayed by a
+// trusted proxy are traced back through X-Forwarded-For, from the nearest
+// hop outwards, to the first address that is not a trusted proxy: anything
+// further along was written by the visitor and proves nothing.
+func visitorIP(r *http.Request, trusted Networks) net.IP {
+	ip := hostIP(r.RemoteAddr)
+	if ip == nil || !trusted.contains(ip) {
+		return ip
+	}
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := hostIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			// A mangled hop can't be traced any further.
+			return ip
+		}
+		ip = hop
+		if !trusted.contains(ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+// visitorAddr returns the address r came from, for the client.
+func (s *Tunnel) visitorAddr(r *http.Request) string {
+	if ip := visitorIP(r, s.options.TrustedProxies); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// visitorScheme returns the scheme r was made with: https on TLS
+// connections, whatever a trusted proxy says it was, or else the scheme
+// tunnels are advertised with.
+func (s *Tunnel) visitorScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if ip := hostIP(r.RemoteAddr); ip != nil && s.options.TrustedProxies.contains(ip) {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			return proto
+		}
+	}
+	return s.options.AccessScheme
+}
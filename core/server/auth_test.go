@@ -171,3 +171,39 @@ func TestAuthTestEndpoint(t *testing.T) {
 		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
 	})
 }
+
+func TestConnectToSharedTunnel(t *testing.T) {
+	guardian, mint, _ := startFakeGuardian(t)
+	handler := NewHandler(Options{
+		Hostname:         "example.com",
+		EnableAuth:       true,
+		GuardianURL:      guardian.URL,
+		GuardianAudience: "svc_tiny-tunnel_stable",
+	}, log.NewTestLogger())
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	// A private tunnel of user-1, shared with a teammate, whose client has
+	// not connected yet.
+	handler.tunnels.SetNX("db", &tunnelPool{private: &privateAccess{owner: "user-1", shared: []string{"grace@example.com"}}})
+
+	connect := func(sub, email string) int {
+		req, _ := http.NewRequest("GET", server.URL+"/connect?name=db", nil)
+		if sub != "" {
+			claims := validClaims(guardian.URL)
+			claims["sub"] = sub
+			claims["email"] = email
+			req.Header.Set("X-Auth-Token", mint(claims))
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, connect("", ""))
+	assert.Equal(t, http.StatusForbidden, connect("user-3", "eve@example.com"))
+	// The owner and the teammate get past the checks.
+	assert.Equal(t, http.StatusServiceUnavailable, connect("user-1", "ada@example.com"))
+	assert.Equal(t, http.StatusServiceUnavailable, connect("user-2", "Grace@example.com"))
+}
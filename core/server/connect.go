@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/campbel/tiny-tunnel/core/protocol"
+	"github.com/campbel/tiny-tunnel/core/shared"
+	"github.com/campbel/tiny-tunnel/internal/guardian"
+	"github.com/google/uuid"
+)
+
+var errPrivateNeedsAuth = errors.New("private tunnels require a server with authentication enabled")
+
+// privateAccess is who may connect to a private tunnel: the subject that
+// registered it, and the users it is shared with, by subject or email.
+type privateAccess struct {
+	owner  string
+	shared []string
+}
+
+// allows reports whether identity may connect to the tunnel.
+func (a *privateAccess) allows(identity guardian.Identity) bool {
+	if identity.Sub != "" && identity.Sub == a.owner {
+		return true
+	}
+	for _, user := range a.shared {
+		if user == identity.Sub || (identity.Email != "" && strings.EqualFold(user, identity.Email)) {
+			return true
+		}
+	}
+	return false
+}
+
+// privateAccess returns who may connect to the tunnel a registration asks
+// to make private, or nil for a public tunnel. Without authentication
+// there is nobody to tell apart, so private tunnels are refused.
+func (s *Handler) privateAccess(r *http.Request) (*privateAccess, error) {
+	if r.FormValue("private") == "" {
+		return nil, nil
+	}
+	if !s.options.EnableAuth {
+		return nil, errPrivateNeedsAuth
+	}
+	identity, _ := identityFromContext(r.Context())
+	access := &privateAccess{owner: identity.Sub}
+	for _, user := range r.Form["share"] {
+		if user = strings.TrimSpace(user); user != "" {
+			access.shared = append(access.shared, user)
+		}
+	}
+	return access, nil
+}
+
+// HandleConnect pipes a `tnl connect` connection to the private tunnel
+// named in the request, like a TCP connection to a TCP tunnel. A target
+// asks an egress proxy tunnel to dial it. Only the tunnel's owner and the
+// users it is shared with may connect.
+func (s *Handler) HandleConnect(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	pool, ok := s.tunnels.Get(name)
+	if !ok {
+		http.Error(w, "tunnel not found", http.StatusNotFound)
+		return
+	}
+	access := pool.access()
+	if access == nil {
+		http.Error(w, "tunnel not found", http.StatusNotFound)
+		return
+	}
+	identity, ok := identityFromContext(r.Context())
+	if !ok || !access.allows(identity) {
+		s.l.Info("connection to private tunnel refused", "name", name, "user", identity.String())
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	tunnel, ok := pool.pick()
+	if !ok {
+		http.Error(w, "tunnel is not connected", http.StatusServiceUnavailable)
+		return
+	}
+	tunnel.inflight.Add(1)
+	defer tunnel.inflight.Add(-1)
+
+	// The client reaches the target before the connection is upgraded, so
+	// one it cannot reach is refused with a status `tnl connect` can report.
+	target := r.FormValue("target")
+	connID := uuid.New().String()
+	session := tunnel.openTCPSession(connID)
+	defer tunnel.closeTCPSession(connID, session)
+	// abandon drops the connection, telling the client unless it dropped
+	// it first.
+	abandon := func() {
+		session.attach(nil)
+		if _, open := tunnel.tcpConns.Get(connID); open && !tunnel.tunnel.IsClosed() {
+			if err := tunnel.tunnel.Send(protocol.MessageKindTcpClose, &protocol.TcpClosePayload{ConnID: connID}); err != nil {
+				s.l.Debug("failed to send tcp close", "error", err.Error())
+			}
+		}
+	}
+	if err := tunnel.openPrivate(r.Context(), connID, session, tunnel.visitorAddr(r), target); err != nil {
+		abandon()
+		s.l.Info("private tunnel connection failed", "name", name, "target", target, "err", err.Error())
+		var e *protocol.Error
+		if !errors.As(err, &e) {
+			e = &protocol.Error{Code: protocol.ErrorCodeUnknown}
+		}
+		http.Error(w, errorText(e), errorStatus(e))
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.l.Error("websocket upgrade failed", "err", err)
+		abandon()
+		return
+	}
+	s.l.Info("connected to private tunnel", "name", name, "remote", conn.RemoteAddr().String(), "target", target)
+	session.attach(shared.NewStreamConn(conn))
+	tunnel.pumpTCP(connID, session.conn)
+}
+
+// openPrivate asks the client to open connID for a `tnl connect` visitor
+// at remoteAddr, to target on an egress proxy tunnel, and waits for it to
+// report whether it reached the target. Clients that do not confirm
+// connections are taken to have reached it.
+func (s *Tunnel) openPrivate(ctx context.Context, connID string, session *tcpSession, remoteAddr, target string) error {
+	if err := s.tunnel.Send(protocol.MessageKindTcpOpen, &protocol.TcpOpenPayload{
+		ConnID:     connID,
+		RemoteAddr: remoteAddr,
+		Target:     target,
+	}); err != nil {
+		s.l.Error("failed to send tcp open", "error", err.Error())
+		return errTunnelUnavailable
+	}
+	if !s.tunnel.Capabilities().Has(protocol.FeatureTcpOpened) {
+		return nil
+	}
+
+	timeout := newDeadline(s.options.ResponseHeaderTimeout)
+	timeout.reset()
+	defer timeout.stop()
+	select {
+	case e := <-session.opened:
+		if e != nil {
+			return e
+		}
+		return nil
+	case <-timeout.C:
+		return &protocol.Error{Code: protocol.ErrorCodeTimeout}
+	case <-s.tunnel.Done():
+		return errTunnelUnavailable
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,35 @@
+package server
+
+import "time"
+
+// deadline is a timer that only runs once reset, and never fires when its
+// duration is zero. C is nil until the timer first runs; receiving from it
+// blocks forever.
+type deadline struct {
+	d time.Duration
+	t *time.Timer
+	C <-chan time.Time
+}
+
+func newDeadline(d time.Duration) *deadline {
+	return &deadline{d: d}
+}
+
+// reset (re)starts the timer.
+func (dl *deadline) reset() {
+	if dl.d <= 0 {
+		return
+	}
+	if dl.t == nil {
+		dl.t = time.NewTimer(dl.d)
+		dl.C = dl.t.C
+		return
+	}
+	dl.t.Reset(dl.d)
+}
+
+func (dl *deadline) stop() {
+	if dl.t != nil {
+		dl.t.Stop()
+	}
+}
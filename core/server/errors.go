@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/campbel/tiny-tunnel/core/protocol"
+)
+
+// errorStatus maps a failure reported by the client to the status the
+// visitor gets: 503 when nothing is listening at the target, 504 when it
+// timed out, 403 when the client refused it and 502 otherwise.
+func errorStatus(e *protocol.Error) int {
+	switch e.Code {
+	case protocol.ErrorCodeConnectionRefused:
+		return http.StatusServiceUnavailable
+	case protocol.ErrorCodeTimeout:
+		return http.StatusGatewayTimeout
+	case protocol.ErrorCodeForbidden:
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
+// errorText is the visitor-facing explanation of a failure. The client's
+// message stays in the server log since it may name local addresses.
+func errorText(e *protocol.Error) string {
+	switch e.Code {
+	case protocol.ErrorCodeConnectionRefused:
+		return "tunnel target refused the connection"
+	case protocol.ErrorCodeDNS:
+		return "tunnel target host could not be resolved"
+	case protocol.ErrorCodeTLS:
+		return "TLS handshake with the tunnel target failed"
+	case protocol.ErrorCodeTimeout:
+		return "tunnel target timed out"
+	case protocol.ErrorCodeReset:
+		return "tunnel target reset the connection"
+	case protocol.ErrorCodeCancelled:
+		return "request to the tunnel target was cancelled"
+	case protocol.ErrorCodeForbidden:
+		return "tunnel client does not allow that destination"
+	}
+	return "tunnel target could not be reached"
+}
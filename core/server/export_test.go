@@ -0,0 +1,7 @@
+package server
+
+// Helpers for the package's external tests.
+var (
+	StartFakeGuardian = startFakeGuardian
+	ValidClaims       = validClaims
+)
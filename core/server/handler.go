@@ -5,17 +5,25 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/campbel/tiny-tunnel/core/protocol"
 	"github.com/campbel/tiny-tunnel/core/server/ui"
 	"github.com/campbel/tiny-tunnel/internal/guardian"
 	"github.com/campbel/tiny-tunnel/internal/log"
 	"github.com/campbel/tiny-tunnel/internal/safe"
 	"github.com/campbel/tiny-tunnel/internal/tunneltoken"
+	"github.com/campbel/tiny-tunnel/internal/version"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // contextKey is a custom type for context keys to avoid string collisions
@@ -27,11 +35,15 @@ const (
 
 type Handler struct {
 	options  Options
+	router   http.Handler
+	h2c      http.Handler
 	upgrader websocket.Upgrader
-	tunnels  *safe.Map[string, *Tunnel]
+	tunnels  *safe.Map[string, *tunnelPool]
 	verifier *guardian.Verifier
 	signer   *tunneltoken.Signer
 	devices  *deviceStore
+	// draining is set by Shutdown; new tunnels are refused from then on.
+	draining atomic.Bool
 	l        log.Logger
 }
 
@@ -42,15 +54,17 @@ func identityFromContext(ctx context.Context) (guardian.Identity, bool) {
 	return identity, ok
 }
 
-func NewHandler(options Options, logger log.Logger) http.Handler {
+func NewHandler(options Options, logger log.Logger) *Handler {
 	server := &Handler{
 		options: options,
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true
 			},
+			Subprotocols:      []string{protocol.SubprotocolHandshake, protocol.SubprotocolBinary},
+			EnableCompression: true,
 		},
-		tunnels: safe.NewMap[string, *Tunnel](),
+		tunnels: safe.NewMap[string, *tunnelPool](),
 		l:       logger,
 	}
 
@@ -90,6 +104,7 @@ func NewHandler(options Options, logger log.Logger) http.Handler {
 		// (resolved against Guardian). Token minting, login pages, and the
 		// okta header dance all live in Guardian now — not here.
 		router.HandleFunc("/register", server.authTokenMiddleware(server.HandleRegister))
+		router.HandleFunc("/connect", server.authTokenMiddleware(server.HandleConnect))
 		// Serve static files for the UI
 		router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", ui.GetHandler()))
 		router.HandleFunc("/", server.HandleRoot)
@@ -103,6 +118,7 @@ func NewHandler(options Options, logger log.Logger) http.Handler {
 		router.HandleFunc("/api/token/exchange", server.authTokenMiddleware(server.HandleTokenExchange))
 	} else {
 		router.HandleFunc("/register", server.HandleRegister)
+		router.HandleFunc("/connect", server.HandleConnect)
 		router.HandleFunc("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if r.Header.Get("X-TT-Tunnel") != "" {
 				server.HandleTunnelRequest(w, r)
@@ -112,7 +128,41 @@ func NewHandler(options Options, logger log.Logger) http.Handler {
 		}))
 	}
 
-	return router
+	server.router = router
+	server.h2c = h2c.NewHandler(router, &http2.Server{})
+	return server
+}
+
+func (s *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Cleartext HTTP/2 visitors (gRPC clients, mostly) open with the
+	// connection preface. Upgrade: h2c requests are left to the router so
+	// they reach the tunnel's target like any other upgrade.
+	if r.Method == "PRI" && r.ProtoMajor == 2 {
+		s.h2c.ServeHTTP(w, r)
+		return
+	}
+	s.router.ServeHTTP(w, r)
+}
+
+// Shutdown drains every tunnel: clients are told the server is going away
+// so they can reconnect elsewhere, and each connection is closed once its
+// requests in flight are done. New tunnels are refused meanwhile. Connections
+// still busy when ctx ends are closed anyway, and ctx's error is returned.
+func (s *Handler) Shutdown(ctx context.Context) error {
+	s.draining.Store(true)
+	var wg sync.WaitGroup
+	s.tunnels.Range(func(name string, pool *tunnelPool) bool {
+		for _, tunnel := range pool.all() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				tunnel.drain(ctx)
+			}()
+		}
+		return true
+	})
+	wg.Wait()
+	return ctx.Err()
 }
 
 func (s *Handler) HandleRoot(w http.ResponseWriter, r *http.Request) {
@@ -148,6 +198,11 @@ func (s *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if s.draining.Load() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
 	// When auth is enabled the Guardian middleware has already verified the
 	// credential; log who is registering.
 	if s.options.EnableAuth {
@@ -159,6 +214,12 @@ func (s *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 		s.l.Info("tunnel registration attempt", "name", name, "user", identity.String(), "auth_method", identity.Method)
 	}
 
+	allow, err := ParseNetworks(r.Form["allow"])
+	if err != nil {
+		http.Error(w, "invalid allowed IPs: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		s.l.Error("websocket upgrade failed", "err", err)
@@ -166,24 +227,170 @@ func (s *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tunnel := NewTunnel(conn, TunnelOptions{}, s.l)
-	if !s.tunnels.SetNX(name, tunnel) {
-		http.Error(w, "name is already used", http.StatusBadRequest)
+	tunnel := NewTunnel(conn, s.options.TunnelOptions(), s.l)
+	handshakeCtx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	err = tunnel.Handshake(handshakeCtx)
+	cancel()
+	if err != nil {
+		s.l.Error("tunnel handshake failed", "name", name, "err", err)
+		tunnel.Close()
 		return
 	}
-	s.l.Info("registered tunnel", "name", name)
+
+	var pool *tunnelPool
+	private, err := s.privateAccess(r)
+	mode := registerMode(r, private)
+	if err == nil {
+		registerCtx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		pool, err = s.register(registerCtx, name, r.FormValue("pool"), r.FormValue("resume"), mode, allow, private, tunnel)
+		cancel()
+	}
+	switch {
+	case err != nil:
+	case mode == modeTCP:
+		port, _ := strconv.Atoi(r.FormValue("port"))
+		if err = pool.listenTCP(s.options.TCPPorts, port); err != nil {
+			s.leave(name, pool, tunnel, 0)
+		}
+	case mode == modeUDP:
+		port, _ := strconv.Atoi(r.FormValue("port"))
+		if err = pool.listenUDP(s.options.UDPPorts, port, s.options.UDPIdleTimeout, s.l); err != nil {
+			s.leave(name, pool, tunnel, 0)
+		}
+	case mode == modeTLS:
+		if s.options.TLSPassthroughAddr == "" {
+			err = errPassthroughDisabled
+			s.leave(name, pool, tunnel, 0)
+		} else {
+			pool.enablePassthrough()
+		}
+	}
+	if err != nil {
+		// The connection is already upgraded; tell the client why before
+		// hanging up.
+		s.l.Info("tunnel registration refused", "name", name, "err", err.Error())
+		tunnel.SendText(err.Error())
+		tunnel.Close()
+		return
+	}
+	s.l.Info("registered tunnel", "name", name, "connections", pool.size())
 
 	// Announce readiness only after the tunnel is registered and routable —
-	// clients (and tests) treat the welcome message as "requests will now be
-	// served".
-	if err := tunnel.SendText(fmt.Sprintf("Welcome to Tiny Tunnel! Your tunnel is ready at %s", s.options.GetTunnelURL(name))); err != nil {
+	// clients (and tests) treat the ack as "requests will now be served".
+	// Clients that predate RegisterAck get the welcome text instead.
+	if tunnel.Capabilities().Has(protocol.FeatureRegisterAck) {
+		if err := tunnel.SendRegisterAck(s.registerAck(r, name, pool)); err != nil {
+			s.l.Error("failed to send register ack", "error", err.Error())
+		}
+	} else if err := tunnel.SendText(fmt.Sprintf("Welcome to Tiny Tunnel! Your tunnel is ready at %s", s.options.GetTunnelURL(name))); err != nil {
 		s.l.Error("failed to send hello message", "error", err.Error())
 	}
 
 	tunnel.Listen(r.Context())
+	s.leave(name, pool, tunnel, s.options.ResumeGracePeriod)
+}
+
+// registerMode returns the mode a registration asks for. Private tunnels
+// are only reachable through /connect, whatever else is asked.
+func registerMode(r *http.Request, private *privateAccess) tunnelMode {
+	switch {
+	case private != nil:
+		return modePrivate
+	case r.FormValue("tcp") != "":
+		return modeTCP
+	case r.FormValue("udp") != "":
+		return modeUDP
+	case r.FormValue("tls") != "":
+		return modeTLS
+	}
+	return modeHTTP
+}
 
-	s.tunnels.Delete(name)
-	s.l.Info("unregistered tunnel", "name", name)
+// leave removes tunnel from the pool registered under name, and the pool
+// itself once it is closed, possibly after grace.
+func (s *Handler) leave(name string, pool *tunnelPool, tunnel *Tunnel, grace time.Duration) {
+	unregister := func() {
+		s.tunnels.DeleteIf(name, func(p *tunnelPool) bool { return p == pool })
+		pool.release()
+		pool.closePorts()
+		s.l.Info("unregistered tunnel", "name", name)
+	}
+	if pool.leave(tunnel, grace, unregister) {
+		unregister()
+	} else if pool.size() == 0 {
+		s.l.Info("tunnel disconnected, holding name for resumption", "name", name, "grace", grace)
+	} else {
+		s.l.Info("tunnel connection closed", "name", name, "connections", pool.size())
+	}
+}
+
+// register adds tunnel under name, either as a new tunnel or, when the
+// client presents the pool key the name was registered with, as another
+// connection of the existing one. A name held after a disconnect is given
+// back to the client presenting its resume token. Every connection must ask
+// for the mode the name was registered with. Visitors are held to the
+// allowlist of the connection that registered last. A private tunnel is
+// private from the start, so it is never routed publicly.
+//
+// A name whose last connection is leaving is waited for, until ctx is done.
+func (s *Handler) register(ctx context.Context, name, key, token string, mode tunnelMode, allow Networks, private *privateAccess, tunnel *Tunnel) (*tunnelPool, error) {
+	for attempt := 0; attempt < maxRegisterAttempts; attempt++ {
+		pool := newTunnelPool(key, mode, tunnel)
+		pool.allow = allow
+		pool.private = private
+		if s.tunnels.SetNX(name, pool) {
+			return pool, nil
+		}
+		existing, ok := s.tunnels.Get(name)
+		if !ok {
+			continue
+		}
+		err := existing.join(key, token, mode, tunnel)
+		if err == errPoolClosed {
+			select {
+			case <-existing.gone:
+				continue
+			case <-ctx.Done():
+				return nil, err
+			}
+		}
+		if err == nil {
+			existing.setAllowlist(allow)
+		}
+		return existing, err
+	}
+	return nil, errPoolClosed
+}
+
+// registerAck describes the tunnel just registered under name.
+func (s *Handler) registerAck(r *http.Request, name string, pool *tunnelPool) *protocol.RegisterAckPayload {
+	ack := &protocol.RegisterAckPayload{
+		TunnelID:      pool.id,
+		Name:          name,
+		URLs:          []string{s.options.GetTunnelURL(name)},
+		ServerVersion: version.Get(),
+		Limits:        s.options.Limits(),
+		ResumeToken:   pool.token,
+	}
+	if port := pool.tcpPort(); port != 0 {
+		ack.URLs = []string{fmt.Sprintf("tcp://%s:%d", s.options.Hostname, port)}
+		ack.TCPPort = port
+	} else if port := pool.udpPort(); port != 0 {
+		ack.URLs = []string{fmt.Sprintf("udp://%s:%d", s.options.Hostname, port)}
+		ack.UDPPort = port
+	} else if pool.access() != nil {
+		ack.URLs = []string{"private://" + name}
+	} else if pool.passthrough() {
+		ack.URLs = []string{s.options.GetPassthroughURL(name)}
+	}
+	if identity, ok := identityFromContext(r.Context()); ok {
+		ack.Identity = &protocol.Identity{
+			Subject: identity.Sub,
+			Email:   identity.Email,
+			Method:  identity.Method,
+		}
+	}
+	return ack
 }
 
 // getHeaderCaseInsensitive retrieves a header value using case-insensitive matching
@@ -281,10 +488,43 @@ func (s *Handler) HandleTunnelRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tunnel, ok := s.tunnels.Get(tunnelID)
+	pool, ok := s.tunnels.Get(tunnelID)
 	if !ok {
 		http.Error(w, "tunnel not found", http.StatusNotFound)
 		return
 	}
-	tunnel.HandleHttpRequest(w, r)
+	if pool.access() != nil {
+		http.Error(w, "tunnel not found", http.StatusNotFound)
+		return
+	}
+	if ip := visitorIP(r, s.options.TrustedProxies); !pool.allows(ip) {
+		s.l.Debug("visitor not allowed", "tunnel", tunnelID, "ip", ip.String())
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	// Requests that never reached a dead connection fail over to the
+	// other connections of the tunnel.
+	attempt := 0
+	for ; attempt < maxPoolConnections; attempt++ {
+		tunnel, ok := pool.pick()
+		if !ok {
+			break
+		}
+		err := tunnel.serveHTTP(w, r)
+		if err == nil {
+			return
+		}
+		s.l.Info("retrying request on another connection", "tunnel", tunnelID, "err", err.Error())
+	}
+
+	switch wait, resuming := pool.resuming(); {
+	case resuming:
+		// The client dropped and has a while to come back.
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+		http.Error(w, "tunnel is reconnecting", http.StatusServiceUnavailable)
+	case attempt == 0:
+		http.Error(w, "tunnel not found", http.StatusNotFound)
+	default:
+		http.Error(w, "tunnel closed", http.StatusBadGateway)
+	}
 }
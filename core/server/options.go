@@ -2,7 +2,10 @@ package server
 
 import (
 	"fmt"
+	"net"
 	"time"
+
+	"github.com/campbel/tiny-tunnel/core/protocol"
 )
 
 type Options struct {
@@ -22,12 +25,77 @@ type Options struct {
 	SigningKey string
 	// TokenTTL is the lifetime of vended tunnel tokens (default 30 days).
 	TokenTTL time.Duration
+	// MaxRequestBodyBytes caps visitor request bodies relayed through a
+	// tunnel. Zero means unlimited.
+	MaxRequestBodyBytes int64
+	// MaxWebsocketMessageBytes caps the size of a websocket message from
+	// the visitor, and from the target through the client. Larger ones
+	// close the websocket with 1009 (message too big). Zero means
+	// unlimited.
+	MaxWebsocketMessageBytes int64
+	// ResponseHeaderTimeout is how long the client gets to relay the
+	// response status and headers before the visitor is sent a 504. Zero
+	// waits forever.
+	ResponseHeaderTimeout time.Duration
+	// IdleTimeout is how long a streamed response may go without a chunk
+	// before it is cut off. Zero waits forever.
+	IdleTimeout time.Duration
+	// ResumeGracePeriod is how long the name of a tunnel that dropped is
+	// held for its client to reconnect. Visitors get a 503 meanwhile. Zero
+	// frees the name right away.
+	ResumeGracePeriod time.Duration
+	// TCPPorts is the range TCP tunnels get their public port from. The
+	// zero value disables TCP tunnels.
+	TCPPorts PortRange
+	// UDPPorts is the range UDP tunnels get their public port from. The
+	// zero value disables UDP tunnels.
+	UDPPorts PortRange
+	// UDPIdleTimeout is how long a visitor address of a UDP tunnel is kept
+	// as a session without datagrams either way (default one minute).
+	UDPIdleTimeout time.Duration
+	// TLSPassthroughAddr is the address ServeTLSPassthrough listens on, used
+	// to build the URLs of passthrough tunnels. Empty disables TLS
+	// passthrough.
+	TLSPassthroughAddr string
+	// TrustedProxies are the proxies in front of the server whose
+	// X-Forwarded-For is believed when telling where visitors come from,
+	// to check them against a tunnel's allowed IPs.
+	TrustedProxies Networks
+}
+
+// Limits returns the limits announced to clients in the RegisterAck.
+func (o Options) Limits() protocol.Limits {
+	return protocol.Limits{
+		MaxRequestBodyBytes: o.MaxRequestBodyBytes,
+		Timeouts:            protocol.NewTimeouts(o.ResponseHeaderTimeout, o.IdleTimeout),
+	}
+}
+
+// TunnelOptions returns the per-tunnel options derived from o.
+func (o Options) TunnelOptions() TunnelOptions {
+	return TunnelOptions{
+		MaxRequestBodyBytes:      o.MaxRequestBodyBytes,
+		MaxWebsocketMessageBytes: o.MaxWebsocketMessageBytes,
+		ResponseHeaderTimeout:    o.ResponseHeaderTimeout,
+		IdleTimeout:              o.IdleTimeout,
+		TrustedProxies:           o.TrustedProxies,
+		AccessScheme:             o.GetAccessScheme(),
+	}
 }
 
 func (o Options) GetTunnelURL(name string) string {
 	return fmt.Sprintf("%s://%s.%s%s", o.GetAccessScheme(), name, o.Hostname, o.GetAccessPort())
 }
 
+// GetPassthroughURL returns the URL of a TLS passthrough tunnel.
+func (o Options) GetPassthroughURL(name string) string {
+	url := fmt.Sprintf("https://%s.%s", name, o.Hostname)
+	if _, port, err := net.SplitHostPort(o.TLSPassthroughAddr); err == nil && port != "443" {
+		url += ":" + port
+	}
+	return url
+}
+
 func (o Options) GetAccessScheme() string {
 	if o.AccessScheme == "" {
 		return "https"
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	errPassthroughDisabled = errors.New("TLS passthrough is not enabled on this server")
+	errNoServerName        = errors.New("no server name in TLS client hello")
+)
+
+// ServeTLSPassthrough accepts TLS connections on ln and relays each one,
+// still encrypted, to the tunnel its SNI names (name.<hostname>). Only
+// tunnels registered for passthrough are reachable. It returns when ln is
+// closed.
+func (s *Handler) ServeTLSPassthrough(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handlePassthrough(conn)
+	}
+}
+
+func (s *Handler) handlePassthrough(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	serverName, hello, err := peekServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		s.l.Debug("tls passthrough: no server name", "remote", conn.RemoteAddr().String(), "error", err.Error())
+		conn.Close()
+		return
+	}
+
+	name, ok := strings.CutSuffix(strings.ToLower(serverName), "."+s.options.Hostname)
+	if !ok || strings.Contains(name, ".") {
+		s.l.Debug("tls passthrough: unknown server name", "server_name", serverName)
+		conn.Close()
+		return
+	}
+	pool, ok := s.tunnels.Get(name)
+	if !ok || !pool.passthrough() {
+		s.l.Debug("tls passthrough: tunnel not found", "name", name)
+		conn.Close()
+		return
+	}
+	if !pool.allows(addrIP(conn.RemoteAddr())) {
+		s.l.Debug("tls passthrough: visitor not allowed", "name", name, "remote", conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+	tunnel, ok := pool.pick()
+	if !ok {
+		conn.Close()
+		return
+	}
+	tunnel.serveTCP(&peekedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(hello), conn)})
+}
+
+// peekServerName reads the TLS ClientHello from conn and returns the server
+// name it asks for, along with the bytes read, which must be replayed to
+// the target ahead of the rest of the connection.
+func peekServerName(conn net.Conn) (string, []byte, error) {
+	var (
+		hello      bytes.Buffer
+		serverName string
+	)
+	// The handshake is abandoned as soon as the hello is parsed; nothing is
+	// ever written back to the visitor.
+	tls.Server(&peekedConn{Conn: conn, r: io.TeeReader(conn, &hello), readOnly: true}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = info.ServerName
+			return nil, errNoServerName
+		},
+	}).Handshake()
+	if serverName == "" {
+		return "", nil, errNoServerName
+	}
+	return serverName, hello.Bytes(), nil
+}
+
+// peekedConn reads from r in place of the connection itself.
+type peekedConn struct {
+	net.Conn
+	r        io.Reader
+	readOnly bool
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *peekedConn) Write(p []byte) (int, error) {
+	if c.readOnly {
+		return 0, io.ErrClosedPipe
+	}
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,342 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/campbel/tiny-tunnel/internal/log"
+	"github.com/google/uuid"
+)
+
+// maxPoolConnections caps how many connections can serve one tunnel.
+const maxPoolConnections = 16
+
+// maxRegisterAttempts bounds how often a registration goes back for a name
+// that keeps being held by a closing pool.
+const maxRegisterAttempts = 5
+
+var (
+	errNameTaken  = errors.New("name is already used")
+	errResumeOnly = errors.New("name is reserved for the tunnel that dropped it")
+	errPoolFull   = errors.New("too many connections for tunnel")
+	errPoolClosed = errors.New("tunnel is closing")
+	errWrongMode  = errors.New("name is used by a different kind of tunnel")
+)
+
+// tunnelMode is what a tunnel serves: HTTP, a public TCP or UDP port, TLS
+// passthrough connections, or `tnl connect` connections.
+type tunnelMode string
+
+const (
+	modeHTTP    tunnelMode = "http"
+	modeTCP     tunnelMode = "tcp"
+	modeUDP     tunnelMode = "udp"
+	modeTLS     tunnelMode = "tls"
+	modePrivate tunnelMode = "private"
+)
+
+// tunnelPool is the set of client connections registered under one tunnel
+// name. Clients started with several connections present the same pool key
+// on each of them; requests are spread across the members round-robin and a
+// member that drops is simply skipped until it leaves.
+//
+// Once the last member leaves the pool may be held empty for a grace
+// period, during which only a client presenting the resume token can join.
+type tunnelPool struct {
+	id  string
+	key string
+	// mode is fixed by the connection that created the pool; the others
+	// must ask for the same.
+	mode tunnelMode
+	// token is the resume token handed out in the RegisterAck.
+	token string
+
+	mu      sync.Mutex
+	members []*Tunnel
+	next    int
+	closed  bool
+	// expiry ends the grace period of an empty pool; resumeBy is when.
+	expiry   *time.Timer
+	resumeBy time.Time
+	// tcp is the public port of a TCP tunnel.
+	tcp net.Listener
+	// udp serves the public port of a UDP tunnel.
+	udp *udpRelay
+	// tls is set for tunnels that take TLS passthrough connections.
+	tls bool
+	// private is set for tunnels only reachable through /connect, by the
+	// users it lets in.
+	private *privateAccess
+	// allow is the networks visitors must come from; empty allows all.
+	allow Networks
+	// gone is closed once the pool no longer holds its name.
+	gone chan struct{}
+}
+
+func newTunnelPool(key string, mode tunnelMode, first *Tunnel) *tunnelPool {
+	return &tunnelPool{
+		id:      uuid.New().String(),
+		key:     key,
+		mode:    mode,
+		token:   uuid.New().String(),
+		members: []*Tunnel{first},
+		gone:    make(chan struct{}),
+	}
+}
+
+// join adds t to the pool if key matches the key the pool was created
+// with and t asks for the same mode. Clients that did not ask for a pool
+// can never be joined. A pool held after its last member left can only be
+// resumed with its token.
+func (p *tunnelPool) join(key, token string, mode tunnelMode, t *Tunnel) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.closed:
+		return errPoolClosed
+	case len(p.members) == 0:
+		if token != p.token {
+			return errResumeOnly
+		}
+	case p.key == "" || key != p.key:
+		return errNameTaken
+	case len(p.members) >= maxPoolConnections:
+		return errPoolFull
+	}
+	if mode != p.mode {
+		return errWrongMode
+	}
+	if p.expiry != nil {
+		p.expiry.Stop()
+		p.expiry = nil
+	}
+	p.members = append(p.members, t)
+	return nil
+}
+
+// leave removes t from the pool. When t was the last member the pool is
+// closed to further joins, right away if grace is zero, otherwise once grace
+// passes without the client resuming, at which point expired is called.
+// leave reports whether the pool was closed right away.
+func (p *tunnelPool) leave(t *Tunnel, grace time.Duration, expired func()) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, member := range p.members {
+		if member == t {
+			p.members = append(p.members[:i], p.members[i+1:]...)
+			break
+		}
+	}
+	if len(p.members) > 0 {
+		return false
+	}
+	if grace <= 0 {
+		p.closed = true
+		return true
+	}
+
+	var expiry *time.Timer
+	expiry = time.AfterFunc(grace, func() {
+		p.mu.Lock()
+		// A timer stopped too late must not close a resumed pool.
+		if p.expiry != expiry {
+			p.mu.Unlock()
+			return
+		}
+		p.closed = true
+		p.mu.Unlock()
+		expired()
+	})
+	p.expiry = expiry
+	p.resumeBy = time.Now().Add(grace)
+	return false
+}
+
+// release marks the pool as no longer holding its name, waking the
+// registrations waiting for it.
+func (p *tunnelPool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.gone:
+	default:
+		close(p.gone)
+	}
+}
+
+// listenTCP opens the public port of a TCP tunnel, unless a connection that
+// registered earlier already did, and relays the connections accepted on it
+// through the members.
+func (p *tunnelPool) listenTCP(ports PortRange, port int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tcp != nil {
+		return nil
+	}
+	if !ports.enabled() {
+		return errTCPDisabled
+	}
+	ln, err := ports.listen(port)
+	if err != nil {
+		return err
+	}
+	p.tcp = ln
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if !p.allows(addrIP(conn.RemoteAddr())) {
+				conn.Close()
+				continue
+			}
+			tunnel, ok := p.pick()
+			if !ok {
+				conn.Close()
+				continue
+			}
+			go tunnel.serveTCP(conn)
+		}
+	}()
+	return nil
+}
+
+// listenUDP opens the public port of a UDP tunnel, unless a connection that
+// registered earlier already did, and relays the datagrams received on it
+// through the members.
+func (p *tunnelPool) listenUDP(ports PortRange, port int, idle time.Duration, l log.Logger) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.udp != nil {
+		return nil
+	}
+	if !ports.enabled() {
+		return errUDPDisabled
+	}
+	conn, err := ports.listenPacket(port)
+	if err != nil {
+		return err
+	}
+	p.udp = newUDPRelay(conn, p, idle, l)
+	return nil
+}
+
+// enablePassthrough routes TLS passthrough connections to the pool.
+func (p *tunnelPool) enablePassthrough() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tls = true
+}
+
+// passthrough reports whether the pool takes TLS passthrough connections.
+func (p *tunnelPool) passthrough() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.tls
+}
+
+// setAllowlist restricts the pool's visitors to those from allow.
+func (p *tunnelPool) setAllowlist(allow Networks) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.allow = allow
+}
+
+// allows reports whether a visitor from ip may reach the pool.
+func (p *tunnelPool) allows(ip net.IP) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.allow) == 0 || p.allow.contains(ip)
+}
+
+// access returns who may connect to a private pool, or nil for a public
+// one.
+func (p *tunnelPool) access() *privateAccess {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.private
+}
+
+// tcpPort returns the public port of a TCP tunnel, or zero.
+func (p *tunnelPool) tcpPort() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tcp == nil {
+		return 0
+	}
+	return p.tcp.Addr().(*net.TCPAddr).Port
+}
+
+// udpPort returns the public port of a UDP tunnel, or zero.
+func (p *tunnelPool) udpPort() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.udp == nil {
+		return 0
+	}
+	return p.udp.port()
+}
+
+// closePorts closes the public port of a TCP or UDP tunnel.
+func (p *tunnelPool) closePorts() {
+	p.mu.Lock()
+	tcp, udp := p.tcp, p.udp
+	p.mu.Unlock()
+	if tcp != nil {
+		tcp.Close()
+	}
+	if udp != nil {
+		udp.close()
+	}
+}
+
+// resuming reports whether the pool is empty and waiting for its client to
+// resume it, and how long it will wait.
+func (p *tunnelPool) resuming() (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || len(p.members) > 0 {
+		return 0, false
+	}
+	return time.Until(p.resumeBy), true
+}
+
+// pick returns the next open member, round-robin. Members that are
+// draining are only used when no other member is left.
+func (p *tunnelPool) pick() (*Tunnel, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var fallback *Tunnel
+	for range p.members {
+		t := p.members[p.next%len(p.members)]
+		p.next++
+		if t.tunnel.IsClosed() {
+			continue
+		}
+		if !t.draining.Load() {
+			return t, true
+		}
+		if fallback == nil {
+			fallback = t
+		}
+	}
+	return fallback, fallback != nil
+}
+
+// all returns a snapshot of the members.
+func (p *tunnelPool) all() []*Tunnel {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.members)
+}
+
+// size returns the number of members.
+func (p *tunnelPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.members)
+}
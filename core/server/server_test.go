@@ -1,25 +1,97 @@
 package server_test
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/campbel/tiny-tunnel/core/client"
+	"github.com/campbel/tiny-tunnel/core/protocol"
 	"github.com/campbel/tiny-tunnel/core/server"
+	"github.com/campbel/tiny-tunnel/core/shared"
 	"github.com/campbel/tiny-tunnel/core/stats"
 	"github.com/campbel/tiny-tunnel/internal/log"
 	"github.com/campbel/tiny-tunnel/internal/util"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
+// serveTunnels starts a tunnel server for the length of the test.
+func serveTunnels(t *testing.T, options server.Options) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(server.NewHandler(options, log.NewTestLogger()))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// serveAuthedTunnels starts a tunnel server that requires authentication,
+// and returns it with a function minting tokens for a user.
+func serveAuthedTunnels(t *testing.T) (*httptest.Server, func(sub, email string) string) {
+	t.Helper()
+	guardian, mint, _ := server.StartFakeGuardian(t)
+	tunnels := serveTunnels(t, server.Options{
+		Hostname:         "example.com",
+		EnableAuth:       true,
+		GuardianURL:      guardian.URL,
+		GuardianAudience: "svc_tiny-tunnel_stable",
+	})
+	token := func(sub, email string) string {
+		claims := server.ValidClaims(guardian.URL)
+		claims["sub"] = sub
+		claims["email"] = email
+		return mint(claims)
+	}
+	return tunnels, token
+}
+
+// tunnelOptions points client options at a test server.
+func tunnelOptions(server *httptest.Server, options client.Options) client.Options {
+	serverURL, _ := url.Parse(server.URL)
+	options.ServerHost = serverURL.Hostname()
+	options.ServerPort = serverURL.Port()
+	options.Insecure = true
+	options.OutputWriter = io.Discard
+	return options
+}
+
+// dialTunnel connects a client tunnel to server without waiting for it
+// to register. The tunnel is closed when the test ends.
+func dialTunnel(t *testing.T, server *httptest.Server, options client.Options) (*shared.Tunnel, *stats.TunnelState) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	state := stats.NewTunnelState(options.Target, options.Name)
+	tunnel, err := client.NewTunnel(ctx, tunnelOptions(server, options), state, stats.NewTestStatsProvider(), log.NewTestLogger())
+	require.NoError(t, err)
+	go tunnel.Listen(ctx)
+	return tunnel, state
+}
+
+// startTunnel serves a tunnel server and registers a client tunnel with
+// it.
+func startTunnel(t *testing.T, serverOptions server.Options, clientOptions client.Options) (*httptest.Server, *stats.TunnelState) {
+	t.Helper()
+	server := serveTunnels(t, serverOptions)
+	_, state := dialTunnel(t, server, clientOptions)
+	require.Eventually(t, func() bool { return state.GetURL() != "" }, 5*time.Second, 10*time.Millisecond)
+	return server, state
+}
+
 func TestServerRoot(t *testing.T) {
 	assert := assert.New(t)
 
@@ -95,6 +167,8 @@ func TestServerConnectWithClient(t *testing.T) {
 	if !assert.NoError(err) {
 		return
 	}
+	assert.True(client.Capabilities().Has(protocol.FeatureBinaryFrames), "binary frames should be negotiated")
+	assert.Equal(protocol.EncodingBinary, client.Encoding())
 
 	go client.Listen(ctx)
 
@@ -179,3 +253,1329 @@ func TestServerTunnel(t *testing.T) {
 	response := recorder.Result()
 	assert.Equal(http.StatusOK, response.StatusCode)
 }
+
+func TestServerRegisterAck(t *testing.T) {
+	assert := assert.New(t)
+
+	appServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer appServer.Close()
+
+	server, state := startTunnel(t, server.Options{
+		Hostname:            "example.com",
+		AccessScheme:        "http",
+		MaxRequestBodyBytes: 16,
+	}, client.Options{
+		Name:   "acked",
+		Target: appServer.URL,
+	})
+	registration := state.GetRegistration()
+	assert.Equal("http://acked.example.com", state.GetURL())
+	assert.Equal([]string{"http://acked.example.com"}, registration.URLs)
+	assert.NotEmpty(registration.TunnelID)
+	assert.NotEmpty(registration.ServerVersion)
+	assert.Equal(int64(16), registration.MaxRequestBodyBytes)
+
+	// The advertised body limit is enforced.
+	request, _ := http.NewRequest("POST", server.URL, strings.NewReader(strings.Repeat("x", 17)))
+	request.Host = "acked.example.com"
+	response, err := http.DefaultClient.Do(request)
+	if assert.NoError(err) {
+		response.Body.Close()
+		assert.Equal(http.StatusRequestEntityTooLarge, response.StatusCode)
+	}
+
+	request, _ = http.NewRequest("POST", server.URL, strings.NewReader(strings.Repeat("x", 16)))
+	request.Host = "acked.example.com"
+	response, err = http.DefaultClient.Do(request)
+	if assert.NoError(err) {
+		response.Body.Close()
+		assert.Equal(http.StatusNoContent, response.StatusCode)
+	}
+}
+
+func TestServerConnectionPool(t *testing.T) {
+	assert := assert.New(t)
+
+	appServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer appServer.Close()
+
+	// A free port, for a connection that asks for TCP.
+	probe, err := net.Listen("tcp", ":0")
+	if !assert.NoError(err) {
+		return
+	}
+	port := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+
+	server := serveTunnels(t, server.Options{
+		Hostname: "example.com",
+		TCPPorts: server.PortRange{First: port, Last: port},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	connect := func(poolKey string) (*shared.Tunnel, *stats.TestStatsProvider, *stats.TunnelState) {
+		statsProvider := stats.NewTestStatsProvider()
+		state := stats.NewTunnelState(appServer.URL, "pooled")
+		tunnel, err := client.NewTunnel(ctx, tunnelOptions(server, client.Options{
+			Name:    "pooled",
+			Target:  appServer.URL,
+			PoolKey: poolKey,
+		}), state, statsProvider, log.NewTestLogger())
+		if !assert.NoError(err) {
+			t.FailNow()
+		}
+		go tunnel.Listen(ctx)
+		return tunnel, statsProvider, state
+	}
+	get := func() int {
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		request.Host = "pooled.example.com"
+		response, err := http.DefaultClient.Do(request)
+		if !assert.NoError(err) {
+			return 0
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	first, firstStats, firstState := connect("secret")
+	_, secondStats, secondState := connect("secret")
+	assert.Eventually(func() bool {
+		return firstState.GetURL() != "" && secondState.GetURL() != ""
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(firstState.GetRegistration().TunnelID, secondState.GetRegistration().TunnelID)
+
+	// Requests are spread across both connections.
+	for i := 0; i < 10; i++ {
+		assert.Equal(http.StatusOK, get())
+	}
+	assert.Equal(5, firstStats.GetHttpStats().TotalRequests)
+	assert.Equal(5, secondStats.GetHttpStats().TotalRequests)
+
+	// A connection without the pool key cannot take over the name.
+	intruder, _, _ := connect("guess")
+	select {
+	case <-intruder.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("intruder connection was not refused")
+	}
+
+	// Nor can one with the key open a port for the HTTP tunnel.
+	tcp, _ := dialTunnel(t, server, client.Options{
+		Name:    "pooled",
+		TCPAddr: appServer.Listener.Addr().String(),
+		PoolKey: "secret",
+	})
+	select {
+	case <-tcp.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("TCP connection joined an HTTP tunnel")
+	}
+	if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+		conn.Close()
+		t.Error("TCP connection opened a port for an HTTP tunnel")
+	}
+
+	// When one connection drops the other carries on.
+	first.Close()
+	for i := 0; i < 4; i++ {
+		assert.Equal(http.StatusOK, get())
+	}
+	assert.Equal(9, secondStats.GetHttpStats().TotalRequests)
+}
+
+func TestServerTargetErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	// A port nothing listens on.
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	server, _ := startTunnel(t, server.Options{
+		Hostname: "example.com",
+	}, client.Options{
+		Name:   "refused",
+		Target: closed.URL,
+	})
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	request.Host = "refused.example.com"
+	response, err := http.DefaultClient.Do(request)
+	if !assert.NoError(err) {
+		return
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	assert.Equal(http.StatusServiceUnavailable, response.StatusCode)
+	assert.Equal("tunnel target refused the connection\n", string(body))
+
+	// Websockets are refused with the same status, before the upgrade.
+	wsURL, err := util.GetWebsocketURL(server.URL)
+	if !assert.NoError(err) {
+		return
+	}
+	_, response, err = websocket.DefaultDialer.Dial(wsURL.String(), http.Header{"X-TT-Tunnel": {"refused"}})
+	assert.ErrorIs(err, websocket.ErrBadHandshake)
+	if assert.NotNil(response) {
+		body, _ := io.ReadAll(response.Body)
+		assert.Equal(http.StatusServiceUnavailable, response.StatusCode)
+		assert.Equal("tunnel target refused the connection\n", string(body))
+	}
+}
+
+func TestServerDeadlines(t *testing.T) {
+	assert := assert.New(t)
+
+	targetDone := make(chan struct{}, 2)
+	appServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() { targetDone <- struct{}{} }()
+		if r.URL.Path == "/stalled-stream" {
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, "first")
+			w.(http.Flusher).Flush()
+		}
+		<-r.Context().Done()
+	}))
+	defer appServer.Close()
+
+	server, _ := startTunnel(t, server.Options{
+		Hostname:              "example.com",
+		ResponseHeaderTimeout: 200 * time.Millisecond,
+		IdleTimeout:           200 * time.Millisecond,
+	}, client.Options{
+		Name:   "slow",
+		Target: appServer.URL,
+	})
+
+	get := func(path string) (*http.Response, string) {
+		request, _ := http.NewRequest("GET", server.URL+path, nil)
+		request.Host = "slow.example.com"
+		response, err := http.DefaultClient.Do(request)
+		if !assert.NoError(err) {
+			t.FailNow()
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		return response, string(body)
+	}
+
+	// No response head in time.
+	response, body := get("/stalled")
+	assert.Equal(http.StatusGatewayTimeout, response.StatusCode)
+	assert.Equal("tunnel target timed out\n", body)
+	select {
+	case <-targetDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("target request was not cancelled")
+	}
+
+	// A streamed response that goes quiet is cut off.
+	response, body = get("/stalled-stream")
+	assert.Equal(http.StatusOK, response.StatusCode)
+	assert.Equal("first", body)
+	select {
+	case <-targetDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("target stream was not cancelled")
+	}
+}
+
+// watchedBody notes reads of a request body that finish after its handler
+// has returned.
+type watchedBody struct {
+	io.ReadCloser
+	returned atomic.Bool
+	late     atomic.Bool
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.returned.Load() {
+		b.late.Store(true)
+	}
+	return n, err
+}
+
+func TestServerEarlyResponseEndsUpload(t *testing.T) {
+	assert := assert.New(t)
+
+	// The target answers without waiting for the upload.
+	appServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "too large", http.StatusRequestEntityTooLarge)
+	}))
+	defer appServer.Close()
+
+	handler := server.NewHandler(server.Options{Hostname: "example.com"}, log.NewTestLogger())
+	bodies := make(chan *watchedBody, 2)
+	tunnels := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			body := &watchedBody{ReadCloser: r.Body}
+			r.Body = body
+			defer func() { bodies <- body }()
+			defer body.returned.Store(true)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer tunnels.Close()
+	_, state := dialTunnel(t, tunnels, client.Options{Name: "early", Target: appServer.URL})
+	require.Eventually(t, func() bool { return state.GetURL() != "" }, 5*time.Second, 10*time.Millisecond)
+
+	// The visitor keeps uploading until it is cut off.
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() {
+		chunk := strings.Repeat("x", 1024)
+		for {
+			if _, err := io.WriteString(pw, chunk); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	req, err := http.NewRequest(http.MethodPost, tunnels.URL+"/upload", pr)
+	if !assert.NoError(err) {
+		return
+	}
+	req.Host = "early.example.com"
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	var body *watchedBody
+	select {
+	case body = <-bodies:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler did not return")
+	}
+	// Give an upload left running the chance to read on.
+	time.Sleep(100 * time.Millisecond)
+	assert.False(body.late.Load(), "request body read after the handler returned")
+}
+
+func TestServerShutdownDrainsTunnels(t *testing.T) {
+	assert := assert.New(t)
+
+	received := make(chan struct{})
+	release := make(chan struct{})
+	appServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(received)
+			<-release
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer appServer.Close()
+
+	// Two servers behind one address, as in a rolling deploy.
+	oldServer := server.NewHandler(server.Options{Hostname: "example.com"}, log.NewTestLogger())
+	newServer := server.NewHandler(server.Options{Hostname: "example.com"}, log.NewTestLogger())
+	var current atomic.Pointer[server.Handler]
+	current.Store(oldServer)
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current.Load().ServeHTTP(w, r)
+	}))
+	defer front.Close()
+
+	frontURL, err := url.Parse(front.URL)
+	if !assert.NoError(err) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state := stats.NewTunnelState(appServer.URL, "deploy")
+	go client.Run(ctx, client.Options{
+		Name:              "deploy",
+		ServerHost:        frontURL.Hostname(),
+		ServerPort:        frontURL.Port(),
+		Insecure:          true,
+		Target:            appServer.URL,
+		ReconnectAttempts: 1,
+		OutputWriter:      io.Discard,
+	}, state, stats.NewTestStatsProvider(), log.NewTestLogger())
+	assert.Eventually(func() bool { return state.GetURL() != "" }, 5*time.Second, 10*time.Millisecond)
+
+	get := func(path string) (int, string) {
+		request, _ := http.NewRequest("GET", front.URL+path, nil)
+		request.Host = "deploy.example.com"
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return response.StatusCode, string(body)
+	}
+
+	slow := make(chan string, 1)
+	go func() {
+		_, body := get("/slow")
+		slow <- body
+	}()
+	<-received
+
+	current.Store(newServer)
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		shutdown <- oldServer.Shutdown(shutdownCtx)
+	}()
+
+	// The client moves to the new server right away, while the old one
+	// still serves the request in flight.
+	assert.Eventually(func() bool {
+		status, _ := get("/")
+		return status == http.StatusOK
+	}, time.Second, 10*time.Millisecond)
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned with a request in flight: %v", err)
+	default:
+	}
+
+	close(release)
+	assert.Equal("ok", <-slow)
+	select {
+	case err := <-shutdown:
+		assert.NoError(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not finish after the request completed")
+	}
+}
+
+func TestServerResumeTunnel(t *testing.T) {
+	assert := assert.New(t)
+
+	appServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer appServer.Close()
+
+	server := serveTunnels(t, server.Options{
+		Hostname:          "example.com",
+		ResumeGracePeriod: 2 * time.Second,
+	})
+
+	connect := func(resumeToken string) (*shared.Tunnel, *stats.TunnelState) {
+		return dialTunnel(t, server, client.Options{
+			Name:        "resumable",
+			Target:      appServer.URL,
+			ResumeToken: resumeToken,
+		})
+	}
+	get := func() *http.Response {
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		request.Host = "resumable.example.com"
+		response, err := http.DefaultClient.Do(request)
+		if !assert.NoError(err) {
+			t.FailNow()
+		}
+		response.Body.Close()
+		return response
+	}
+
+	tunnel, state := connect("")
+	assert.Eventually(func() bool { return state.GetURL() != "" }, 5*time.Second, 10*time.Millisecond)
+	token := state.GetRegistration().ResumeToken
+	assert.NotEmpty(token)
+
+	// While the client is away visitors are asked to come back, and the
+	// name is not up for grabs.
+	tunnel.Close()
+	assert.Eventually(func() bool { return get().StatusCode == http.StatusServiceUnavailable }, time.Second, 10*time.Millisecond)
+	assert.NotEmpty(get().Header.Get("Retry-After"))
+
+	intruder, _ := connect("")
+	select {
+	case <-intruder.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("intruder took a reserved name")
+	}
+
+	// The token takes the name back.
+	tunnel, state = connect(token)
+	assert.Eventually(func() bool { return state.GetURL() != "" }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(token, state.GetRegistration().ResumeToken)
+	assert.Equal(http.StatusOK, get().StatusCode)
+
+	// Unclaimed names are freed once the grace period is over.
+	tunnel.Close()
+	assert.Eventually(func() bool { return get().StatusCode == http.StatusNotFound }, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestServerTCPTunnel(t *testing.T) {
+	assert := assert.New(t)
+
+	// The target greets first, like SSH, then echoes.
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(err) {
+		return
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				fmt.Fprint(conn, "hi\n")
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// Find a free port for the tunnel.
+	probe, err := net.Listen("tcp", ":0")
+	if !assert.NoError(err) {
+		return
+	}
+	port := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+
+	_, state := startTunnel(t, server.Options{
+		Hostname: "example.com",
+		TCPPorts: server.PortRange{First: port, Last: port},
+	}, client.Options{
+		Name:    "db",
+		TCPAddr: target.Addr().String(),
+	})
+	assert.Equal(fmt.Sprintf("tcp://example.com:%d", port), state.GetURL())
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if !assert.NoError(err) {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	line, err := reader.ReadString('\n')
+	assert.NoError(err)
+	assert.Equal("hi\n", line)
+
+	payload := strings.Repeat("x", 1<<20) + "\n"
+	go fmt.Fprint(conn, payload)
+	line, err = reader.ReadString('\n')
+	assert.NoError(err)
+	assert.Equal(payload, line)
+}
+
+func TestServerUDPTunnel(t *testing.T) {
+	assert := assert.New(t)
+
+	target, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(err) {
+		return
+	}
+	defer target.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := target.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			target.WriteTo(append([]byte("echo:"), buf[:n]...), addr)
+		}
+	}()
+
+	// Find a free port for the tunnel.
+	probe, err := net.ListenPacket("udp", ":0")
+	if !assert.NoError(err) {
+		return
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	_, state := startTunnel(t, server.Options{
+		Hostname:       "example.com",
+		UDPPorts:       server.PortRange{First: port, Last: port},
+		UDPIdleTimeout: 100 * time.Millisecond,
+	}, client.Options{
+		Name:    "game",
+		UDPAddr: target.LocalAddr().String(),
+	})
+	assert.Equal(fmt.Sprintf("udp://example.com:%d", port), state.GetURL())
+
+	// Each visitor gets its own replies.
+	exchange := func(conn net.Conn, msg string) string {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			return err.Error()
+		}
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err.Error()
+		}
+		return string(buf[:n])
+	}
+	alice, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", port))
+	if !assert.NoError(err) {
+		return
+	}
+	defer alice.Close()
+	bob, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", port))
+	if !assert.NoError(err) {
+		return
+	}
+	defer bob.Close()
+
+	assert.Equal("echo:alice", exchange(alice, "alice"))
+	assert.Equal("echo:bob", exchange(bob, "bob"))
+
+	// A visitor whose session expired starts a new one.
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal("echo:again", exchange(alice, "again"))
+}
+
+func TestServerPrivateTunnel(t *testing.T) {
+	assert := assert.New(t)
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(err) {
+		return
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	tunnels, token := serveAuthedTunnels(t)
+	options := tunnelOptions(tunnels, client.Options{
+		Name:    "db",
+		Token:   token("user-1", "ada@example.com"),
+		TCPAddr: target.Addr().String(),
+		Private: true,
+		Share:   []string{"grace@example.com"},
+	})
+	_, state := dialTunnel(t, tunnels, options)
+	assert.Eventually(func() bool { return state.GetURL() != "" }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal("private://db", state.GetURL())
+
+	// Not routed publicly.
+	req, _ := http.NewRequest("GET", tunnels.URL, nil)
+	req.Header.Set("X-TT-Tunnel", "db")
+	resp, err := http.DefaultClient.Do(req)
+	if assert.NoError(err) {
+		resp.Body.Close()
+		assert.Equal(http.StatusNotFound, resp.StatusCode)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(err) {
+		return
+	}
+	go client.Connect(ctx, options, local, log.NewTestLogger())
+
+	conn, err := net.Dial("tcp", local.Addr().String())
+	if !assert.NoError(err) {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	payload := strings.Repeat("x", 1<<20) + "\n"
+	go fmt.Fprint(conn, payload)
+	line, err := reader.ReadString('\n')
+	assert.NoError(err)
+	assert.Equal(payload, line)
+
+	// The users it is shared with can connect too, and nobody else.
+	teammate := tunnelOptions(tunnels, client.Options{Name: "db", Token: token("user-2", "grace@example.com")})
+	remote, err := client.DialPrivate(ctx, teammate, "")
+	if assert.NoError(err) {
+		remote.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprint(remote, "hello\n")
+		line, err := bufio.NewReader(remote).ReadString('\n')
+		assert.NoError(err)
+		assert.Equal("hello\n", line)
+		remote.Close()
+	}
+	stranger := tunnelOptions(tunnels, client.Options{Name: "db", Token: token("user-3", "eve@example.com")})
+	_, err = client.DialPrivate(ctx, stranger, "")
+	assert.ErrorContains(err, "403")
+
+	// Only private tunnels can be connected to.
+	_, err = client.DialPrivate(ctx, tunnelOptions(tunnels, client.Options{Name: "nope", Token: options.Token}), "")
+	assert.ErrorContains(err, "404")
+
+	// A server that does not authenticate cannot tell users apart, so it
+	// refuses private tunnels.
+	open := serveTunnels(t, server.Options{
+		Hostname: "example.com",
+	})
+	refused, state := dialTunnel(t, open, client.Options{
+		Name:    "db",
+		TCPAddr: target.Addr().String(),
+		Private: true,
+	})
+	select {
+	case <-refused.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("private tunnel registered without authentication")
+	}
+	assert.Empty(state.GetURL())
+}
+
+func TestServerEgressProxy(t *testing.T) {
+	assert := assert.New(t)
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(err) {
+		return
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	tunnels, token := serveAuthedTunnels(t)
+	options := tunnelOptions(tunnels, client.Options{
+		Name:        "lab",
+		Token:       token("user-1", "ada@example.com"),
+		Private:     true,
+		EgressProxy: true,
+		EgressAllow: []string{"127.0.0.1"},
+		Share:       []string{"grace@example.com"},
+	})
+	_, state := dialTunnel(t, tunnels, options)
+	assert.Eventually(func() bool { return state.GetURL() != "" }, 5*time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serveProxy := func(token string) string {
+		proxy, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assert.NoError(err) {
+			t.FailNow()
+		}
+		go client.ServeProxy(ctx, tunnelOptions(tunnels, client.Options{Name: "lab", Token: token}), proxy, log.NewTestLogger())
+		return proxy.Addr().String()
+	}
+	proxy := serveProxy(options.Token)
+
+	// socks asks the proxy at proxyAddr for addr and returns the reply
+	// code, with the connection on success.
+	socks := func(t *testing.T, proxyAddr string, addr *net.TCPAddr) (net.Conn, byte) {
+		conn, err := net.Dial("tcp", proxyAddr)
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		conn.Write([]byte{5, 1, 0})
+		reply := make([]byte, 2)
+		_, err = io.ReadFull(conn, reply)
+		assert.NoError(err)
+		assert.Equal([]byte{5, 0}, reply)
+
+		request := append([]byte{5, 1, 0, 1}, addr.IP.To4()...)
+		request = append(request, byte(addr.Port>>8), byte(addr.Port))
+		conn.Write(request)
+		reply = make([]byte, 10)
+		_, err = io.ReadFull(conn, reply)
+		assert.NoError(err)
+		if reply[1] != 0 {
+			conn.Close()
+			return nil, reply[1]
+		}
+		return conn, 0
+	}
+	connect := func(t *testing.T, addr string) (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := net.Dial("tcp", proxy)
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		return conn, reader, resp
+	}
+
+	targetAddr := target.Addr().(*net.TCPAddr)
+	// Allowed, but nothing listens there.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(err) {
+		return
+	}
+	closed.Close()
+	closedAddr := closed.Addr().(*net.TCPAddr)
+	outside := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80}
+
+	t.Run("socks5", func(t *testing.T) {
+		conn, code := socks(t, proxy, targetAddr)
+		if !assert.Equal(byte(0), code) {
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprint(conn, "ping\n")
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		assert.NoError(err)
+		assert.Equal("ping\n", line)
+	})
+
+	t.Run("connect", func(t *testing.T) {
+		conn, reader, resp := connect(t, target.Addr().String())
+		defer conn.Close()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+
+		fmt.Fprint(conn, "pong\n")
+		line, err := reader.ReadString('\n')
+		assert.NoError(err)
+		assert.Equal("pong\n", line)
+	})
+
+	// Failures are reported before anything is relayed.
+	t.Run("outside allowlist", func(t *testing.T) {
+		_, code := socks(t, proxy, outside)
+		assert.Equal(byte(2), code)
+
+		conn, _, resp := connect(t, outside.String())
+		defer conn.Close()
+		assert.Equal(http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		_, code := socks(t, proxy, closedAddr)
+		assert.Equal(byte(5), code)
+
+		conn, _, resp := connect(t, closedAddr.String())
+		defer conn.Close()
+		assert.Equal(http.StatusBadGateway, resp.StatusCode)
+	})
+
+	t.Run("shared", func(t *testing.T) {
+		conn, code := socks(t, serveProxy(token("user-2", "grace@example.com")), targetAddr)
+		if assert.Equal(byte(0), code) {
+			conn.Close()
+		}
+
+		_, code = socks(t, serveProxy(token("user-3", "eve@example.com")), targetAddr)
+		assert.Equal(byte(2), code)
+	})
+}
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    server.PortRange
+		wantErr bool
+	}{
+		{"", server.PortRange{}, false},
+		{"20000-20100", server.PortRange{First: 20000, Last: 20100}, false},
+		{"5432", server.PortRange{First: 5432, Last: 5432}, false},
+		{"20100-20000", server.PortRange{}, true},
+		{"0-10", server.PortRange{}, true},
+		{"a-b", server.PortRange{}, true},
+	}
+	for _, tt := range tests {
+		got, err := server.ParsePortRange(tt.in)
+		if tt.wantErr {
+			assert.Error(t, err, tt.in)
+			continue
+		}
+		assert.NoError(t, err, tt.in)
+		assert.Equal(t, tt.want, got, tt.in)
+	}
+}
+
+func TestServerTLSPassthrough(t *testing.T) {
+	assert := assert.New(t)
+
+	appServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "secret")
+	}))
+	defer appServer.Close()
+
+	passthrough, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(err) {
+		return
+	}
+	defer passthrough.Close()
+
+	handler := server.NewHandler(server.Options{
+		Hostname:           "example.com",
+		TLSPassthroughAddr: passthrough.Addr().String(),
+	}, log.NewTestLogger())
+	go handler.ServeTLSPassthrough(passthrough)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	_, state := dialTunnel(t, server, client.Options{
+		Name:           "secure",
+		TCPAddr:        appServer.Listener.Addr().String(),
+		TLSPassthrough: true,
+	})
+	assert.Eventually(func() bool { return state.GetURL() != "" }, 5*time.Second, 10*time.Millisecond)
+	_, port, _ := net.SplitHostPort(passthrough.Addr().String())
+	assert.Equal("https://secure.example.com:"+port, state.GetURL())
+
+	visitor := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial(network, passthrough.Addr().String())
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+
+	// TLS is terminated by the target itself.
+	response, err := visitor.Get("https://secure.example.com/")
+	if assert.NoError(err) {
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		assert.Equal("secret", string(body))
+		assert.Equal(appServer.Certificate().Raw, response.TLS.PeerCertificates[0].Raw)
+	}
+
+	// Names without a passthrough tunnel are hung up on.
+	_, err = visitor.Get("https://unknown.example.com/")
+	assert.Error(err)
+}
+
+func TestServerUpgrade(t *testing.T) {
+	assert := assert.New(t)
+
+	// The target switches to a line echo protocol, and declines anything
+	// else.
+	appServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo/1" {
+			http.Error(w, "unsupported upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo/1\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	}))
+	defer appServer.Close()
+
+	server, _ := startTunnel(t, server.Options{
+		Hostname: "example.com",
+	}, client.Options{
+		Name:   "test",
+		Target: appServer.URL,
+	})
+
+	upgrade := func(protocol string) (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if !assert.NoError(err) {
+			return nil, nil, nil
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		// The first bytes of the new protocol go out with the request.
+		fmt.Fprintf(conn, "GET /stream?x=1 HTTP/1.1\r\nHost: test.example.com\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\nhello\n", protocol)
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if !assert.NoError(err) {
+			conn.Close()
+			return nil, nil, nil
+		}
+		return conn, reader, resp
+	}
+
+	t.Run("switches protocols", func(t *testing.T) {
+		conn, reader, resp := upgrade("echo/1")
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		assert.Equal(http.StatusSwitchingProtocols, resp.StatusCode)
+		assert.Equal("echo/1", resp.Header.Get("Upgrade"))
+
+		line, err := reader.ReadString('\n')
+		assert.NoError(err)
+		assert.Equal("hello\n", line)
+
+		payload := strings.Repeat("x", 1<<20) + "\n"
+		go fmt.Fprint(conn, payload)
+		line, err = reader.ReadString('\n')
+		assert.NoError(err)
+		assert.Equal(payload, line)
+	})
+
+	t.Run("declined", func(t *testing.T) {
+		conn, _, resp := upgrade("other/1")
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		assert.Equal(http.StatusBadRequest, resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal("unsupported upgrade\n", string(body))
+	})
+}
+
+func TestServerGRPC(t *testing.T) {
+	assert := assert.New(t)
+
+	// The target answers like a gRPC server over h2c: it echoes the
+	// request body and reports the status in trailers, along with the
+	// request trailer it got.
+	appServer := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			http.Error(w, "grpc requires HTTP/2", http.StatusHTTPVersionNotSupported)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, X-Request-Trailer")
+		io.Copy(w, r.Body)
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("X-Request-Trailer", r.Trailer.Get("X-Checksum"))
+	}), &http2.Server{}))
+	defer appServer.Close()
+
+	server, _ := startTunnel(t, server.Options{
+		Hostname: "example.com",
+	}, client.Options{
+		Name:   "grpc",
+		Target: appServer.URL,
+	})
+
+	// The visitor speaks HTTP/2 with prior knowledge, like gRPC clients do.
+	visitor := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}}
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/echo.Echo/Stream", pr)
+	if !assert.NoError(err) {
+		return
+	}
+	req.Host = "grpc.example.com"
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+	req.Trailer = http.Header{"X-Checksum": nil}
+	go func() {
+		for i := range 3 {
+			fmt.Fprintf(pw, "message %d\n", i)
+		}
+		req.Trailer.Set("X-Checksum", "abc")
+		pw.Close()
+	}()
+
+	resp, err := visitor.Do(req)
+	if !assert.NoError(err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal(2, resp.ProtoMajor)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(err)
+	assert.Equal("message 0\nmessage 1\nmessage 2\n", string(body))
+	assert.Equal("0", resp.Trailer.Get("Grpc-Status"))
+	assert.Equal("abc", resp.Trailer.Get("X-Request-Trailer"))
+}
+
+func TestServerWebsocketHandshake(t *testing.T) {
+	assert := assert.New(t)
+
+	// The target wants a token and a room, greets as soon as it accepts,
+	// then echoes.
+	appServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "who are you?", http.StatusUnauthorized)
+			return
+		}
+		upgrader := websocket.Upgrader{Subprotocols: []string{"chat.v1"}}
+		conn, err := upgrader.Upgrade(w, r, http.Header{"Set-Cookie": {"seen=1"}})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("room %s, cookie %s", r.URL.Query().Get("room"), r.Header.Get("Cookie"))))
+		for {
+			mt, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(mt, message)
+		}
+	}))
+	defer appServer.Close()
+
+	server, _ := startTunnel(t, server.Options{
+		Hostname: "example.com",
+	}, client.Options{
+		Name:   "chat",
+		Target: appServer.URL,
+	})
+
+	wsURL, err := util.GetWebsocketURL(server.URL)
+	if !assert.NoError(err) {
+		return
+	}
+	dialer := websocket.Dialer{Subprotocols: []string{"chat.v2", "chat.v1"}}
+
+	t.Run("accepted", func(t *testing.T) {
+		conn, response, err := dialer.Dial(wsURL.String()+"/ws?room=42", http.Header{
+			"Host":          {"chat.example.com"},
+			"Authorization": {"Bearer secret"},
+			"Cookie":        {"session=abc"},
+		})
+		if !assert.NoError(err) {
+			return
+		}
+		defer conn.Close()
+		assert.Equal("chat.v1", conn.Subprotocol())
+		assert.Equal("seen=1", response.Header.Get("Set-Cookie"))
+
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, message, err := conn.ReadMessage()
+		assert.NoError(err)
+		assert.Equal("room 42, cookie session=abc", string(message))
+
+		assert.NoError(conn.WriteMessage(websocket.TextMessage, []byte("hello")))
+		_, message, err = conn.ReadMessage()
+		assert.NoError(err)
+		assert.Equal("hello", string(message))
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		_, response, err := dialer.Dial(wsURL.String()+"/ws?room=42", http.Header{"Host": {"chat.example.com"}})
+		assert.ErrorIs(err, websocket.ErrBadHandshake)
+		if assert.NotNil(response) {
+			body, _ := io.ReadAll(response.Body)
+			assert.Equal(http.StatusUnauthorized, response.StatusCode)
+			assert.Equal("Bearer", response.Header.Get("WWW-Authenticate"))
+			assert.Equal("who are you?\n", string(body))
+		}
+	})
+}
+
+func TestServerWebsocketControl(t *testing.T) {
+	assert := assert.New(t)
+
+	// The target answers "expire" by closing with an application code,
+	// "big" with a message over the limit, and reports how the visitor
+	// closed on targetClosed. Pings get the default pong.
+	targetClosed := make(chan *websocket.CloseError, 1)
+	appServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		closing := false
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				// Visitors that just go away close it abnormally.
+				var closeErr *websocket.CloseError
+				if errors.As(err, &closeErr) && closeErr.Code != websocket.CloseAbnormalClosure && !closing {
+					targetClosed <- closeErr
+				}
+				return
+			}
+			switch string(message) {
+			case "expire":
+				closing = true
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4001, "auth expired"))
+			case "big":
+				conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 2048)))
+			}
+		}
+	}))
+	defer appServer.Close()
+
+	server, _ := startTunnel(t, server.Options{
+		Hostname:                 "example.com",
+		MaxWebsocketMessageBytes: 1024,
+	}, client.Options{
+		Name:   "ws",
+		Target: appServer.URL,
+	})
+
+	wsURL, err := util.GetWebsocketURL(server.URL)
+	if !assert.NoError(err) {
+		return
+	}
+	dial := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL.String(), http.Header{"Host": {"ws.example.com"}})
+		if !assert.NoError(err) {
+			return nil
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+	readClose := func(conn *websocket.Conn) *websocket.CloseError {
+		_, _, err := conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		assert.ErrorAs(err, &closeErr)
+		return closeErr
+	}
+
+	t.Run("ping pong", func(t *testing.T) {
+		conn := dial()
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		pong := make(chan string, 1)
+		conn.SetPongHandler(func(data string) error {
+			pong <- data
+			return nil
+		})
+		go conn.ReadMessage()
+		assert.NoError(conn.WriteControl(websocket.PingMessage, []byte("are you there"), time.Now().Add(time.Second)))
+		select {
+		case data := <-pong:
+			assert.Equal("are you there", data)
+		case <-time.After(5 * time.Second):
+			t.Error("no pong from the target")
+		}
+	})
+
+	t.Run("target close code", func(t *testing.T) {
+		conn := dial()
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		assert.NoError(conn.WriteMessage(websocket.TextMessage, []byte("expire")))
+		if closeErr := readClose(conn); closeErr != nil {
+			assert.Equal(4001, closeErr.Code)
+			assert.Equal("auth expired", closeErr.Text)
+		}
+	})
+
+	t.Run("visitor close code", func(t *testing.T) {
+		conn := dial()
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		assert.NoError(conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4002, "logged out")))
+		select {
+		case closeErr := <-targetClosed:
+			assert.Equal(4002, closeErr.Code)
+			assert.Equal("logged out", closeErr.Text)
+		case <-time.After(5 * time.Second):
+			t.Error("target was not closed")
+		}
+	})
+
+	t.Run("visitor message too big", func(t *testing.T) {
+		conn := dial()
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		assert.NoError(conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 2048))))
+		if closeErr := readClose(conn); closeErr != nil {
+			assert.Equal(websocket.CloseMessageTooBig, closeErr.Code)
+		}
+	})
+
+	t.Run("target message too big", func(t *testing.T) {
+		conn := dial()
+		if conn == nil {
+			return
+		}
+		defer conn.Close()
+		assert.NoError(conn.WriteMessage(websocket.TextMessage, []byte("big")))
+		if closeErr := readClose(conn); closeErr != nil {
+			assert.Equal(websocket.CloseMessageTooBig, closeErr.Code)
+		}
+	})
+}
+
+func TestServerAllowedIPs(t *testing.T) {
+	assert := assert.New(t)
+
+	appServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello")
+	}))
+	defer appServer.Close()
+
+	// Visitors connect from loopback, which plays the trusted proxy.
+	trusted, err := server.ParseNetworks([]string{"127.0.0.0/8", "::1"})
+	if !assert.NoError(err) {
+		return
+	}
+	server := serveTunnels(t, server.Options{
+		Hostname:       "example.com",
+		TrustedProxies: trusted,
+	})
+
+	start := func(name string, allowedIPs ...string) bool {
+		_, state := dialTunnel(t, server, client.Options{
+			Name:       name,
+			Target:     appServer.URL,
+			AllowedIPs: allowedIPs,
+		})
+		return assert.Eventually(func() bool { return state.GetURL() != "" }, 5*time.Second, 10*time.Millisecond)
+	}
+	if !start("office", "10.0.0.0/8", "2001:db8::/32") || !start("open", "0.0.0.0/0", "::/0") {
+		return
+	}
+
+	get := func(name string, forwardedFor ...string) int {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if !assert.NoError(err) {
+			return 0
+		}
+		req.Host = name + ".example.com"
+		for _, hop := range forwardedFor {
+			req.Header.Add("X-Forwarded-For", hop)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(http.StatusForbidden, get("office"))
+	assert.Equal(http.StatusOK, get("office", "10.1.2.3"))
+	assert.Equal(http.StatusOK, get("office", "2001:db8::1"))
+	// Hops through trusted proxies are followed to the visitor.
+	assert.Equal(http.StatusOK, get("office", "10.1.2.3, 127.0.0.2"))
+	assert.Equal(http.StatusOK, get("office", "198.51.100.7", "10.1.2.3"))
+	// Whatever comes before the first untrusted hop is not believed.
+	assert.Equal(http.StatusForbidden, get("office", "10.1.2.3, 198.51.100.7"))
+	assert.Equal(http.StatusForbidden, get("office", "not-an-ip"))
+	assert.Equal(http.StatusOK, get("open", "198.51.100.7"))
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/campbel/tiny-tunnel/core/protocol"
+	"github.com/campbel/tiny-tunnel/core/shared"
+	"github.com/google/uuid"
+)
+
+var (
+	errTCPDisabled = errors.New("TCP tunnels are not enabled on this server")
+	errNoFreePort  = errors.New("no free port in range")
+)
+
+// PortRange is the range public ports of TCP or UDP tunnels are allocated
+// from. The zero value disables them.
+type PortRange struct {
+	First, Last int
+}
+
+// ParsePortRange parses a range written "first-last", or a single port.
+func ParsePortRange(s string) (PortRange, error) {
+	if s == "" {
+		return PortRange{}, nil
+	}
+	first, last, found := strings.Cut(s, "-")
+	if !found {
+		last = first
+	}
+	var (
+		r   PortRange
+		err error
+	)
+	if r.First, err = strconv.Atoi(first); err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	if r.Last, err = strconv.Atoi(last); err != nil {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	if r.First < 1 || r.Last > 65535 || r.First > r.Last {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return r, nil
+}
+
+func (r PortRange) enabled() bool {
+	return r.First > 0
+}
+
+func (r PortRange) contains(port int) bool {
+	return port >= r.First && port <= r.Last
+}
+
+// listen opens port, or when it is zero the first free port of the range
+// from a random starting point.
+func (r PortRange) listen(port int) (net.Listener, error) {
+	return allocate(r, port, func(addr string) (net.Listener, error) {
+		return net.Listen("tcp", addr)
+	})
+}
+
+// listenPacket is listen for UDP.
+func (r PortRange) listenPacket(port int) (net.PacketConn, error) {
+	return allocate(r, port, func(addr string) (net.PacketConn, error) {
+		return net.ListenPacket("udp", addr)
+	})
+}
+
+func allocate[T any](r PortRange, port int, open func(addr string) (T, error)) (T, error) {
+	var zero T
+	if port != 0 {
+		if !r.contains(port) {
+			return zero, fmt.Errorf("port %d is outside the range %d-%d", port, r.First, r.Last)
+		}
+		return open(":" + strconv.Itoa(port))
+	}
+	n := r.Last - r.First + 1
+	offset := rand.IntN(n)
+	for i := range n {
+		if conn, err := open(":" + strconv.Itoa(r.First+(offset+i)%n)); err == nil {
+			return conn, nil
+		}
+	}
+	return zero, errNoFreePort
+}
+
+// tcpSession is a visitor TCP connection relayed through the tunnel, or an
+// upgraded HTTP connection.
+// Data from the client is written to conn from the inbox so a slow visitor
+// only holds up its own connection. For an upgrade the inbox holds it until
+// the visitor's connection is attached.
+type tcpSession struct {
+	conn     net.Conn
+	attached chan struct{}
+	inbox    *shared.Inbox
+	// opened gets whether the client reached the target: nil once it
+	// confirms the connection, or why it could not.
+	opened chan *protocol.Error
+}
+
+// connected waits for the visitor's connection to be attached and reports
+// whether it was.
+func (s *tcpSession) connected() bool {
+	<-s.attached
+	return s.conn != nil
+}
+
+// attach sets the visitor's connection, or nil when there is none after
+// all, and releases the data held for it.
+func (s *tcpSession) attach(conn net.Conn) {
+	s.conn = conn
+	close(s.attached)
+}
+
+// open tells whoever waits for the connection whether the client reached
+// the target.
+func (s *tcpSession) open(err *protocol.Error) {
+	select {
+	case s.opened <- err:
+	default:
+	}
+}
+
+func (s *Tunnel) handleTcpOpened(tunnel *shared.Tunnel, id string, payload protocol.TcpOpenedPayload) {
+	if session, ok := s.tcpConns.Get(payload.ConnID); ok {
+		session.open(nil)
+	}
+}
+
+func (s *Tunnel) handleTcpData(tunnel *shared.Tunnel, id string, payload protocol.TcpDataPayload) {
+	session, ok := s.tcpConns.Get(payload.ConnID)
+	if !ok {
+		return
+	}
+	session.inbox.Push(len(payload.Data), func() {
+		if !session.connected() {
+			return
+		}
+		if _, err := session.conn.Write(payload.Data); err != nil {
+			s.l.Debug("failed to write tcp data", "conn_id", payload.ConnID, "error", err.Error())
+		}
+	})
+}
+
+func (s *Tunnel) handleTcpClose(tunnel *shared.Tunnel, id string, payload protocol.TcpClosePayload) {
+	if e := payload.Error; e != nil {
+		s.l.Info("tunnel target connection failed", "code", e.Code, "error", e.Message)
+	}
+	session, ok := s.tcpConns.Get(payload.ConnID)
+	if !ok {
+		return
+	}
+	if payload.Error != nil {
+		session.open(payload.Error)
+	} else {
+		session.open(&protocol.Error{Code: protocol.ErrorCodeReset})
+	}
+	s.tcpConns.Delete(payload.ConnID)
+	tunnel.ReleaseWindow(payload.ConnID)
+	// Close after the data still queued ahead of it.
+	session.inbox.Push(0, func() {
+		if session.connected() {
+			session.conn.Close()
+		}
+		session.inbox.Close()
+	})
+}
+
+// serveTCP relays a connection accepted on the tunnel's public port until
+// either side closes it.
+func (s *Tunnel) serveTCP(conn net.Conn) {
+	s.inflight.Add(1)
+	defer s.inflight.Add(-1)
+
+	connID := uuid.New().String()
+	session := s.openTCPSession(connID)
+	session.attach(conn)
+	defer s.closeTCPSession(connID, session)
+
+	if err := s.tunnel.Send(protocol.MessageKindTcpOpen, &protocol.TcpOpenPayload{
+		ConnID:     connID,
+		RemoteAddr: conn.RemoteAddr().String(),
+	}); err != nil {
+		s.l.Error("failed to send tcp open", "error", err.Error())
+		return
+	}
+	s.pumpTCP(connID, conn)
+}
+
+// openTCPSession registers a session for connID, to be attached to the
+// visitor's connection.
+func (s *Tunnel) openTCPSession(connID string) *tcpSession {
+	session := &tcpSession{attached: make(chan struct{}), inbox: s.tunnel.NewInbox(connID), opened: make(chan *protocol.Error, 1)}
+	s.tcpConns.SetNX(connID, session)
+	return session
+}
+
+func (s *Tunnel) closeTCPSession(connID string, session *tcpSession) {
+	s.tcpConns.Delete(connID)
+	s.tunnel.ReleaseWindow(connID)
+	session.inbox.Close()
+	if session.conn != nil {
+		session.conn.Close()
+	}
+}
+
+// pumpTCP relays what the visitor sends on conn to the client until either
+// side closes the connection.
+func (s *Tunnel) pumpTCP(connID string, conn net.Conn) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			// Stop reading from the visitor while the client's window is
+			// exhausted; it fails once the client closes the connection.
+			if err := s.tunnel.AcquireWindow(s.tunnel.Context(), connID, n); err != nil {
+				return
+			}
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			if err := s.tunnel.Send(protocol.MessageKindTcpData, &protocol.TcpDataPayload{ConnID: connID, Data: data}); err != nil {
+				s.l.Error("failed to send tcp data", "error", err.Error())
+				return
+			}
+		}
+		if err != nil {
+			// The client is only told when the visitor hung up first.
+			if _, open := s.tcpConns.Get(connID); open && !s.tunnel.IsClosed() {
+				if err := s.tunnel.Send(protocol.MessageKindTcpClose, &protocol.TcpClosePayload{ConnID: connID}); err != nil {
+					s.l.Error("failed to send tcp close", "error", err.Error())
+				}
+			}
+			return
+		}
+	}
+}
@@ -1,11 +1,13 @@
 package server
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/campbel/tiny-tunnel/internal/log"
@@ -14,38 +16,112 @@ import (
 	"github.com/campbel/tiny-tunnel/core/protocol"
 	"github.com/campbel/tiny-tunnel/core/shared"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
 type Tunnel struct {
 	tunnel         *shared.Tunnel
-	websocketConns *safe.Map[string, *safe.WSConn]
+	options        TunnelOptions
+	websocketConns *safe.Map[string, *websocketSession]
+	tcpConns       *safe.Map[string, *tcpSession]
+	udpSessions    *safe.Map[string, *udpSession]
 	l              log.Logger
+
+	// inflight counts the visitor requests and websockets being served.
+	inflight atomic.Int64
+	// draining is set once the client has been told the server is going
+	// away.
+	draining atomic.Bool
+}
+
+// websocketSession is a visitor websocket relayed through the tunnel.
+// Messages from the client are written to conn from the inbox so a slow
+// visitor only holds up its own session. The inbox holds them until the
+// visitor has been upgraded.
+type websocketSession struct {
+	conn     *safe.WSConn
+	attached chan struct{}
+	inbox    *shared.Inbox
+}
+
+// connected waits for the visitor's websocket to be attached and reports
+// whether it was.
+func (s *websocketSession) connected() bool {
+	<-s.attached
+	return s.conn != nil
+}
+
+// attach sets the visitor's websocket and releases the messages held for
+// it.
+func (s *websocketSession) attach(conn *safe.WSConn) {
+	s.conn = conn
+	close(s.attached)
+}
+
+// detach releases the messages held for a session that was never attached,
+// to be dropped.
+func (s *websocketSession) detach() {
+	select {
+	case <-s.attached:
+	default:
+		close(s.attached)
+	}
+}
+
+// requestStreamThreshold is the request body size above which bodies are
+// streamed to the client instead of buffered.
+const requestStreamThreshold = 1 << 20
+
+type TunnelOptions struct {
+	// MaxRequestBodyBytes caps visitor request bodies; zero means unlimited.
+	MaxRequestBodyBytes int64
+	// MaxWebsocketMessageBytes caps websocket messages either way; zero
+	// means unlimited.
+	MaxWebsocketMessageBytes int64
+	// ResponseHeaderTimeout and IdleTimeout bound the wait for the response
+	// head and for each chunk of a streamed response; zero waits forever.
+	ResponseHeaderTimeout time.Duration
+	IdleTimeout           time.Duration
+	// TrustedProxies are believed about the visitor's address and scheme.
+	TrustedProxies Networks
+	// AccessScheme is the scheme visitors reach tunnels with when neither
+	// the connection nor a trusted proxy tells.
+	AccessScheme string
 }
 
-type TunnelOptions struct{}
+// capabilities lists everything this server can speak; the handshake narrows
+// it down to what each client supports.
+var capabilities = protocol.Capabilities{
+	Version: protocol.ProtocolVersion,
+	Features: []string{
+		protocol.FeatureStreaming,
+		protocol.FeatureBinaryFrames,
+		protocol.FeatureCompression,
+		protocol.FeatureRegisterAck,
+		protocol.FeatureRequestStreaming,
+		protocol.FeatureFlowControl,
+		protocol.FeatureErrorCodes,
+		protocol.FeatureGoAway,
+		protocol.FeatureTCP,
+		protocol.FeatureTcpOpened,
+		protocol.FeatureUDP,
+		protocol.FeatureUpgrade,
+		protocol.FeatureWebsocketControl,
+		protocol.FeatureAllowedIPs,
+	},
+}
 
 func NewTunnel(conn *websocket.Conn, options TunnelOptions, l log.Logger) *Tunnel {
 	server := &Tunnel{
 		tunnel:         shared.NewTunnel(conn, l),
-		websocketConns: safe.NewMap[string, *safe.WSConn](),
+		options:        options,
+		websocketConns: safe.NewMap[string, *websocketSession](),
+		tcpConns:       safe.NewMap[string, *tcpSession](),
+		udpSessions:    safe.NewMap[string, *udpSession](),
 		l:              l,
 	}
 
-	ticker := time.NewTicker(15 * time.Second)
-	go func() {
-		for range ticker.C {
-			if server.tunnel.IsClosed() {
-				return
-			}
-			if err := server.tunnel.Send(protocol.MessageKindText, &protocol.TextPayload{
-				Text: "ping",
-			}); err != nil {
-				l.Error("failed to send ping message", "error", err.Error())
-			}
-		}
-	}()
-
 	server.tunnel.RegisterTextHandler(func(tunnel *shared.Tunnel, id string, payload protocol.TextPayload) {
 		if payload.Text == "pong" {
 			l.Debug("received pong", "id", id)
@@ -56,28 +132,44 @@ func NewTunnel(conn *websocket.Conn, options TunnelOptions, l log.Logger) *Tunne
 
 	server.tunnel.RegisterWebsocketMessageHandler(func(tunnel *shared.Tunnel, id string, payload protocol.WebsocketMessagePayload) {
 		l.Debug("handling websocket message", "payload", payload)
-		conn, ok := server.websocketConns.Get(payload.SessionID)
+		session, ok := server.websocketConns.Get(payload.SessionID)
 		if !ok {
 			return
 		}
-		err := conn.WriteMessage(payload.Kind, payload.Data)
-		if err != nil {
-			l.Error("failed to write websocket message", "error", err.Error())
-		}
+		session.inbox.Push(len(payload.Data), func() {
+			if !session.connected() {
+				return
+			}
+			if err := session.conn.WriteMessage(payload.Kind, payload.Data); err != nil {
+				l.Error("failed to write websocket message", "error", err.Error())
+			}
+		})
 	})
 
 	server.tunnel.RegisterWebsocketCloseHandler(func(tunnel *shared.Tunnel, id string, payload protocol.WebsocketClosePayload) {
 		l.Debug("handling websocket close", "payload", payload)
-		conn, ok := server.websocketConns.Get(payload.SessionID)
+		session, ok := server.websocketConns.Get(payload.SessionID)
 		if !ok {
 			return
 		}
-		if err := conn.Close(); err != nil {
-			l.Error("failed to close websocket connection", "error", err.Error(), "payload", payload)
-		}
 		server.websocketConns.Delete(payload.SessionID)
+		tunnel.ReleaseWindow(payload.SessionID)
+		// Close after the messages still queued ahead of it.
+		session.inbox.Push(0, func() {
+			if session.connected() {
+				if err := session.conn.CloseWith(payload.Code, payload.Reason); err != nil {
+					l.Error("failed to close websocket connection", "error", err.Error(), "payload", payload)
+				}
+			}
+			session.inbox.Close()
+		})
 	})
 
+	server.tunnel.RegisterTcpOpenedHandler(server.handleTcpOpened)
+	server.tunnel.RegisterTcpDataHandler(server.handleTcpData)
+	server.tunnel.RegisterTcpCloseHandler(server.handleTcpClose)
+	server.tunnel.RegisterUdpDatagramHandler(server.handleUdpDatagram)
+
 	return server
 }
 
@@ -88,29 +180,111 @@ func (s *Tunnel) SendText(text string) error {
 	return s.tunnel.Send(protocol.MessageKindText, &protocol.TextPayload{Text: text})
 }
 
+// SendRegisterAck tells the client its tunnel is registered and routable.
+func (s *Tunnel) SendRegisterAck(ack *protocol.RegisterAckPayload) error {
+	return s.tunnel.Send(protocol.MessageKindRegisterAck, ack)
+}
+
+// Capabilities returns the capabilities negotiated with the client.
+func (s *Tunnel) Capabilities() protocol.Capabilities {
+	return s.tunnel.Capabilities()
+}
+
+// Handshake negotiates capabilities with the client. It must complete
+// before anything else is sent on the tunnel.
+func (s *Tunnel) Handshake(ctx context.Context) error {
+	return s.tunnel.ServerHandshake(ctx, capabilities)
+}
+
 func (s *Tunnel) Listen(ctx context.Context) {
+	go s.keepalive()
 	s.tunnel.Listen(ctx)
 }
 
+// keepalive pings the client until the tunnel closes.
+func (s *Tunnel) keepalive() {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.tunnel.Send(protocol.MessageKindText, &protocol.TextPayload{
+				Text: "ping",
+			}); err != nil {
+				s.l.Error("failed to send ping message", "error", err.Error())
+			}
+		case <-s.tunnel.Done():
+			return
+		}
+	}
+}
+
 func (s *Tunnel) Close() {
 	s.tunnel.Close()
 }
 
+// drain tells the client the server is going away, then closes the tunnel
+// once nothing is in flight on it, or when ctx ends. Clients that predate
+// GoAway only notice the close.
+func (s *Tunnel) drain(ctx context.Context) {
+	s.draining.Store(true)
+	if s.tunnel.Capabilities().Has(protocol.FeatureGoAway) {
+		if err := s.tunnel.SendGoAway("server shutting down"); err != nil {
+			s.l.Error("failed to send go away", "error", err.Error())
+		}
+	}
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for s.inflight.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.l.Warn("closing tunnel with requests in flight", "requests", s.inflight.Load())
+			s.tunnel.Close()
+			return
+		case <-s.tunnel.Done():
+			return
+		}
+	}
+	s.tunnel.Close()
+}
+
 // HandleHttpRequest proxies an HTTP request through the tunnel. The client
 // responds either with a single buffered HttpResponse, or with a stream
 // (HttpResponseStart, then HttpResponseChunk*, then HttpResponseEnd) for
 // responses of unknown length (SSE, k8s watch streams, log follows, ...).
 func (s *Tunnel) HandleHttpRequest(w http.ResponseWriter, r *http.Request) {
+	if err := s.serveHTTP(w, r); err != nil {
+		http.Error(w, "tunnel closed", http.StatusBadGateway)
+	}
+}
+
+// errTunnelUnavailable is returned by serveHTTP when the tunnel closed
+// before the request reached the client, or before an idempotent request was
+// answered. Nothing has been written to the visitor, so the request can be
+// retried on another connection of the tunnel.
+var errTunnelUnavailable = errors.New("tunnel unavailable")
+
+func (s *Tunnel) serveHTTP(w http.ResponseWriter, r *http.Request) error {
+	s.inflight.Add(1)
+	defer s.inflight.Add(-1)
+
 	// Handle WebSocket requests
 	if r.Header.Get("Upgrade") == "websocket" {
 		s.HandleWebsocketRequest(w, r)
-		return
+		return nil
+	}
+	if isUpgrade(r) && s.tunnel.Capabilities().Has(protocol.FeatureUpgrade) {
+		return s.serveUpgrade(w, r)
 	}
 
-	bodyBytes, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "", http.StatusInternalServerError)
-		return
+	if limit := s.options.MaxRequestBodyBytes; limit > 0 {
+		if r.ContentLength > limit {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return nil
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
 	}
 
 	path := r.URL.Path
@@ -123,31 +297,124 @@ func (s *Tunnel) HandleHttpRequest(w http.ResponseWriter, r *http.Request) {
 	responseChannel := make(chan protocol.Message, 64)
 
 	start := time.Now()
-	requestID, clean, err := s.tunnel.SendWithResponseChannel(protocol.MessageKindHttpRequest, &protocol.HttpRequestPayload{
-		Method:  r.Method,
-		Path:    path,
-		Headers: r.Header,
-		Body:    bodyBytes,
-	}, responseChannel)
+	timeouts := protocol.NewTimeouts(s.options.ResponseHeaderTimeout, s.options.IdleTimeout)
+	// sent is closed once the whole request has been relayed to the client.
+	sent := make(chan struct{})
+	var (
+		requestID string
+		clean     func()
+		err       error
+		// retryable is set when the request can be replayed elsewhere
+		// should this connection turn out to be gone.
+		retryable bool
+	)
+	if s.streamsRequestBody(r) {
+		// Large or open-ended uploads are relayed as they arrive instead of
+		// being buffered here. The response may start before the upload
+		// finishes, so the connection must be full duplex.
+		http.NewResponseController(w).EnableFullDuplex()
+		requestID, clean, err = s.tunnel.SendWithResponseChannel(protocol.MessageKindHttpRequestStart, &protocol.HttpRequestStartPayload{
+			Method:     r.Method,
+			Path:       path,
+			Headers:    requestHeaders(r),
+			Timeouts:   timeouts,
+			RemoteAddr: s.visitorAddr(r),
+			Host:       r.Host,
+			Scheme:     s.visitorScheme(r),
+		}, responseChannel)
+		if err == nil {
+			upload, stopUpload := context.WithCancel(r.Context())
+			uploaded := sent
+			go func() {
+				defer close(uploaded)
+				s.streamRequestBody(upload, requestID, r.Body, r.Trailer)
+			}()
+			// The body must not be read once the handler has returned, so an
+			// upload still running then, because the response came early or
+			// never did, is cut short and waited for.
+			defer func() {
+				stopUpload()
+				select {
+				case <-uploaded:
+				default:
+					http.NewResponseController(w).SetReadDeadline(time.Now())
+					<-uploaded
+				}
+			}()
+		}
+	} else {
+		bodyBytes, readErr := io.ReadAll(r.Body)
+		if readErr != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(readErr, &maxBytesErr) {
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return nil
+			}
+			http.Error(w, "", http.StatusInternalServerError)
+			return nil
+		}
+		// Keep the body around for a retry on another connection.
+		r.Body = io.NopCloser(bytes.NewReader(bodyBytes))
+		retryable = true
+		requestID, clean, err = s.tunnel.SendWithResponseChannel(protocol.MessageKindHttpRequest, &protocol.HttpRequestPayload{
+			Method:     r.Method,
+			Path:       path,
+			Headers:    r.Header,
+			Body:       bodyBytes,
+			Timeouts:   timeouts,
+			RemoteAddr: s.visitorAddr(r),
+			Host:       r.Host,
+			Scheme:     s.visitorScheme(r),
+		}, responseChannel)
+		close(sent)
+	}
 	if err != nil {
 		s.l.Error("failed to send HTTP request", "error", err.Error())
+		if clean != nil {
+			clean()
+		}
+		if retryable {
+			return errTunnelUnavailable
+		}
 		http.Error(w, "", http.StatusBadGateway)
-		return
+		return nil
 	}
 	defer clean()
 
-	// Wait for the first response message
+	// Wait for the first response message. The response head deadline
+	// runs from when the request has been sent in full, so slow uploads
+	// don't count against it.
+	head := newDeadline(s.options.ResponseHeaderTimeout)
+	defer head.stop()
 	var first protocol.Message
-	select {
-	case first = <-responseChannel:
-	case <-r.Context().Done():
-		// Downstream consumer went away before the client responded;
-		// tell the client to cancel the upstream request.
-		s.sendStreamCancel(requestID)
-		return
-	case <-s.tunnel.Done():
-		http.Error(w, "tunnel closed", http.StatusBadGateway)
-		return
+wait:
+	for {
+		select {
+		case first = <-responseChannel:
+			break wait
+		case <-sent:
+			sent = nil
+			head.reset()
+		case <-head.C:
+			s.l.Info("timed out waiting for response", "request_id", requestID, "method", r.Method, "path", path)
+			s.sendStreamCancel(requestID)
+			timeout := &protocol.Error{Code: protocol.ErrorCodeTimeout}
+			http.Error(w, errorText(timeout), errorStatus(timeout))
+			return nil
+		case <-r.Context().Done():
+			// Downstream consumer went away before the client responded;
+			// tell the client to cancel the upstream request.
+			s.sendStreamCancel(requestID)
+			return nil
+		case <-s.tunnel.Done():
+			// The client may have acted on the request already, so only
+			// requests that are safe to repeat are retried.
+			if retryable && isIdempotent(r) {
+				return errTunnelUnavailable
+			}
+			http.Error(w, "tunnel closed", http.StatusBadGateway)
+			return nil
+		}
 	}
 
 	switch first.Kind {
@@ -159,21 +426,107 @@ func (s *Tunnel) HandleHttpRequest(w http.ResponseWriter, r *http.Request) {
 		s.l.Error("received unexpected message kind", "kind", first.Kind)
 		http.Error(w, "", http.StatusInternalServerError)
 	}
+	return nil
+}
+
+// isIdempotent reports whether r may be sent again after an attempt whose
+// outcome is unknown, by the same rules net/http's Transport uses.
+func isIdempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	_, ok := r.Header["Idempotency-Key"]
+	if !ok {
+		_, ok = r.Header["X-Idempotency-Key"]
+	}
+	return ok
+}
+
+// streamsRequestBody reports whether the request body should be streamed to
+// the client rather than buffered: bodies of unknown length (chunked
+// uploads, gRPC client streams) and large ones, when the client can take it.
+func (s *Tunnel) streamsRequestBody(r *http.Request) bool {
+	if !s.tunnel.Capabilities().Has(protocol.FeatureRequestStreaming) {
+		return false
+	}
+	return r.ContentLength < 0 || r.ContentLength > requestStreamThreshold
+}
+
+// requestHeaders returns the headers of r to send to the client. net/http
+// moves the Trailer header into r.Trailer; it is put back so the client can
+// declare the same trailers to the target.
+func requestHeaders(r *http.Request) http.Header {
+	if len(r.Trailer) == 0 {
+		return r.Header
+	}
+	headers := r.Header.Clone()
+	for name := range r.Trailer {
+		headers.Add("Trailer", name)
+	}
+	return headers
+}
+
+// streamRequestBody relays the visitor's request body to the client as
+// HttpRequestChunk messages, terminated by an HttpRequestEnd carrying the
+// trailers, which net/http fills in once the body is read. It stops reading
+// from the visitor while the client's window for the request is exhausted.
+func (s *Tunnel) streamRequestBody(ctx context.Context, requestID string, body io.Reader, trailer http.Header) {
+	defer s.tunnel.ReleaseWindow(requestID)
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if acquireErr := s.tunnel.AcquireWindow(ctx, requestID, n); acquireErr != nil {
+				n, err = 0, acquireErr
+			}
+		}
+		if n > 0 {
+			chunk := make([]byte, n)
+			copy(chunk, buf[:n])
+			if sendErr := s.tunnel.Send(protocol.MessageKindHttpRequestChunk, &protocol.HttpRequestChunkPayload{
+				RequestID: requestID,
+				Data:      chunk,
+			}); sendErr != nil {
+				s.l.Error("failed to send request chunk", "error", sendErr.Error())
+				return
+			}
+		}
+		if err != nil {
+			end := &protocol.HttpRequestEndPayload{RequestID: requestID}
+			if err != io.EOF {
+				end.Error = err.Error()
+			} else {
+				end.Trailers = trailer
+			}
+			if s.tunnel.IsClosed() {
+				return
+			}
+			if sendErr := s.tunnel.Send(protocol.MessageKindHttpRequestEnd, end); sendErr != nil {
+				s.l.Error("failed to send request end", "error", sendErr.Error())
+			}
+			return
+		}
+	}
 }
 
 func (s *Tunnel) writeBufferedResponse(w http.ResponseWriter, msg protocol.Message, start time.Time) {
 	var responsePayload protocol.HttpResponsePayload
-	if err := json.Unmarshal(msg.Payload, &responsePayload); err != nil {
+	if err := msg.DecodePayload(&responsePayload); err != nil {
 		http.Error(w, "", http.StatusInternalServerError)
 		return
 	}
 	s.l.Debug("received response", "duration", time.Since(start), "status", responsePayload.Response.Status)
 
-	if responsePayload.Response.Status == 0 {
+	if e := responsePayload.Error; e != nil || responsePayload.Response.Status == 0 {
 		// The client failed to reach the target (error responses don't carry
-		// a status). Return a gateway error rather than panicking on
-		// WriteHeader(0).
-		http.Error(w, "", http.StatusBadGateway)
+		// a status). Clients that predate error codes don't say why.
+		if e == nil {
+			e = &protocol.Error{Code: protocol.ErrorCodeUnknown}
+		}
+		s.l.Info("tunnel target request failed", "code", e.Code, "error", e.Message)
+		http.Error(w, errorText(e), errorStatus(e))
 		return
 	}
 
@@ -189,7 +542,7 @@ func (s *Tunnel) writeBufferedResponse(w http.ResponseWriter, msg protocol.Messa
 
 func (s *Tunnel) writeStreamedResponse(w http.ResponseWriter, r *http.Request, requestID string, first protocol.Message, responseChannel chan protocol.Message, start time.Time) {
 	var startPayload protocol.HttpResponseStartPayload
-	if err := json.Unmarshal(first.Payload, &startPayload); err != nil {
+	if err := first.DecodePayload(&startPayload); err != nil {
 		s.l.Error("failed to unmarshal stream start", "error", err.Error())
 		http.Error(w, "", http.StatusInternalServerError)
 		return
@@ -220,13 +573,20 @@ func (s *Tunnel) writeStreamedResponse(w http.ResponseWriter, r *http.Request, r
 
 	s.l.Debug("stream started", "status", status, "duration", time.Since(start))
 
+	// Credit is returned to the client only once chunks reach the visitor,
+	// so a slow consumer throttles its own stream and nothing else.
+	window := s.tunnel.NewReceiveWindow(requestID)
+
+	idle := newDeadline(s.options.IdleTimeout)
+	defer idle.stop()
 	for {
+		idle.reset()
 		select {
 		case msg := <-responseChannel:
 			switch msg.Kind {
 			case protocol.MessageKindHttpResponseChunk:
 				var chunk protocol.HttpResponseChunkPayload
-				if err := json.Unmarshal(msg.Payload, &chunk); err != nil {
+				if err := msg.DecodePayload(&chunk); err != nil {
 					s.l.Error("failed to unmarshal stream chunk", "error", err.Error())
 					return
 				}
@@ -237,17 +597,30 @@ func (s *Tunnel) writeStreamedResponse(w http.ResponseWriter, r *http.Request, r
 					return
 				}
 				flusher.Flush()
+				window.Consume(len(chunk.Data))
 			case protocol.MessageKindHttpResponseEnd:
 				var end protocol.HttpResponseEndPayload
-				if err := json.Unmarshal(msg.Payload, &end); err == nil && end.Error != "" {
+				if err := msg.DecodePayload(&end); err == nil && end.Error != "" {
 					s.l.Error("stream ended with error", "error", end.Error)
 				}
+				// Trailers are announced after the body, which net/http
+				// allows with the trailer prefix.
+				for k, v := range end.Trailers {
+					w.Header()[http.TrailerPrefix+k] = v
+				}
 				s.l.Debug("stream ended", "duration", time.Since(start))
 				return
 			default:
 				s.l.Error("received unexpected message kind during stream", "kind", msg.Kind)
 				return
 			}
+		case <-idle.C:
+			// The status is already out; all we can do is cut the
+			// response short.
+			s.l.Info("stream idle timeout, cancelling stream", "request_id", requestID)
+			s.sendStreamCancel(requestID)
+			s.drainUntilEnd(responseChannel)
+			return
 		case <-r.Context().Done():
 			// Downstream consumer disconnected; cancel upstream and drain
 			// remaining messages so the tunnel read loop is never blocked
@@ -293,35 +666,59 @@ func (s *Tunnel) drainUntilEnd(responseChannel chan protocol.Message) {
 }
 
 func (s *Tunnel) HandleWebsocketRequest(w http.ResponseWriter, r *http.Request) {
-	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	}
-
-	rawConn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		http.Error(w, "", http.StatusInternalServerError)
-		return
+	path := r.URL.Path
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
 	}
 
-	conn := safe.NewWSConn(rawConn)
+	// Register the session up front so messages the target sends as soon
+	// as it accepts are held until the visitor is upgraded. The visitor is
+	// only upgraded once the target has accepted, so a refusal reaches it
+	// as a plain HTTP response.
+	sessionID := uuid.New().String()
+	session := s.openWebsocketSession(sessionID)
+	defer func() { s.closeWebsocketSession(sessionID, session) }()
 
 	responseChannel := make(chan protocol.Message, 1)
 	_, clean, err := s.tunnel.SendWithResponseChannel(protocol.MessageKindWebsocketCreateRequest, &protocol.WebsocketCreateRequestPayload{
-		Origin: r.Header.Get("Origin"),
-		Path:   r.URL.Path,
+		SessionID:    sessionID,
+		Origin:       r.Header.Get("Origin"),
+		Path:         path,
+		Headers:      websocketHeaders(r.Header),
+		Subprotocols: websocket.Subprotocols(r),
+		// The client reads the target's messages under the same limit.
+		MaxMessageBytes: s.options.MaxWebsocketMessageBytes,
+		RemoteAddr:      s.visitorAddr(r),
+		Host:            r.Host,
+		Scheme:          s.visitorScheme(r),
 	}, responseChannel)
 	if err != nil {
+		if clean != nil {
+			clean()
+		}
 		s.l.Error("failed to send websocket create request", "error", err.Error())
+		http.Error(w, "", http.StatusBadGateway)
 		return
 	}
-	defer clean()
 
+	head := newDeadline(s.options.ResponseHeaderTimeout)
+	head.reset()
+	defer head.stop()
 	var response protocol.Message
 	select {
 	case response = <-responseChannel:
+		clean()
+	case <-head.C:
+		s.l.Info("timed out waiting for websocket create response", "path", path)
+		go s.closeLateWebsocket(responseChannel, clean)
+		timeout := &protocol.Error{Code: protocol.ErrorCodeTimeout}
+		http.Error(w, errorText(timeout), errorStatus(timeout))
+		return
+	case <-r.Context().Done():
+		go s.closeLateWebsocket(responseChannel, clean)
+		return
 	case <-s.tunnel.Done():
+		clean()
 		http.Error(w, "tunnel closed", http.StatusBadGateway)
 		return
 	}
@@ -332,40 +729,116 @@ func (s *Tunnel) HandleWebsocketRequest(w http.ResponseWriter, r *http.Request)
 	}
 
 	var responsePayload protocol.WebsocketCreateResponsePayload
-	if err := json.Unmarshal(response.Payload, &responsePayload); err != nil {
+	if err := response.DecodePayload(&responsePayload); err != nil {
 		http.Error(w, "", http.StatusInternalServerError)
 		return
 	}
 
-	if !s.websocketConns.SetNX(responsePayload.SessionID, conn) {
-		http.Error(w, "", http.StatusInternalServerError)
+	if e := responsePayload.Error; e != nil || responsePayload.SessionID == "" {
+		// A target that refused the handshake (401, 403, a redirect to a
+		// login page, ...) is answered with its own response; one that
+		// could not be reached with a gateway error.
+		if handshake := responsePayload.HttpResponse; handshake != nil && handshake.Response.Status != 0 {
+			s.l.Info("tunnel target refused websocket", "status", handshake.Response.Status)
+			for k, v := range handshake.Response.Headers {
+				w.Header()[k] = v
+			}
+			// The body may have been cut short.
+			w.Header().Del("Content-Length")
+			w.Header().Del("Connection")
+			w.WriteHeader(handshake.Response.Status)
+			w.Write(handshake.Response.Body)
+			return
+		}
+		if e == nil {
+			e = &protocol.Error{Code: protocol.ErrorCodeUnknown}
+		}
+		s.l.Info("tunnel target websocket failed", "code", e.Code, "error", e.Message)
+		http.Error(w, errorText(e), errorStatus(e))
+		return
+	}
+	if responsePayload.SessionID != sessionID {
+		// The client chose its own session ID.
+		s.closeWebsocketSession(sessionID, session)
+		sessionID = responsePayload.SessionID
+		session = s.openWebsocketSession(sessionID)
+	}
+
+	var responseHeader http.Header
+	if handshake := responsePayload.HttpResponse; handshake != nil {
+		responseHeader = websocketHeaders(handshake.Response.Headers)
+		// The upgrader picks the subprotocol from the response header when
+		// it has none of its own.
+		if subprotocol := handshake.Response.Headers.Get("Sec-Websocket-Protocol"); subprotocol != "" {
+			responseHeader.Set("Sec-Websocket-Protocol", subprotocol)
+		}
+	}
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+	rawConn, err := upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		// The upgrader has answered the visitor already.
+		s.l.Debug("failed to upgrade visitor websocket", "error", err.Error())
+		if err := s.tunnel.Send(protocol.MessageKindWebsocketClose, &protocol.WebsocketClosePayload{
+			SessionID: sessionID,
+		}); err != nil {
+			s.l.Error("failed to send websocket close", "error", err.Error())
+		}
 		return
 	}
-	defer func() {
-		s.websocketConns.Delete(responsePayload.SessionID)
-		conn.Close()
-	}()
+	conn := safe.NewWSConn(rawConn)
+	if limit := s.options.MaxWebsocketMessageBytes; limit > 0 {
+		conn.SetReadLimit(limit)
+	}
+	if s.tunnel.Capabilities().Has(protocol.FeatureWebsocketControl) {
+		conn.RelayControl(func(messageType int, data []byte) {
+			if err := s.tunnel.Send(protocol.MessageKindWebsocketMessage, &protocol.WebsocketMessagePayload{
+				SessionID: sessionID,
+				Kind:      messageType,
+				Data:      data,
+			}); err != nil {
+				s.l.Debug("failed to send websocket control message", "error", err.Error())
+			}
+		})
+	}
+	session.attach(conn)
 
 	for {
 		messageType, message, err := conn.ReadMessage()
 		if err != nil {
-			s.l.Debug("app websocket connection closed", "sessionID", responsePayload.SessionID, "error", err.Error())
-			if err := s.tunnel.Send(protocol.MessageKindWebsocketClose, &protocol.WebsocketClosePayload{
-				SessionID: responsePayload.SessionID,
-			}); err != nil {
-				s.l.Error("failed to send websocket close", "error", err.Error())
+			s.l.Debug("app websocket connection closed", "sessionID", sessionID, "error", err.Error())
+			// The client closes the target with the visitor's status.
+			code, reason := safe.CloseStatus(err)
+			if _, open := s.websocketConns.Get(sessionID); open && !s.tunnel.IsClosed() {
+				if err := s.tunnel.Send(protocol.MessageKindWebsocketClose, &protocol.WebsocketClosePayload{
+					SessionID: sessionID,
+					Code:      code,
+					Reason:    reason,
+				}); err != nil {
+					s.l.Error("failed to send websocket close", "error", err.Error())
+				}
 			}
 			return
 		}
 
+		// Stop reading from the visitor while the client's window for the
+		// session is exhausted; it fails once the client closes the session.
+		if err := s.tunnel.AcquireWindow(s.tunnel.Context(), sessionID, len(message)); err != nil {
+			s.l.Debug("websocket session ended", "sessionID", sessionID, "error", err.Error())
+			return
+		}
+
 		if err := s.tunnel.Send(protocol.MessageKindWebsocketMessage, &protocol.WebsocketMessagePayload{
-			SessionID: responsePayload.SessionID,
+			SessionID: sessionID,
 			Kind:      messageType,
 			Data:      message,
 		}); err != nil {
 			if err == websocket.ErrCloseSent {
 				conn.Close()
-				s.l.Debug("tunnel websocket connection closed", "sessionID", responsePayload.SessionID, "error", err.Error())
+				s.l.Debug("tunnel websocket connection closed", "sessionID", sessionID, "error", err.Error())
 				return
 			}
 			s.l.Error("failed to send websocket message", "error", err.Error())
@@ -373,3 +846,65 @@ func (s *Tunnel) HandleWebsocketRequest(w http.ResponseWriter, r *http.Request)
 		}
 	}
 }
+
+// openWebsocketSession registers a session for sessionID, to be attached to
+// the visitor's websocket.
+func (s *Tunnel) openWebsocketSession(sessionID string) *websocketSession {
+	session := &websocketSession{attached: make(chan struct{}), inbox: s.tunnel.NewInbox(sessionID)}
+	s.websocketConns.SetNX(sessionID, session)
+	return session
+}
+
+func (s *Tunnel) closeWebsocketSession(sessionID string, session *websocketSession) {
+	s.websocketConns.Delete(sessionID)
+	s.tunnel.ReleaseWindow(sessionID)
+	session.detach()
+	session.inbox.Close()
+	if session.conn != nil {
+		session.conn.Close()
+	}
+}
+
+// closeLateWebsocket waits for the answer to a websocket create request the
+// visitor is no longer waiting for, and closes the target websocket if the
+// client opened one after all.
+func (s *Tunnel) closeLateWebsocket(responseChannel chan protocol.Message, clean func()) {
+	defer clean()
+	select {
+	case response := <-responseChannel:
+		var responsePayload protocol.WebsocketCreateResponsePayload
+		if response.DecodePayload(&responsePayload) != nil || responsePayload.SessionID == "" {
+			return
+		}
+		if err := s.tunnel.Send(protocol.MessageKindWebsocketClose, &protocol.WebsocketClosePayload{
+			SessionID: responsePayload.SessionID,
+		}); err != nil {
+			s.l.Debug("failed to send websocket close", "error", err.Error())
+		}
+	case <-s.tunnel.Done():
+	}
+}
+
+// websocketHandshakeHeaders are set by the websocket handshake on either
+// side of the tunnel and so are not relayed.
+var websocketHandshakeHeaders = []string{
+	"Connection",
+	"Upgrade",
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Accept",
+	"Sec-Websocket-Extensions",
+	"Sec-Websocket-Protocol",
+}
+
+// websocketHeaders returns headers without the websocket handshake ones.
+func websocketHeaders(headers http.Header) http.Header {
+	headers = headers.Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	for _, name := range websocketHandshakeHeaders {
+		headers.Del(name)
+	}
+	return headers
+}
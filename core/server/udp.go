@@ -0,0 +1,181 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/campbel/tiny-tunnel/core/protocol"
+	"github.com/campbel/tiny-tunnel/core/shared"
+	"github.com/campbel/tiny-tunnel/internal/log"
+	"github.com/google/uuid"
+)
+
+// defaultUDPIdleTimeout is how long a UDP session lasts without datagrams
+// when Options.UDPIdleTimeout is zero.
+const defaultUDPIdleTimeout = time.Minute
+
+var errUDPDisabled = errors.New("UDP tunnels are not enabled on this server")
+
+// udpSession is a visitor address of a UDP tunnel. Its datagrams are all
+// relayed through the same member of the pool until it expires.
+type udpSession struct {
+	id     string
+	addr   net.Addr
+	conn   net.PacketConn
+	tunnel *Tunnel
+	// seen is when the last datagram went either way, in Unix nanoseconds.
+	seen atomic.Int64
+}
+
+func (s *udpSession) touch() {
+	s.seen.Store(time.Now().UnixNano())
+}
+
+func (s *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, s.seen.Load()))
+}
+
+// udpRelay serves the public port of a UDP tunnel.
+type udpRelay struct {
+	conn net.PacketConn
+	pool *tunnelPool
+	idle time.Duration
+	l    log.Logger
+
+	mu sync.Mutex
+	// sessions are keyed by visitor address.
+	sessions map[string]*udpSession
+}
+
+func newUDPRelay(conn net.PacketConn, pool *tunnelPool, idle time.Duration, l log.Logger) *udpRelay {
+	if idle <= 0 {
+		idle = defaultUDPIdleTimeout
+	}
+	r := &udpRelay{
+		conn:     conn,
+		pool:     pool,
+		idle:     idle,
+		l:        l,
+		sessions: make(map[string]*udpSession),
+	}
+	go r.serve()
+	go r.expire()
+	return r
+}
+
+// serve relays the datagrams received on the public port until it is
+// closed. Datagrams nobody can take are dropped, as UDP would.
+func (r *udpRelay) serve() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if !r.pool.allows(addrIP(addr)) {
+			continue
+		}
+		session, ok := r.session(addr)
+		if !ok {
+			continue
+		}
+		session.touch()
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		if err := session.tunnel.tunnel.Send(protocol.MessageKindUdpDatagram, &protocol.UdpDatagramPayload{
+			SessionID:  session.id,
+			RemoteAddr: addr.String(),
+			Data:       data,
+		}); err != nil {
+			r.l.Debug("failed to send udp datagram", "error", err.Error())
+		}
+	}
+}
+
+// session returns the session of addr, starting one on a member of the pool
+// if there is none or its member has gone.
+func (r *udpRelay) session(addr net.Addr) (*udpSession, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions == nil {
+		return nil, false
+	}
+	key := addr.String()
+	if session, ok := r.sessions[key]; ok {
+		if !session.tunnel.tunnel.IsClosed() {
+			return session, true
+		}
+		delete(r.sessions, key)
+	}
+	tunnel, ok := r.pool.pick()
+	if !ok {
+		return nil, false
+	}
+	session := &udpSession{id: uuid.New().String(), addr: addr, conn: r.conn, tunnel: tunnel}
+	session.touch()
+	tunnel.udpSessions.SetNX(session.id, session)
+	r.sessions[key] = session
+	return session, true
+}
+
+// expire ends the sessions idle for longer than r.idle, telling the client
+// so it can let go of its socket.
+func (r *udpRelay) expire() {
+	ticker := time.NewTicker(r.idle / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.mu.Lock()
+		if r.sessions == nil {
+			r.mu.Unlock()
+			return
+		}
+		var expired []*udpSession
+		for key, session := range r.sessions {
+			if session.idle() >= r.idle {
+				delete(r.sessions, key)
+				expired = append(expired, session)
+			}
+		}
+		r.mu.Unlock()
+
+		for _, session := range expired {
+			session.tunnel.udpSessions.Delete(session.id)
+			if session.tunnel.tunnel.IsClosed() {
+				continue
+			}
+			if err := session.tunnel.tunnel.Send(protocol.MessageKindUdpClose, &protocol.UdpClosePayload{SessionID: session.id}); err != nil {
+				r.l.Debug("failed to send udp close", "error", err.Error())
+			}
+		}
+	}
+}
+
+// port returns the public port.
+func (r *udpRelay) port() int {
+	return r.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// close closes the public port and ends every session.
+func (r *udpRelay) close() {
+	r.conn.Close()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, session := range r.sessions {
+		session.tunnel.udpSessions.Delete(session.id)
+	}
+	r.sessions = nil
+}
+
+func (s *Tunnel) handleUdpDatagram(tunnel *shared.Tunnel, id string, payload protocol.UdpDatagramPayload) {
+	session, ok := s.udpSessions.Get(payload.SessionID)
+	if !ok {
+		return
+	}
+	session.touch()
+	if _, err := session.conn.WriteTo(payload.Data, session.addr); err != nil {
+		s.l.Debug("failed to write udp datagram", "session_id", payload.SessionID, "error", err.Error())
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/campbel/tiny-tunnel/core/protocol"
+	"github.com/google/uuid"
+)
+
+// isUpgrade reports whether r asks to switch protocols (SPDY for kubectl
+// exec, h2c, ...). Websockets are checked for first: they are relayed
+// message by message instead.
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveUpgrade relays an upgrade request to the client. When the target
+// switches protocols the visitor's connection is hijacked and relayed as an
+// opaque byte stream both ways, like a TCP connection; any other response
+// is written as usual.
+func (s *Tunnel) serveUpgrade(w http.ResponseWriter, r *http.Request) error {
+	path := r.URL.Path
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+
+	connID := uuid.New().String()
+	session := s.openTCPSession(connID)
+	defer s.closeTCPSession(connID, session)
+
+	start := time.Now()
+	responseChannel := make(chan protocol.Message, 1)
+	requestID, clean, err := s.tunnel.SendWithResponseChannel(protocol.MessageKindHttpUpgradeRequest, &protocol.HttpUpgradeRequestPayload{
+		ConnID:     connID,
+		Method:     r.Method,
+		Path:       path,
+		Headers:    r.Header,
+		RemoteAddr: s.visitorAddr(r),
+		Host:       r.Host,
+		Scheme:     s.visitorScheme(r),
+	}, responseChannel)
+	if err != nil {
+		session.attach(nil)
+		if clean != nil {
+			clean()
+		}
+		s.l.Error("failed to send upgrade request", "error", err.Error())
+		return errTunnelUnavailable
+	}
+	defer clean()
+
+	// abandon drops the stream in case the target switches protocols
+	// after all.
+	abandon := func() {
+		session.attach(nil)
+		if err := s.tunnel.Send(protocol.MessageKindTcpClose, &protocol.TcpClosePayload{ConnID: connID}); err != nil {
+			s.l.Debug("failed to send tcp close", "error", err.Error())
+		}
+	}
+
+	head := newDeadline(s.options.ResponseHeaderTimeout)
+	head.reset()
+	defer head.stop()
+	var msg protocol.Message
+	select {
+	case msg = <-responseChannel:
+	case <-head.C:
+		s.l.Info("timed out waiting for upgrade response", "request_id", requestID, "path", path)
+		abandon()
+		timeout := &protocol.Error{Code: protocol.ErrorCodeTimeout}
+		http.Error(w, errorText(timeout), errorStatus(timeout))
+		return nil
+	case <-r.Context().Done():
+		abandon()
+		return nil
+	case <-s.tunnel.Done():
+		session.attach(nil)
+		http.Error(w, "tunnel closed", http.StatusBadGateway)
+		return nil
+	}
+
+	var response protocol.HttpResponsePayload
+	if msg.Kind != protocol.MessageKindHttpResponse || msg.DecodePayload(&response) != nil {
+		abandon()
+		http.Error(w, "", http.StatusInternalServerError)
+		return nil
+	}
+	if response.Error != nil || response.Response.Status != http.StatusSwitchingProtocols {
+		session.attach(nil)
+		s.writeBufferedResponse(w, msg, start)
+		return nil
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		s.l.Error("failed to hijack upgraded connection", "error", err.Error())
+		abandon()
+		http.Error(w, "", http.StatusInternalServerError)
+		return nil
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 %d %s\r\n", response.Response.Status, http.StatusText(response.Response.Status))
+	response.Response.Headers.Write(rw)
+	rw.WriteString("\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		abandon()
+		return nil
+	}
+	// Bytes the visitor sent right after the request may be buffered.
+	visitor := &peekedConn{Conn: conn, r: rw.Reader}
+	session.attach(visitor)
+	s.l.Info("upgraded connection", "protocol", response.Response.Headers.Get("Upgrade"), "path", path)
+	s.pumpTCP(connID, visitor)
+	return nil
+}
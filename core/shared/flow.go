@@ -0,0 +1,258 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/campbel/tiny-tunnel/core/protocol"
+	"github.com/campbel/tiny-tunnel/internal/safe"
+)
+
+// Flow control
+//
+// When both peers negotiate FeatureFlowControl every stream (a streamed
+// request or response, a websocket session) gets a window of
+// protocol.InitialWindowSize bytes in each direction. Senders charge data to
+// the window with AcquireWindow and stop once it is used up; receivers queue
+// what arrives in an Inbox, so the read loop never waits on a slow consumer,
+// and grant the bytes back with WindowUpdate messages as they are consumed.
+
+// windowUpdateThreshold is how many consumed bytes a receiver accumulates
+// before granting them back, so small messages don't each cost an update.
+const windowUpdateThreshold = protocol.InitialWindowSize / 4
+
+// legacyInboxLimit bounds an inbox when flow control was not negotiated;
+// a full inbox stalls the read loop, which is the only backpressure legacy
+// peers understand.
+const legacyInboxLimit = 64
+
+var errStreamClosed = errors.New("stream closed")
+
+// FlowControl reports whether per-stream flow control was negotiated.
+func (t *Tunnel) FlowControl() bool {
+	return t.capabilities.Has(protocol.FeatureFlowControl)
+}
+
+type sendWindow struct {
+	mu          sync.Mutex
+	outstanding int64
+	closed      bool
+	// changed is closed and replaced whenever credit is granted or the
+	// window is released.
+	changed chan struct{}
+}
+
+// AcquireWindow waits until the peer can take more data on streamID and
+// charges n bytes to the stream's window. A sender may overshoot the window
+// by one message, so messages larger than the window still go through. It
+// returns immediately when flow control was not negotiated.
+func (t *Tunnel) AcquireWindow(ctx context.Context, streamID string, n int) error {
+	if !t.FlowControl() {
+		return nil
+	}
+	w, ok := t.sendWindows.Get(streamID)
+	if !ok {
+		t.sendWindows.SetNX(streamID, &sendWindow{changed: make(chan struct{})})
+		if w, ok = t.sendWindows.Get(streamID); !ok {
+			return errStreamClosed
+		}
+	}
+
+	for {
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			return errStreamClosed
+		}
+		if w.outstanding < protocol.InitialWindowSize {
+			w.outstanding += int64(n)
+			w.mu.Unlock()
+			return nil
+		}
+		changed := w.changed
+		w.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.closeChan:
+			return errStreamClosed
+		}
+	}
+}
+
+// ReleaseWindow discards the send window of streamID, failing any
+// AcquireWindow still waiting on it. Senders call it once a stream ends.
+func (t *Tunnel) ReleaseWindow(streamID string) {
+	w, ok := t.sendWindows.Get(streamID)
+	if !ok {
+		return
+	}
+	t.sendWindows.Delete(streamID)
+	w.mu.Lock()
+	w.closed = true
+	close(w.changed)
+	w.mu.Unlock()
+}
+
+// handleWindowUpdate returns credit granted by the peer to the stream's
+// send window. Updates for streams that already ended are ignored.
+func handleWindowUpdate(tunnel *Tunnel, id string, payload protocol.WindowUpdatePayload) {
+	w, ok := tunnel.sendWindows.Get(payload.StreamID)
+	if !ok {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	w.outstanding -= payload.Increment
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// ReceiveWindow tracks the data consumed on one incoming stream and grants
+// it back to the sender.
+type ReceiveWindow struct {
+	tunnel   *Tunnel
+	streamID string
+
+	mu      sync.Mutex
+	pending int64
+}
+
+func (t *Tunnel) NewReceiveWindow(streamID string) *ReceiveWindow {
+	return &ReceiveWindow{tunnel: t, streamID: streamID}
+}
+
+// Consume records that n bytes received on the stream were handled. Credit
+// is granted back to the peer in batches.
+func (w *ReceiveWindow) Consume(n int) {
+	if n == 0 || !w.tunnel.FlowControl() {
+		return
+	}
+	w.mu.Lock()
+	w.pending += int64(n)
+	if w.pending < windowUpdateThreshold {
+		w.mu.Unlock()
+		return
+	}
+	increment := w.pending
+	w.pending = 0
+	w.mu.Unlock()
+
+	if err := w.tunnel.Send(protocol.MessageKindWindowUpdate, &protocol.WindowUpdatePayload{
+		StreamID:  w.streamID,
+		Increment: increment,
+	}); err != nil {
+		w.tunnel.l.Debug("failed to send window update", "stream_id", w.streamID, "error", err.Error())
+	}
+}
+
+// Inbox runs the deliveries of one incoming stream on its own goroutine so
+// a slow destination (a visitor's websocket, a target reading a request
+// body) never blocks the tunnel read loop. The bytes of each delivery are
+// granted back to the peer once it returns.
+//
+// With flow control the bytes queued are bounded by the window the peer was
+// granted. A peer that sends past it is broken or hostile; like an HTTP/2
+// FLOW_CONTROL_ERROR, the tunnel is closed rather than left to buffer
+// without limit.
+type Inbox struct {
+	tunnel *Tunnel
+	// window grants consumed bytes back to the peer; nil when the consumer
+	// grants them itself.
+	window *ReceiveWindow
+	queue  *safe.Queue[delivery]
+	// queued counts the bytes pushed but not yet delivered.
+	queued atomic.Int64
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type delivery struct {
+	n  int
+	fn func()
+}
+
+// NewInbox starts an inbox for streamID. It runs until Close is called or
+// the tunnel closes.
+func (t *Tunnel) NewInbox(streamID string) *Inbox {
+	return t.newInbox(t.NewReceiveWindow(streamID))
+}
+
+func (t *Tunnel) newInbox(window *ReceiveWindow) *Inbox {
+	limit := 0
+	if !t.FlowControl() {
+		limit = legacyInboxLimit
+	}
+	ctx, cancel := context.WithCancel(t.ctx)
+	i := &Inbox{
+		tunnel: t,
+		window: window,
+		queue:  safe.NewQueue[delivery](limit),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	go i.run()
+	return i
+}
+
+// Push queues fn, which delivers n bytes of stream data. Deliveries run in
+// order. Push only blocks when flow control was not negotiated and the
+// inbox is full.
+//
+// A sender only sends while its window has room, so the bytes still queued
+// never reach the window; data pushed once they do overran it.
+func (i *Inbox) Push(n int, fn func()) {
+	if i.ctx.Err() != nil {
+		return
+	}
+	if n > 0 && i.tunnel.FlowControl() && i.queued.Load() >= protocol.InitialWindowSize {
+		i.tunnel.l.Error("peer overran a stream's flow control window, closing tunnel", "queued", i.queued.Load())
+		i.Close()
+		i.tunnel.Close()
+		return
+	}
+	i.queued.Add(int64(n))
+	if !i.queue.Push(delivery{n: n, fn: fn}, i.ctx.Done()) {
+		i.queued.Add(-int64(n))
+	}
+}
+
+// Close stops the inbox; deliveries still queued are dropped.
+func (i *Inbox) Close() {
+	i.cancel()
+}
+
+func (i *Inbox) run() {
+	for {
+		d, ok := i.queue.Pop(i.ctx.Done())
+		if !ok {
+			return
+		}
+		d.fn()
+		i.queued.Add(-int64(d.n))
+		if i.window != nil {
+			i.window.Consume(d.n)
+		}
+	}
+}
+
+// chunkSize returns the bytes of stream data msg charges to its stream's
+// window: the data of a streamed response chunk, or none for any other
+// response.
+func chunkSize(msg protocol.Message) int {
+	if msg.Kind != protocol.MessageKindHttpResponseChunk {
+		return 0
+	}
+	var chunk protocol.HttpResponseChunkPayload
+	if err := msg.DecodePayload(&chunk); err != nil {
+		return 0
+	}
+	return len(chunk.Data)
+}
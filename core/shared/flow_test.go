@@ -0,0 +1,162 @@
+package shared
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/campbel/tiny-tunnel/core/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func flowControlTunnels(t *testing.T) (*Tunnel, *Tunnel) {
+	t.Helper()
+	caps := protocol.Capabilities{
+		Version:  protocol.ProtocolVersion,
+		Features: []string{protocol.FeatureBinaryFrames, protocol.FeatureFlowControl},
+	}
+	clientTunnel, serverTunnel, err := handshakeTunnels(t, caps, caps)
+	require.NoError(t, err)
+	t.Cleanup(clientTunnel.Close)
+	t.Cleanup(serverTunnel.Close)
+	require.True(t, clientTunnel.FlowControl())
+	return clientTunnel, serverTunnel
+}
+
+func TestSlowStreamDoesNotBlockTunnel(t *testing.T) {
+	assert := assert.New(t)
+	clientTunnel, serverTunnel := flowControlTunnels(t)
+
+	// The client streams a response for every request as fast as the
+	// window allows.
+	chunk := make([]byte, 32*1024)
+	var sent atomic.Int64
+	clientTunnel.RegisterHttpRequestHandler(func(tunnel *Tunnel, id string, payload protocol.HttpRequestPayload) {
+		if payload.Path == "/fast" {
+			tunnel.SendResponse(protocol.MessageKindHttpResponse, id, &protocol.HttpResponsePayload{})
+			return
+		}
+		go func() {
+			defer tunnel.ReleaseWindow(id)
+			for {
+				if err := tunnel.AcquireWindow(tunnel.Context(), id, len(chunk)); err != nil {
+					return
+				}
+				if err := tunnel.SendResponse(protocol.MessageKindHttpResponseChunk, id, &protocol.HttpResponseChunkPayload{Data: chunk}); err != nil {
+					return
+				}
+				sent.Add(int64(len(chunk)))
+			}
+		}()
+	})
+
+	// Nobody reads the slow stream.
+	_, cleanSlow, err := serverTunnel.SendWithResponseChannel(protocol.MessageKindHttpRequest, &protocol.HttpRequestPayload{Path: "/slow"}, make(chan protocol.Message, 1))
+	require.NoError(t, err)
+	defer cleanSlow()
+
+	// The sender stalls once the window is used up.
+	assert.Eventually(func() bool { return sent.Load() >= protocol.InitialWindowSize }, time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.LessOrEqual(sent.Load(), int64(protocol.InitialWindowSize+len(chunk)))
+
+	// Other requests still get through.
+	fast := make(chan protocol.Message, 1)
+	_, cleanFast, err := serverTunnel.SendWithResponseChannel(protocol.MessageKindHttpRequest, &protocol.HttpRequestPayload{Path: "/fast"}, fast)
+	require.NoError(t, err)
+	defer cleanFast()
+	select {
+	case msg := <-fast:
+		assert.Equal(protocol.MessageKindHttpResponse, msg.Kind)
+	case <-time.After(time.Second):
+		t.Fatal("request blocked behind a stalled stream")
+	}
+}
+
+func TestWindowUpdatesResumeSender(t *testing.T) {
+	clientTunnel, serverTunnel := flowControlTunnels(t)
+
+	const total = 4 * protocol.InitialWindowSize
+	chunk := make([]byte, 16*1024)
+	clientTunnel.RegisterHttpRequestHandler(func(tunnel *Tunnel, id string, payload protocol.HttpRequestPayload) {
+		go func() {
+			defer tunnel.ReleaseWindow(id)
+			for n := 0; n < total; n += len(chunk) {
+				if err := tunnel.AcquireWindow(tunnel.Context(), id, len(chunk)); err != nil {
+					return
+				}
+				tunnel.SendResponse(protocol.MessageKindHttpResponseChunk, id, &protocol.HttpResponseChunkPayload{Data: chunk})
+			}
+		}()
+	})
+
+	responses := make(chan protocol.Message, 1)
+	id, clean, err := serverTunnel.SendWithResponseChannel(protocol.MessageKindHttpRequest, &protocol.HttpRequestPayload{}, responses)
+	require.NoError(t, err)
+	defer clean()
+
+	window := serverTunnel.NewReceiveWindow(id)
+	received := 0
+	for received < total {
+		select {
+		case msg := <-responses:
+			var payload protocol.HttpResponseChunkPayload
+			require.NoError(t, msg.DecodePayload(&payload))
+			received += len(payload.Data)
+			window.Consume(len(payload.Data))
+		case <-time.After(time.Second):
+			t.Fatalf("stream stalled after %d bytes", received)
+		}
+	}
+	assert.Equal(t, total, received)
+}
+
+func TestReleaseWindowFailsWaitingSender(t *testing.T) {
+	clientTunnel, _ := flowControlTunnels(t)
+
+	require.NoError(t, clientTunnel.AcquireWindow(context.Background(), "stream", protocol.InitialWindowSize))
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- clientTunnel.AcquireWindow(context.Background(), "stream", 1)
+	}()
+	select {
+	case err := <-errc:
+		t.Fatalf("acquired beyond the window: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clientTunnel.ReleaseWindow("stream")
+	assert.ErrorIs(t, <-errc, errStreamClosed)
+}
+
+func TestSenderOverrunningWindowClosesTunnel(t *testing.T) {
+	clientTunnel, serverTunnel := flowControlTunnels(t)
+
+	// The server never gets to deliver what arrives on the stream.
+	stuck := make(chan struct{})
+	defer close(stuck)
+	inbox := serverTunnel.NewInbox("stream")
+	serverTunnel.RegisterTcpDataHandler(func(tunnel *Tunnel, id string, payload protocol.TcpDataPayload) {
+		inbox.Push(len(payload.Data), func() { <-stuck })
+	})
+
+	// The client ignores its window and keeps sending.
+	chunk := make([]byte, 32*1024)
+	go func() {
+		for i := 0; i < 4*protocol.InitialWindowSize/len(chunk); i++ {
+			if err := clientTunnel.Send(protocol.MessageKindTcpData, &protocol.TcpDataPayload{ConnID: "stream", Data: chunk}); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-serverTunnel.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("tunnel kept buffering past the window")
+	}
+	assert.LessOrEqual(t, inbox.queued.Load(), int64(protocol.InitialWindowSize+len(chunk)))
+}
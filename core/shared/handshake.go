@@ -0,0 +1,112 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/campbel/tiny-tunnel/core/protocol"
+)
+
+// handshakeTimeout bounds the Hello/HelloAck exchange when the caller's
+// context has no deadline of its own.
+const handshakeTimeout = 10 * time.Second
+
+// Capabilities returns the capabilities negotiated with the peer. Handlers
+// use it to avoid message kinds the peer would not understand.
+func (t *Tunnel) Capabilities() protocol.Capabilities {
+	return t.capabilities
+}
+
+// negotiatesHandshake reports whether the peer agreed to open the tunnel
+// with a Hello/HelloAck exchange.
+func (t *Tunnel) negotiatesHandshake() bool {
+	return t.conn.Conn().Subprotocol() == protocol.SubprotocolHandshake
+}
+
+// ClientHandshake sends our Hello and waits for the server's HelloAck. It is
+// a no-op against servers that predate the handshake. It must be called
+// before Listen and before anything else is sent.
+func (t *Tunnel) ClientHandshake(ctx context.Context, local protocol.Capabilities) error {
+	if !t.negotiatesHandshake() {
+		return nil
+	}
+	if err := t.Send(protocol.MessageKindHello, &protocol.HelloPayload{Capabilities: local}); err != nil {
+		return err
+	}
+
+	msg, err := t.readHandshake(ctx, protocol.MessageKindHelloAck)
+	if err != nil {
+		return err
+	}
+	var ack protocol.HelloAckPayload
+	if err := msg.DecodePayload(&ack); err != nil {
+		return err
+	}
+	if ack.Error != "" {
+		return fmt.Errorf("server rejected handshake: %s", ack.Error)
+	}
+	t.apply(ack.Capabilities)
+	return nil
+}
+
+// ServerHandshake waits for the client's Hello, replies with the agreed
+// capabilities and applies them. Clients that predate the handshake keep
+// their legacy capabilities. It must be called before Listen.
+func (t *Tunnel) ServerHandshake(ctx context.Context, supported protocol.Capabilities) error {
+	if !t.negotiatesHandshake() {
+		return nil
+	}
+
+	msg, err := t.readHandshake(ctx, protocol.MessageKindHello)
+	if err != nil {
+		return err
+	}
+	var hello protocol.HelloPayload
+	if err := msg.DecodePayload(&hello); err != nil {
+		return err
+	}
+
+	agreed := supported.Negotiate(hello.Capabilities)
+	if agreed.Version < 1 {
+		err := fmt.Errorf("unsupported protocol version %d", hello.Version)
+		t.SendResponse(protocol.MessageKindHelloAck, msg.ID, &protocol.HelloAckPayload{Error: err.Error()})
+		return err
+	}
+	if err := t.SendResponse(protocol.MessageKindHelloAck, msg.ID, &protocol.HelloAckPayload{Capabilities: agreed}); err != nil {
+		return err
+	}
+	t.apply(agreed)
+	return nil
+}
+
+// readHandshake reads the next message, which must be of the given kind,
+// honoring the context deadline.
+func (t *Tunnel) readHandshake(ctx context.Context, kind int) (protocol.Message, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(handshakeTimeout)
+	}
+	t.conn.SetReadDeadline(deadline)
+	defer t.conn.SetReadDeadline(time.Time{})
+
+	msg, err := t.read()
+	if err != nil {
+		return protocol.Message{}, fmt.Errorf("handshake: %w", err)
+	}
+	if msg.Kind != kind {
+		return protocol.Message{}, errors.New("handshake: unexpected message kind")
+	}
+	return msg, nil
+}
+
+// apply records the negotiated capabilities and switches the connection to
+// the agreed encoding and compression.
+func (t *Tunnel) apply(caps protocol.Capabilities) {
+	t.capabilities = caps
+	if caps.Has(protocol.FeatureBinaryFrames) {
+		t.encoding = protocol.EncodingBinary
+	}
+	t.conn.EnableWriteCompression(caps.Has(protocol.FeatureCompression))
+}
@@ -0,0 +1,99 @@
+package shared
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/campbel/tiny-tunnel/core/protocol"
+	"github.com/campbel/tiny-tunnel/internal/log"
+	"github.com/campbel/tiny-tunnel/internal/util"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// handshakeTunnels connects a client and server tunnel over the handshake
+// subprotocol and runs the handshake on both sides before listening.
+func handshakeTunnels(t *testing.T, clientCaps, serverCaps protocol.Capabilities) (*Tunnel, *Tunnel, error) {
+	t.Helper()
+
+	type result struct {
+		tunnel *Tunnel
+		err    error
+	}
+	serverChan := make(chan result, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{Subprotocols: []string{protocol.SubprotocolHandshake}}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		serverTunnel := NewTunnel(conn, log.NewTestLogger())
+		err = serverTunnel.ServerHandshake(context.Background(), serverCaps)
+		serverChan <- result{serverTunnel, err}
+		if err == nil {
+			serverTunnel.Listen(context.Background())
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	wsURL, err := util.GetWebsocketURL(server.URL)
+	require.NoError(t, err)
+	dialer := websocket.Dialer{Subprotocols: []string{protocol.SubprotocolHandshake}}
+	conn, _, err := dialer.Dial(wsURL.String(), nil)
+	require.NoError(t, err)
+
+	clientTunnel := NewTunnel(conn, log.NewTestLogger())
+	clientErr := clientTunnel.ClientHandshake(context.Background(), clientCaps)
+	serverResult := <-serverChan
+	if clientErr != nil {
+		return nil, nil, clientErr
+	}
+	require.NoError(t, serverResult.err)
+	go clientTunnel.Listen(context.Background())
+	return clientTunnel, serverResult.tunnel, nil
+}
+
+func TestHandshakeNegotiatesCapabilities(t *testing.T) {
+	assert := assert.New(t)
+
+	clientTunnel, serverTunnel, err := handshakeTunnels(t,
+		protocol.Capabilities{Version: protocol.ProtocolVersion, Features: []string{protocol.FeatureStreaming, protocol.FeatureBinaryFrames}},
+		protocol.Capabilities{Version: protocol.ProtocolVersion, Features: []string{protocol.FeatureBinaryFrames, protocol.FeatureCompression}},
+	)
+	require.NoError(t, err)
+	defer clientTunnel.Close()
+	defer serverTunnel.Close()
+
+	expected := protocol.Capabilities{Version: protocol.ProtocolVersion, Features: []string{protocol.FeatureBinaryFrames}}
+	assert.Equal(expected, clientTunnel.Capabilities())
+	assert.Equal(expected, serverTunnel.Capabilities())
+	assert.Equal(protocol.EncodingBinary, clientTunnel.Encoding())
+	assert.Equal(protocol.EncodingBinary, serverTunnel.Encoding())
+
+	// Traffic flows in the agreed encoding after the handshake.
+	received := make(chan string, 1)
+	serverTunnel.RegisterTextHandler(func(tunnel *Tunnel, id string, payload protocol.TextPayload) {
+		received <- payload.Text
+	})
+	assert.NoError(clientTunnel.Send(protocol.MessageKindText, &protocol.TextPayload{Text: "hello"}))
+	assert.Equal("hello", <-received)
+}
+
+func TestHandshakeRejectsUnsupportedVersion(t *testing.T) {
+	_, _, err := handshakeTunnels(t,
+		protocol.Capabilities{Version: 0},
+		protocol.Capabilities{Version: protocol.ProtocolVersion},
+	)
+	assert.ErrorContains(t, err, "unsupported protocol version")
+}
+
+func TestLegacyPeerSkipsHandshake(t *testing.T) {
+	clientTunnel, serverTunnel := createConnectedTunnels(t)
+	defer clientTunnel.Close()
+	defer serverTunnel.Close()
+
+	assert.NoError(t, clientTunnel.ClientHandshake(context.Background(), protocol.Capabilities{Version: protocol.ProtocolVersion}))
+	assert.Equal(t, protocol.LegacyCapabilities(), clientTunnel.Capabilities())
+	assert.Equal(t, protocol.EncodingJSON, clientTunnel.Encoding())
+}
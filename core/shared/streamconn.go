@@ -0,0 +1,85 @@
+package shared
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// StreamConn is a byte stream carried over a websocket as binary messages,
+// for connections relayed verbatim such as `tnl connect`'s. Message
+// boundaries carry no meaning.
+type StreamConn struct {
+	conn *websocket.Conn
+	// r is the message being read.
+	r io.Reader
+	// mu serializes writers.
+	mu sync.Mutex
+}
+
+var _ net.Conn = (*StreamConn)(nil)
+
+func NewStreamConn(conn *websocket.Conn) *StreamConn {
+	return &StreamConn{conn: conn}
+}
+
+// Read reads from the stream. A normal websocket close reads as io.EOF.
+func (c *StreamConn) Read(p []byte) (int, error) {
+	for {
+		if c.r == nil {
+			kind, r, err := c.conn.NextReader()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return 0, io.EOF
+			}
+			if err != nil {
+				return 0, err
+			}
+			if kind != websocket.BinaryMessage {
+				continue
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(p)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *StreamConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close tells the peer the stream ended before closing the connection.
+func (c *StreamConn) Close() error {
+	c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second))
+	return c.conn.Close()
+}
+
+func (c *StreamConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *StreamConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+func (c *StreamConn) SetDeadline(t time.Time) error {
+	if err := c.conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *StreamConn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *StreamConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
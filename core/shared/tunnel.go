@@ -16,21 +16,34 @@ import (
 type Tunnel struct {
 	conn *safe.WSConn
 
+	// encoding is the wire format for outgoing messages, fixed by the
+	// websocket subprotocol or the handshake before any traffic flows.
+	encoding protocol.Encoding
+	// capabilities are the features both peers agreed on.
+	capabilities protocol.Capabilities
+
 	// closure
 	isClosed     bool
 	closeHandler func()
 	closeChan    chan struct{} // Channel to signal tunnel closure
 	closeMu      sync.Mutex
 
+	// goingAway is closed when the peer announces it is shutting down.
+	goingAway     chan struct{}
+	goingAwayOnce sync.Once
+
 	// For context management and cleanup
 	ctx        context.Context
 	cancelFunc context.CancelFunc
 
-	// responseChannels is a map of message IDs to the channel that wants to receive the response
-	responseChannels *safe.Map[string, chan protocol.Message]
+	// responseChannels is a map of message IDs to the route of the channel that wants to receive the response
+	responseChannels *safe.Map[string, responseRoute]
+
+	// sendWindows holds the flow control credit of streams we send on.
+	sendWindows *safe.Map[string, *sendWindow]
 
 	// Handlers
-	handlerRegistry map[int]func(tunnel *Tunnel, id string, payload []byte)
+	handlerRegistry map[int]func(tunnel *Tunnel, msg protocol.Message)
 
 	// Context for storing arbitrary data
 	context   map[string]interface{}
@@ -45,17 +58,42 @@ type Tunnel struct {
 
 func NewTunnel(conn *websocket.Conn, l log.Logger) *Tunnel {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Tunnel{
-		conn:             safe.NewWSConn(conn),
-		responseChannels: safe.NewMap[string, chan protocol.Message](),
+	// Until a handshake says otherwise the peer is assumed to be legacy;
+	// SubprotocolBinary predates the handshake and implies binary frames.
+	encoding := protocol.EncodingJSON
+	capabilities := protocol.LegacyCapabilities()
+	if conn.Subprotocol() == protocol.SubprotocolBinary {
+		encoding = protocol.EncodingBinary
+		capabilities.Features = append(capabilities.Features, protocol.FeatureBinaryFrames)
+	}
+	wsConn := safe.NewWSConn(conn)
+	wsConn.EnableWriteCompression(false)
+	t := &Tunnel{
+		conn:             wsConn,
+		encoding:         encoding,
+		capabilities:     capabilities,
+		responseChannels: safe.NewMap[string, responseRoute](),
+		sendWindows:      safe.NewMap[string, *sendWindow](),
 		closeChan:        make(chan struct{}),
-		handlerRegistry:  make(map[int]func(tunnel *Tunnel, id string, payload []byte)),
+		goingAway:        make(chan struct{}),
+		handlerRegistry:  make(map[int]func(tunnel *Tunnel, msg protocol.Message)),
 		context:          make(map[string]interface{}),
 		lastReceiveTime:  time.Now(),
 		ctx:              ctx,
 		cancelFunc:       cancel,
 		l:                l,
 	}
+	t.registerHandler(protocol.MessageKindWindowUpdate, handlerFunc(handleWindowUpdate))
+	t.registerHandler(protocol.MessageKindGoAway, handlerFunc(handleGoAway))
+	return t
+}
+
+// responseRoute delivers responses to the channel registered with
+// SendWithResponseChannel through an inbox, so a consumer that falls behind
+// does not hold up the read loop.
+type responseRoute struct {
+	ch    chan protocol.Message
+	inbox *Inbox
 }
 
 func (t *Tunnel) Close() {
@@ -111,51 +149,83 @@ func (t *Tunnel) close(peerSent bool) {
 // responses addressed to it (RE == returned id). The returned id can be used
 // to reference the request in follow-up messages (e.g. stream cancellation).
 func (t *Tunnel) SendWithResponseChannel(kind int, message any, reChan chan protocol.Message) (string, func(), error) {
-	data, err := json.Marshal(message)
+	msg, err := t.newMessage(kind, "", message)
 	if err != nil {
 		return "", func() {}, err
 	}
-	msg := protocol.Message{
-		ID:      uuid.New().String(),
-		Kind:    kind,
-		Payload: data,
-	}
-	t.responseChannels.SetNX(msg.ID, reChan)
+	// The consumer grants credit for streamed chunks itself, once they
+	// reach their destination.
+	inbox := t.newInbox(nil)
+	t.responseChannels.SetNX(msg.ID, responseRoute{ch: reChan, inbox: inbox})
 	clean := func() {
 		t.responseChannels.Delete(msg.ID)
+		inbox.Close()
 	}
-	return msg.ID, clean, t.conn.WriteJSON(msg)
+	return msg.ID, clean, t.write(msg)
 }
 
 func (t *Tunnel) Send(kind int, message any) error {
-	data, err := json.Marshal(message)
+	msg, err := t.newMessage(kind, "", message)
 	if err != nil {
 		return err
 	}
-
-	msg := protocol.Message{
-		ID:      uuid.New().String(),
-		Kind:    kind,
-		Payload: data,
-	}
-	return t.conn.WriteJSON(msg)
+	return t.write(msg)
 }
 
 func (t *Tunnel) SendResponse(kind int, id string, message any) error {
-	data, err := json.Marshal(message)
+	msg, err := t.newMessage(kind, id, message)
 	if err != nil {
 		return err
 	}
+	return t.write(msg)
+}
+
+// Encoding returns the wire encoding used for messages sent on this tunnel.
+func (t *Tunnel) Encoding() protocol.Encoding {
+	return t.encoding
+}
 
-	msg := protocol.Message{
+func (t *Tunnel) newMessage(kind int, re string, message any) (protocol.Message, error) {
+	data, err := protocol.EncodePayload(t.encoding, message)
+	if err != nil {
+		return protocol.Message{}, err
+	}
+	return protocol.Message{
 		ID:      uuid.New().String(),
-		RE:      id,
+		RE:      re,
 		Kind:    kind,
 		Payload: data,
+	}, nil
+}
+
+// write sends msg in the tunnel's encoding: a binary frame when binary
+// frames were negotiated, JSON text otherwise.
+func (t *Tunnel) write(msg protocol.Message) error {
+	if t.encoding == protocol.EncodingBinary {
+		frame, err := protocol.MarshalFrame(msg)
+		if err != nil {
+			return err
+		}
+		return t.conn.WriteMessage(websocket.BinaryMessage, frame)
 	}
 	return t.conn.WriteJSON(msg)
 }
 
+// read receives the next message. The encoding is taken from the websocket
+// frame type, so either encoding is accepted regardless of what we send.
+func (t *Tunnel) read() (protocol.Message, error) {
+	mt, data, err := t.conn.ReadMessage()
+	if err != nil {
+		return protocol.Message{}, err
+	}
+	if mt == websocket.BinaryMessage {
+		return protocol.UnmarshalFrame(data)
+	}
+	var msg protocol.Message
+	err = json.Unmarshal(data, &msg)
+	return msg, err
+}
+
 func (t *Tunnel) Listen(ctx context.Context) {
 	go func() {
 		select {
@@ -167,8 +237,7 @@ func (t *Tunnel) Listen(ctx context.Context) {
 	}()
 
 	for {
-		var msg protocol.Message
-		err := t.conn.ReadJSON(&msg)
+		msg, err := t.read()
 		if err != nil {
 			// if err is websocket.CloseError, we need to close the tunnel
 			switch v := err.(type) {
@@ -195,23 +264,24 @@ func (t *Tunnel) Listen(ctx context.Context) {
 		// for spawning their own goroutines so they don't block this loop.
 
 		// If a message contains a RE, it is a response to a previous message.
-		// Deliver it in order to the channel waiting for the response. If the
-		// channel's buffer is full this applies backpressure to the tunnel;
-		// consumers must keep draining until the stream ends. Done() unblocks
-		// delivery when the tunnel closes.
+		// Queue it in order for the channel waiting for the response. With
+		// flow control the sender never outruns the consumer by more than a
+		// window; without it a full queue applies backpressure to the whole
+		// tunnel, so consumers must keep draining until the stream ends.
 		if msg.RE != "" {
-			if reChan, ok := t.responseChannels.Get(msg.RE); ok {
-				select {
-				case reChan <- msg:
-				case <-t.closeChan:
-					return
-				}
+			if route, ok := t.responseChannels.Get(msg.RE); ok {
+				route.inbox.Push(chunkSize(msg), func() {
+					select {
+					case route.ch <- msg:
+					case <-route.inbox.ctx.Done():
+					}
+				})
 			}
 			continue
 		}
 
 		if handler, ok := t.handlerRegistry[msg.Kind]; ok {
-			handler(t, msg.ID, msg.Payload)
+			handler(t, msg)
 		} else {
 			t.l.Error("no handler registered for message kind", "kind", msg.Kind)
 		}
@@ -249,18 +319,35 @@ func (t *Tunnel) Done() <-chan struct{} {
 	return t.closeChan
 }
 
-func (t *Tunnel) registerHandler(kind int, handler func(tunnel *Tunnel, id string, payload []byte)) {
+// SendGoAway tells the peer this end is shutting down. The tunnel keeps
+// working until it is closed.
+func (t *Tunnel) SendGoAway(reason string) error {
+	return t.Send(protocol.MessageKindGoAway, &protocol.GoAwayPayload{Reason: reason})
+}
+
+// GoingAway returns a channel that's closed when the peer announces it is
+// shutting down.
+func (t *Tunnel) GoingAway() <-chan struct{} {
+	return t.goingAway
+}
+
+func handleGoAway(t *Tunnel, id string, payload protocol.GoAwayPayload) {
+	t.l.Info("peer is going away", "reason", payload.Reason)
+	t.goingAwayOnce.Do(func() { close(t.goingAway) })
+}
+
+func (t *Tunnel) registerHandler(kind int, handler func(tunnel *Tunnel, msg protocol.Message)) {
 	t.handlerRegistry[kind] = handler
 }
 
-func handlerFunc[T any](handler func(tunnel *Tunnel, id string, payload T)) func(tunnel *Tunnel, id string, payload []byte) {
-	return func(tunnel *Tunnel, id string, payload []byte) {
+func handlerFunc[T any](handler func(tunnel *Tunnel, id string, payload T)) func(tunnel *Tunnel, msg protocol.Message) {
+	return func(tunnel *Tunnel, msg protocol.Message) {
 		var tPayload T
-		if err := json.Unmarshal(payload, &tPayload); err != nil {
+		if err := msg.DecodePayload(&tPayload); err != nil {
 			tunnel.l.Error("failed to unmarshal payload", "error", err.Error())
 			return
 		}
-		handler(tunnel, id, tPayload)
+		handler(tunnel, msg.ID, tPayload)
 	}
 }
 
@@ -287,3 +374,47 @@ func (t *Tunnel) RegisterWebsocketCloseHandler(handler func(tunnel *Tunnel, id s
 func (t *Tunnel) RegisterHttpStreamCancelHandler(handler func(tunnel *Tunnel, id string, payload protocol.HttpStreamCancelPayload)) {
 	t.registerHandler(protocol.MessageKindHttpStreamCancel, handlerFunc(handler))
 }
+
+func (t *Tunnel) RegisterRegisterAckHandler(handler func(tunnel *Tunnel, id string, payload protocol.RegisterAckPayload)) {
+	t.registerHandler(protocol.MessageKindRegisterAck, handlerFunc(handler))
+}
+
+func (t *Tunnel) RegisterHttpRequestStartHandler(handler func(tunnel *Tunnel, id string, payload protocol.HttpRequestStartPayload)) {
+	t.registerHandler(protocol.MessageKindHttpRequestStart, handlerFunc(handler))
+}
+
+func (t *Tunnel) RegisterHttpRequestChunkHandler(handler func(tunnel *Tunnel, id string, payload protocol.HttpRequestChunkPayload)) {
+	t.registerHandler(protocol.MessageKindHttpRequestChunk, handlerFunc(handler))
+}
+
+func (t *Tunnel) RegisterHttpRequestEndHandler(handler func(tunnel *Tunnel, id string, payload protocol.HttpRequestEndPayload)) {
+	t.registerHandler(protocol.MessageKindHttpRequestEnd, handlerFunc(handler))
+}
+
+func (t *Tunnel) RegisterTcpOpenHandler(handler func(tunnel *Tunnel, id string, payload protocol.TcpOpenPayload)) {
+	t.registerHandler(protocol.MessageKindTcpOpen, handlerFunc(handler))
+}
+
+func (t *Tunnel) RegisterTcpDataHandler(handler func(tunnel *Tunnel, id string, payload protocol.TcpDataPayload)) {
+	t.registerHandler(protocol.MessageKindTcpData, handlerFunc(handler))
+}
+
+func (t *Tunnel) RegisterTcpOpenedHandler(handler func(tunnel *Tunnel, id string, payload protocol.TcpOpenedPayload)) {
+	t.registerHandler(protocol.MessageKindTcpOpened, handlerFunc(handler))
+}
+
+func (t *Tunnel) RegisterTcpCloseHandler(handler func(tunnel *Tunnel, id string, payload protocol.TcpClosePayload)) {
+	t.registerHandler(protocol.MessageKindTcpClose, handlerFunc(handler))
+}
+
+func (t *Tunnel) RegisterUdpDatagramHandler(handler func(tunnel *Tunnel, id string, payload protocol.UdpDatagramPayload)) {
+	t.registerHandler(protocol.MessageKindUdpDatagram, handlerFunc(handler))
+}
+
+func (t *Tunnel) RegisterUdpCloseHandler(handler func(tunnel *Tunnel, id string, payload protocol.UdpClosePayload)) {
+	t.registerHandler(protocol.MessageKindUdpClose, handlerFunc(handler))
+}
+
+func (t *Tunnel) RegisterHttpUpgradeRequestHandler(handler func(tunnel *Tunnel, id string, payload protocol.HttpUpgradeRequestPayload)) {
+	t.registerHandler(protocol.MessageKindHttpUpgradeRequest, handlerFunc(handler))
+}
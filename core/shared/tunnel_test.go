@@ -43,7 +43,9 @@ func TestTunnel(t *testing.T) {
 	clientTunnel.Close()
 }
 
-func createConnectedTunnels(t *testing.T) (*Tunnel, *Tunnel) {
+// createConnectedTunnels connects a client and server tunnel. Subprotocols,
+// when given, are offered by the client and accepted by the server.
+func createConnectedTunnels(t testing.TB, subprotocols ...string) (*Tunnel, *Tunnel) {
 	assert := assert.New(t)
 
 	serverTunnelChan := make(chan *Tunnel)
@@ -52,6 +54,7 @@ func createConnectedTunnels(t *testing.T) (*Tunnel, *Tunnel) {
 			CheckOrigin: func(r *http.Request) bool {
 				return true
 			},
+			Subprotocols: subprotocols,
 		}
 		conn, err := upgrader.Upgrade(w, r, nil)
 		assert.NoError(err)
@@ -67,7 +70,8 @@ func createConnectedTunnels(t *testing.T) (*Tunnel, *Tunnel) {
 	if !assert.NoError(err) {
 		t.FailNow()
 	}
-	conn, _, err := websocket.DefaultDialer.Dial(serverWSURL.String(), nil)
+	dialer := websocket.Dialer{Subprotocols: subprotocols}
+	conn, _, err := dialer.Dial(serverWSURL.String(), nil)
 	if !assert.NoError(err) {
 		t.FailNow()
 	}
@@ -77,6 +81,35 @@ func createConnectedTunnels(t *testing.T) (*Tunnel, *Tunnel) {
 	return clientTunnel, <-serverTunnelChan
 }
 
+func TestTunnelBinaryFrames(t *testing.T) {
+	assert := assert.New(t)
+	clientTunnel, serverTunnel := createConnectedTunnels(t, protocol.SubprotocolBinary)
+	defer clientTunnel.Close()
+	defer serverTunnel.Close()
+
+	assert.Equal(protocol.EncodingBinary, clientTunnel.Encoding())
+	assert.Equal(protocol.EncodingBinary, serverTunnel.Encoding())
+
+	body := []byte{0x00, 0x01, 0x02, 0xff}
+	clientTunnel.RegisterHttpRequestHandler(func(tunnel *Tunnel, id string, payload protocol.HttpRequestPayload) {
+		tunnel.SendResponse(protocol.MessageKindHttpResponseChunk, id, &protocol.HttpResponseChunkPayload{Data: payload.Body})
+	})
+
+	responseChan := make(chan protocol.Message, 1)
+	_, clean, err := serverTunnel.SendWithResponseChannel(protocol.MessageKindHttpRequest, &protocol.HttpRequestPayload{
+		Method: "POST",
+		Body:   body,
+	}, responseChan)
+	assert.NoError(err)
+	defer clean()
+
+	msg := <-responseChan
+	assert.Equal(protocol.EncodingBinary, msg.Encoding)
+	var chunk protocol.HttpResponseChunkPayload
+	assert.NoError(msg.DecodePayload(&chunk))
+	assert.Equal(body, chunk.Data)
+}
+
 func TestTunnelClose(t *testing.T) {
 	assert := assert.New(t)
 
@@ -123,3 +156,40 @@ func TestTunnelClose(t *testing.T) {
 	assert.True(clientTunnel.isClosed, "client tunnel should be closed")
 	assert.True(serverTunnel.isClosed, "server tunnel should be closed")
 }
+
+// benchmarkThroughput streams 32KiB chunks from the client to a response
+// channel on the server over a real websocket.
+func benchmarkThroughput(b *testing.B, subprotocols ...string) {
+	clientTunnel, serverTunnel := createConnectedTunnels(b, subprotocols...)
+	defer clientTunnel.Close()
+	defer serverTunnel.Close()
+
+	chunk := make([]byte, 32*1024)
+	clientTunnel.RegisterHttpRequestHandler(func(tunnel *Tunnel, id string, payload protocol.HttpRequestPayload) {
+		go func() {
+			for i := 0; i < b.N; i++ {
+				tunnel.SendResponse(protocol.MessageKindHttpResponseChunk, id, &protocol.HttpResponseChunkPayload{Data: chunk})
+			}
+		}()
+	})
+
+	responseChan := make(chan protocol.Message, 64)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	_, clean, err := serverTunnel.SendWithResponseChannel(protocol.MessageKindHttpRequest, &protocol.HttpRequestPayload{Method: "GET"}, responseChan)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer clean()
+	for i := 0; i < b.N; i++ {
+		var payload protocol.HttpResponseChunkPayload
+		if err := (<-responseChan).DecodePayload(&payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkTunnelThroughputJSON(b *testing.B) { benchmarkThroughput(b) }
+func BenchmarkTunnelThroughputBinary(b *testing.B) {
+	benchmarkThroughput(b, protocol.SubprotocolBinary)
+}
@@ -9,10 +9,28 @@ type StateProvider interface {
 	SetStatus(status Status)
 	SetStatusMessage(message string)
 	SetURL(url string)
+	SetRegistration(registration Registration)
 	GetStatus() Status
 	GetConnectionDuration() time.Duration
 	GetURL() string
 	GetTarget() string
+	GetRegistration() Registration
+}
+
+// Registration is what the server told us about the tunnel when it was
+// registered.
+type Registration struct {
+	TunnelID      string
+	URLs          []string
+	ServerVersion string
+	// Identity is the authenticated owner, empty when the server does not
+	// require authentication.
+	Identity string
+	// MaxRequestBodyBytes is the server's request body limit; zero means
+	// unlimited.
+	MaxRequestBodyBytes int64
+	// ResumeToken reclaims the name when reconnecting after a drop.
+	ResumeToken string
 }
 
 // TunnelState represents the current state of a tunnel connection.
@@ -25,6 +43,7 @@ type TunnelState struct {
 	target           string
 	name             string
 	statusMessage    string
+	registration     Registration
 }
 
 // Status represents the connection status of the tunnel.
@@ -81,6 +100,24 @@ func (s *TunnelState) SetURL(url string) {
 	s.url = url
 }
 
+// SetRegistration records the server's registration details. The first URL
+// becomes the tunnel URL.
+func (s *TunnelState) SetRegistration(registration Registration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.registration = registration
+	if len(registration.URLs) > 0 {
+		s.url = registration.URLs[0]
+	}
+}
+
+// GetRegistration returns the server's registration details.
+func (s *TunnelState) GetRegistration() Registration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.registration
+}
+
 // GetStatus returns the current connection status.
 func (s *TunnelState) GetStatus() Status {
 	s.mu.RLock()
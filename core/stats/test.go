@@ -150,6 +150,7 @@ type TestStateProvider struct {
 	url                string
 	target             string
 	connectionDuration time.Duration
+	registration       Registration
 }
 
 func NewTestStateProvider() *TestStateProvider {
@@ -168,6 +169,17 @@ func (p *TestStateProvider) SetURL(url string) {
 	p.url = url
 }
 
+func (p *TestStateProvider) SetRegistration(registration Registration) {
+	p.registration = registration
+	if len(registration.URLs) > 0 {
+		p.url = registration.URLs[0]
+	}
+}
+
+func (p *TestStateProvider) GetRegistration() Registration {
+	return p.registration
+}
+
 func (p *TestStateProvider) GetStatus() Status {
 	return p.status
 }
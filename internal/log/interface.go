@@ -1,8 +1,36 @@
 package log
 
+import "slices"
+
 type Logger interface {
 	Debug(message string, args ...any)
 	Info(message string, args ...any)
 	Warn(message string, args ...any)
 	Error(message string, args ...any)
 }
+
+// With returns a logger that adds args to everything it logs through l.
+func With(l Logger, args ...any) Logger {
+	return withLogger{l, args}
+}
+
+type withLogger struct {
+	Logger
+	args []any
+}
+
+func (l withLogger) Debug(message string, args ...any) {
+	l.Logger.Debug(message, slices.Concat(args, l.args)...)
+}
+
+func (l withLogger) Info(message string, args ...any) {
+	l.Logger.Info(message, slices.Concat(args, l.args)...)
+}
+
+func (l withLogger) Warn(message string, args ...any) {
+	l.Logger.Warn(message, slices.Concat(args, l.args)...)
+}
+
+func (l withLogger) Error(message string, args ...any) {
+	l.Logger.Error(message, slices.Concat(args, l.args)...)
+}
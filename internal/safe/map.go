@@ -36,6 +36,15 @@ func (m *Map[K, V]) Delete(k K) {
 	delete(m.m, k)
 }
 
+// DeleteIf removes k if its current value satisfies f.
+func (m *Map[K, V]) DeleteIf(k K, f func(V) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if v, ok := m.m[k]; ok && f(v) {
+		delete(m.m, k)
+	}
+}
+
 // Range calls f sequentially for each key and value in the map.
 // If f returns false, range stops the iteration.
 // This method acquires a lock for the entire iteration to ensure consistency.
@@ -0,0 +1,74 @@
+package safe
+
+import "sync"
+
+// Queue is a FIFO queue for one producer and one consumer. With a limit,
+// Push blocks while the queue is full; a zero limit makes it unbounded.
+type Queue[T any] struct {
+	mu       sync.Mutex
+	items    []T
+	limit    int
+	notEmpty chan struct{}
+	notFull  chan struct{}
+}
+
+func NewQueue[T any](limit int) *Queue[T] {
+	return &Queue[T]{
+		limit:    limit,
+		notEmpty: make(chan struct{}, 1),
+		notFull:  make(chan struct{}, 1),
+	}
+}
+
+// Push appends v, waiting for room if the queue is full. It returns false
+// if done is closed first.
+func (q *Queue[T]) Push(v T, done <-chan struct{}) bool {
+	for {
+		q.mu.Lock()
+		if q.limit == 0 || len(q.items) < q.limit {
+			q.items = append(q.items, v)
+			q.mu.Unlock()
+			signal(q.notEmpty)
+			return true
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.notFull:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// Pop removes the oldest item, waiting for one if the queue is empty. It
+// returns false if done is closed first.
+func (q *Queue[T]) Pop(done <-chan struct{}) (T, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.items) > 0 {
+			v := q.items[0]
+			var zero T
+			q.items[0] = zero
+			q.items = q.items[1:]
+			q.mu.Unlock()
+			signal(q.notFull)
+			return v, true
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.notEmpty:
+		case <-done:
+			var zero T
+			return zero, false
+		}
+	}
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
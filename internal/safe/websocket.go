@@ -1,6 +1,7 @@
 package safe
 
 import (
+	"errors"
 	"sync"
 	"time"
 
@@ -27,6 +28,10 @@ func (w *WSConn) WriteMessage(messageType int, data []byte) error {
 		return websocket.ErrCloseSent
 	}
 
+	// Pings and pongs are relayed through here too.
+	if messageType == websocket.PingMessage || messageType == websocket.PongMessage {
+		return w.conn.WriteControl(messageType, data, time.Now().Add(time.Second))
+	}
 	return w.conn.WriteMessage(messageType, data)
 }
 
@@ -41,6 +46,14 @@ func (w *WSConn) WriteJSON(v any) error {
 	return w.conn.WriteJSON(v)
 }
 
+// EnableWriteCompression toggles compression of subsequent messages. It only
+// has an effect when permessage-deflate was negotiated for the connection.
+func (w *WSConn) EnableWriteCompression(enable bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.conn.EnableWriteCompression(enable)
+}
+
 func (w *WSConn) Conn() *websocket.Conn {
 	return w.conn
 }
@@ -67,8 +80,55 @@ func (w *WSConn) SetWriteDeadline(t time.Time) error {
 	return w.conn.SetWriteDeadline(t)
 }
 
+// RelayControl hands the pings and pongs the peer sends to relay instead of
+// answering pings here, so they can be passed on end to end.
+func (w *WSConn) RelayControl(relay func(messageType int, data []byte)) {
+	w.conn.SetPingHandler(func(data string) error {
+		relay(websocket.PingMessage, []byte(data))
+		return nil
+	})
+	w.conn.SetPongHandler(func(data string) error {
+		relay(websocket.PongMessage, []byte(data))
+		return nil
+	})
+}
+
+// SetReadLimit caps the size of a message read from the peer. Larger
+// messages close the connection with CloseMessageTooBig.
+func (w *WSConn) SetReadLimit(limit int64) {
+	w.conn.SetReadLimit(limit)
+}
+
+// CloseStatus returns the close code and reason to pass on for err, as
+// returned by ReadMessage.
+func CloseStatus(err error) (int, string) {
+	var closeErr *websocket.CloseError
+	switch {
+	case errors.As(err, &closeErr):
+		return closeErr.Code, closeErr.Text
+	case errors.Is(err, websocket.ErrReadLimit):
+		return websocket.CloseMessageTooBig, "message too big"
+	}
+	return websocket.CloseAbnormalClosure, ""
+}
+
 // CloseWithTimeout forcefully closes the connection with a timeout
 func (w *WSConn) CloseWithTimeout(timeout time.Duration) error {
+	return w.closeWith(websocket.CloseNormalClosure, "", timeout)
+}
+
+// CloseWith closes the connection with code and reason. A zero code is a
+// normal closure; CloseNoStatusReceived sends an empty close frame and the
+// codes that may not be sent (CloseAbnormalClosure, CloseTLSHandshake) drop
+// the connection without one.
+func (w *WSConn) CloseWith(code int, reason string) error {
+	if code == 0 {
+		code = websocket.CloseNormalClosure
+	}
+	return w.closeWith(code, reason, time.Second)
+}
+
+func (w *WSConn) closeWith(code int, reason string, timeout time.Duration) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
@@ -80,11 +140,17 @@ func (w *WSConn) CloseWithTimeout(timeout time.Duration) error {
 	_ = w.conn.SetWriteDeadline(time.Now().Add(timeout))
 
 	// Send a close message, but don't wait indefinitely
-	_ = w.conn.WriteControl(
-		websocket.CloseMessage,
-		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
-		time.Now().Add(timeout),
-	)
+	if code != websocket.CloseAbnormalClosure && code != websocket.CloseTLSHandshake {
+		// Close frames carry at most 123 bytes of reason.
+		if len(reason) > 123 {
+			reason = reason[:123]
+		}
+		_ = w.conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(code, reason),
+			time.Now().Add(timeout),
+		)
+	}
 
 	// Mark as closed
 	w.closed = true
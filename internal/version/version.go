@@ -0,0 +1,19 @@
+package version
+
+import "runtime/debug"
+
+// Version is the release version, set at build time with
+// -ldflags "-X github.com/campbel/tiny-tunnel/internal/version.Version=...".
+var Version = ""
+
+// Get returns the release version, falling back to the module version for
+// `go install` builds and "dev" otherwise.
+func Get() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "dev"
+}
@@ -335,3 +335,138 @@ func TestBufferedRequestsDuringActiveStream(t *testing.T) {
 	require.NoError(t, err)
 	require.NotEmpty(t, line)
 }
+
+// TestStreamedUploadThroughTunnel verifies that a large upload is relayed to
+// the origin byte-identical, with its Content-Length intact.
+func TestStreamedUploadThroughTunnel(t *testing.T) {
+	payload := make([]byte, 4*1024*1024)
+	_, err := rand.Read(payload)
+	require.NoError(t, err)
+
+	type received struct {
+		body          []byte
+		contentLength int64
+	}
+	receivedChan := make(chan received, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		receivedChan <- received{body, r.ContentLength}
+		fmt.Fprintf(w, "%d", len(body))
+	}))
+	defer origin.Close()
+
+	do, tunnelURL := setupStreamingTunnel(t, origin.URL)
+
+	req, err := http.NewRequest("PUT", tunnelURL+"/artifact", bytes.NewReader(payload))
+	require.NoError(t, err)
+	resp, err := do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	got := <-receivedChan
+	require.Equal(t, int64(len(payload)), got.contentLength)
+	require.True(t, bytes.Equal(payload, got.body), "upload must arrive byte-identical")
+}
+
+// TestChunkedUploadReachesOriginBeforeItEnds verifies that a chunked upload
+// starts reaching the origin while the visitor is still sending it.
+func TestChunkedUploadReachesOriginBeforeItEnds(t *testing.T) {
+	firstChunk := make(chan string, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader := bufio.NewReader(r.Body)
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		firstChunk <- line
+		rest, _ := io.ReadAll(reader)
+		fmt.Fprintf(w, "%s%s", line, rest)
+	}))
+	defer origin.Close()
+
+	do, tunnelURL := setupStreamingTunnel(t, origin.URL)
+
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("POST", tunnelURL+"/upload", pr)
+	require.NoError(t, err)
+
+	respChan := make(chan *http.Response, 1)
+	go func() {
+		resp, err := do(req)
+		if assert.NoError(t, err) {
+			respChan <- resp
+		}
+	}()
+
+	_, err = pw.Write([]byte("first\n"))
+	require.NoError(t, err)
+	select {
+	case line := <-firstChunk:
+		require.Equal(t, "first\n", line)
+	case <-time.After(5 * time.Second):
+		t.Fatal("origin did not see the upload before it finished")
+	}
+
+	_, err = pw.Write([]byte("second\n"))
+	require.NoError(t, err)
+	require.NoError(t, pw.Close())
+
+	resp := <-respChan
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "first\nsecond\n", string(body))
+}
+
+// TestSlowStreamConsumerDoesNotStallTunnel opens a fast stream whose visitor
+// never reads it. Flow control must confine the stall to that stream, so
+// other requests keep flowing through the tunnel.
+func TestSlowStreamConsumerDoesNotStallTunnel(t *testing.T) {
+	chunk := bytes.Repeat([]byte("x"), 32*1024)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/firehose":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			flusher := w.(http.Flusher)
+			for {
+				if _, err := w.Write(chunk); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		case "/ping":
+			w.Write([]byte("pong"))
+		}
+	}))
+	defer origin.Close()
+
+	do, tunnelURL := setupStreamingTunnel(t, origin.URL)
+
+	streamReq, err := http.NewRequest("GET", tunnelURL+"/firehose", nil)
+	require.NoError(t, err)
+	streamResp, err := do(streamReq)
+	require.NoError(t, err)
+	defer streamResp.Body.Close()
+
+	// Let the firehose fill every buffer between the origin and the visitor.
+	time.Sleep(500 * time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		req, err := http.NewRequestWithContext(ctx, "GET", tunnelURL+"/ping", nil)
+		require.NoError(t, err)
+		resp, err := do(req)
+		require.NoError(t, err, "request stalled behind the unread stream")
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		cancel()
+		require.NoError(t, err)
+		assert.Equal(t, "pong", string(body))
+	}
+}